@@ -5,13 +5,18 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"time"
 
+	"Syncase-silent-app-main/backend"
 	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+	syncpkg "Syncase-silent-app-main/sync"
 	"Syncase-silent-app-main/uploader"
-	"Syncase-silent-app-main/watcher"
 )
 
+// statsInterval is how often the agent logs and saves transfer stats
+const statsInterval = 5 * time.Minute
+
 func runMain() error {
 	fmt.Println("🚀 Starting Syncase...")
 
@@ -37,41 +42,51 @@ func runMain() error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	log.Printf("[INFO] Config loaded: watchedFolder=%s, remote=%s", cfg.WatchedFolder, cfg.RcloneRemote)
+	log.Printf("[INFO] Config loaded: watchedFolder=%s, remote=%s, pairs=%d", cfg.WatchedFolder, cfg.RcloneRemote, len(cfg.Pairs))
 
-	// Resolve absolute path for watched folder
-	cfg.WatchedFolder, err = filepath.Abs(cfg.WatchedFolder)
+	pairs, err := preparePairs(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to resolve watched folder path: %w", err)
+		return err
 	}
 
-	// Ensure watched folder exists
-	fmt.Println("🗂 Checking watched folder:", cfg.WatchedFolder)
-	info, err := os.Stat(cfg.WatchedFolder)
-	if err != nil {
-		return fmt.Errorf("watched folder error: %w", err)
-	}
-	if !info.IsDir() {
-		return fmt.Errorf("watched path is not a directory: %s", cfg.WatchedFolder)
+	ctx := context.Background()
+
+	// Transfer stats are logged and saved to storage/ while running
+	if err := uploader.LoadStats(); err != nil {
+		log.Println("[WARN] Previous transfer stats not loaded:", err)
 	}
-	fmt.Println("✅ Watched folder ready")
+	defer uploader.SaveStats()
+	go uploader.ReportStats(ctx, statsInterval)
 
-	ctx := context.Background()
+	// Every pair syncs with its own backend, manifest and watcher (blocking)
+	return runPairs(ctx, pairs)
+}
 
-	// Initial remote → local sync to match folders
-	fmt.Println("🔁 Performing initial remote pull to match folders...")
-	if err := uploader.SyncRemoteToLocal(ctx, cfg); err != nil {
-		log.Println("[WARN] Initial remote pull failed:", err)
-	} else {
-		log.Println("[INFO] Remote → Local baseline sync completed")
+// loadKeys unlocks the configured keys. On write-only devices it returns a
+// nil keyring, as they only need their recipients.
+func loadKeys(cfg *config.Config) (*crypto.Keyring, error) {
+	if !crypto.WriteOnly(cfg) {
+		return crypto.LoadKeys(cfg)
+	}
+	if len(cfg.Recipients) == 0 {
+		return nil, fmt.Errorf("key_source %q needs recipients to encrypt to", cfg.KeySource)
 	}
+	return nil, nil
+}
 
-	// Start watcher (blocking)
-	fmt.Println("👀 Starting watcher...")
-	log.Println("[INFO] Starting folder watcher")
-	if err := watcher.StartWatcher(ctx, cfg); err != nil {
-		return fmt.Errorf("watcher exited with error: %w", err)
+// resumeRotation continues a key rotation that was interrupted, if any
+func resumeRotation(ctx context.Context, cfg *config.Config, store backend.Backend, keyring *crypto.Keyring, mf *syncpkg.Manifest) {
+	if !syncpkg.RotationPending(cfg) {
+		return
 	}
 
-	return nil
+	log.Println("[ROTATE] Resuming interrupted key rotation to", keyring.Active().ID)
+	err := syncpkg.RotateRemote(ctx, cfg, store, keyring, mf, func(p syncpkg.RotationProgress) {
+		if p.Current != "" {
+			log.Printf("[ROTATE] %d/%d %s", p.Done+p.Skipped+p.Failed, p.Total, p.Current)
+		}
+	})
+	if err != nil {
+		log.Println("[ROTATE ERROR]", err)
+	}
 }
@@ -0,0 +1,245 @@
+// Package backend abstracts the storage the encrypted tree is kept in, so
+// the sync engine does not depend on how objects get there.
+package backend
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// Object describes a stored object. Paths are slash separated and relative
+// to the root of the backend they were listed from.
+type Object struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Hashes maps a hash name such as "sha256" or "md5" to its lowercase hex
+	// value. Backends only fill in the hashes they get cheaply.
+	Hashes map[string]string
+	// ETag is an opaque version of the content that changes whenever the
+	// content does, empty if the backend has none.
+	ETag string
+}
+
+// Backend stores objects by path. Errors for missing objects wrap
+// fs.ErrNotExist.
+type Backend interface {
+	// Put stores everything read from r at path, replacing any object there.
+	// When reading r fails, the object is left as it was.
+	Put(ctx context.Context, path string, r io.Reader) error
+	// Get opens the object at path for reading. Errors during the transfer
+	// are returned by Read; Close releases it early.
+	Get(ctx context.Context, path string) (io.ReadCloser, error)
+	// List returns every object below dir, "" for the whole backend.
+	List(ctx context.Context, dir string) ([]Object, error)
+	// Stat describes the object at path.
+	Stat(ctx context.Context, path string) (*Object, error)
+	// Delete removes the object at path. Deleting a missing object succeeds.
+	Delete(ctx context.Context, path string) error
+	// Move renames the object at from to to, replacing any object there.
+	Move(ctx context.Context, from, to string) error
+}
+
+// FilePutter is implemented by backends that store a local file better
+// than a stream of it, e.g. by handing its path to rclone.
+type FilePutter interface {
+	PutFile(ctx context.Context, path, localPath string) error
+}
+
+// Mirrorer is implemented by backends that can copy a whole directory to
+// local disk themselves.
+type Mirrorer interface {
+	// Mirror makes localDir an exact copy of the objects below dir. It
+	// returns an error wrapping errors.ErrUnsupported if it cannot.
+	Mirror(ctx context.Context, dir, localDir string) error
+}
+
+// Hasher is implemented by backends that can hash a stored object without
+// the caller downloading it. name is a hash name as used in Object.Hashes.
+type Hasher interface {
+	// Hash returns the hex hash of the object at path. It returns an error
+	// wrapping errors.ErrUnsupported if it cannot compute that hash.
+	Hash(ctx context.Context, path, name string) (string, error)
+}
+
+// HashReporter is implemented by backends that can tell the content hash
+// of a stored object, with the object from Stat or as a Hasher. Uploads
+// compute that hash and verify the stored object by it.
+type HashReporter interface {
+	// ReportedHash returns the name of the hash as used in Object.Hashes,
+	// or "" if there is none uploads can be verified with.
+	ReportedHash(ctx context.Context) string
+}
+
+// Hash returns the named hash of the object at p, asking b if it is a
+// Hasher and downloading the object otherwise.
+func Hash(ctx context.Context, b Backend, p, name string) (string, error) {
+	if hb, ok := b.(Hasher); ok {
+		sum, err := hb.Hash(ctx, p, name)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return sum, err
+		}
+	}
+	h, err := newHash(name)
+	if err != nil {
+		return "", err
+	}
+	r, err := b.Get(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newHash(name string) (hash.Hash, error) {
+	switch name {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "quickxor":
+		return newQuickXor(), nil
+	case "s3etag":
+		return newETagHash(), nil
+	}
+	return nil, fmt.Errorf("hash %q: %w", name, errors.ErrUnsupported)
+}
+
+// NotFound returns an error for a missing object at p that wraps fs.ErrNotExist.
+func NotFound(p string) error {
+	return &fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist}
+}
+
+// Sub returns a backend whose paths are relative to dir within b.
+func Sub(b Backend, dir string) Backend {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	if dir == "" {
+		return b
+	}
+	return &subBackend{b: b, dir: dir}
+}
+
+type subBackend struct {
+	b   Backend
+	dir string
+}
+
+func (s *subBackend) full(p string) string {
+	return path.Join(s.dir, p)
+}
+
+func (s *subBackend) trim(obj Object) Object {
+	obj.Path = strings.TrimPrefix(strings.TrimPrefix(obj.Path, s.dir), "/")
+	return obj
+}
+
+func (s *subBackend) Put(ctx context.Context, p string, r io.Reader) error {
+	return s.b.Put(ctx, s.full(p), r)
+}
+
+func (s *subBackend) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	return s.b.Get(ctx, s.full(p))
+}
+
+func (s *subBackend) List(ctx context.Context, dir string) ([]Object, error) {
+	objects, err := s.b.List(ctx, s.full(dir))
+	for i := range objects {
+		objects[i] = s.trim(objects[i])
+	}
+	return objects, err
+}
+
+func (s *subBackend) Stat(ctx context.Context, p string) (*Object, error) {
+	obj, err := s.b.Stat(ctx, s.full(p))
+	if err != nil {
+		return nil, err
+	}
+	trimmed := s.trim(*obj)
+	return &trimmed, nil
+}
+
+func (s *subBackend) Delete(ctx context.Context, p string) error {
+	return s.b.Delete(ctx, s.full(p))
+}
+
+func (s *subBackend) Move(ctx context.Context, from, to string) error {
+	return s.b.Move(ctx, s.full(from), s.full(to))
+}
+
+func (s *subBackend) Hash(ctx context.Context, p, name string) (string, error) {
+	if hb, ok := s.b.(Hasher); ok {
+		return hb.Hash(ctx, s.full(p), name)
+	}
+	return "", errors.ErrUnsupported
+}
+
+func (s *subBackend) ReportedHash(ctx context.Context) string {
+	return reportedHash(ctx, s.b)
+}
+
+func (s *subBackend) PutFile(ctx context.Context, p, localPath string) error {
+	return PutFile(ctx, s.b, s.full(p), localPath)
+}
+
+func (s *subBackend) Mirror(ctx context.Context, dir, localDir string) error {
+	if m, ok := s.b.(Mirrorer); ok {
+		return m.Mirror(ctx, s.full(dir), localDir)
+	}
+	return errors.ErrUnsupported
+}
+
+// Close releases what b holds open, such as a connection or a helper
+// process, if it has anything to release.
+func Close(b Backend) error {
+	if c, ok := b.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ReadAll reads the whole object at p, e.g. a small metadata file.
+func ReadAll(ctx context.Context, b Backend, p string) ([]byte, error) {
+	r, err := b.Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", p, err)
+	}
+	return data, nil
+}
+
+// ReadHead returns up to the first n bytes of the object at p, e.g. to
+// inspect an encrypted file header without downloading the whole file.
+func ReadHead(ctx context.Context, b Backend, p string, n int) ([]byte, error) {
+	r, err := b.Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	head := make([]byte, n)
+	read, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:read], nil
+}
@@ -0,0 +1,190 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrorClass is the kind of a storage failure, which decides whether and
+// how long to wait before trying again.
+type ErrorClass int
+
+const (
+	// ClassUnknown is any other failure, retried with the usual backoff
+	ClassUnknown ErrorClass = iota
+	// ClassNotFound is a missing object or directory
+	ClassNotFound
+	// ClassAuthExpired is a rejected login or an expired token, which
+	// needs the remote to be reconnected
+	ClassAuthExpired
+	// ClassQuotaExceeded is a full remote
+	ClassQuotaExceeded
+	// ClassRateLimited is the remote asking to slow down
+	ClassRateLimited
+	// ClassNetwork is a remote that cannot be reached
+	ClassNetwork
+	// ClassPermissionDenied is an operation the account may not perform
+	ClassPermissionDenied
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassNotFound:
+		return "not found"
+	case ClassAuthExpired:
+		return "auth expired"
+	case ClassQuotaExceeded:
+		return "quota exceeded"
+	case ClassRateLimited:
+		return "rate limited"
+	case ClassNetwork:
+		return "network unreachable"
+	case ClassPermissionDenied:
+		return "permission denied"
+	}
+	return "unknown"
+}
+
+// Error is a failure of a known class. Missing objects also match
+// fs.ErrNotExist and denied operations fs.ErrPermission.
+type Error struct {
+	Class ErrorClass
+	Op    string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Op, e.Class, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Class == ClassNotFound
+	case fs.ErrPermission:
+		return e.Class == ClassPermissionDenied
+	}
+	return false
+}
+
+// ErrorClass lets Classify find the class of an Error.
+func (e *Error) ErrorClass() ErrorClass { return e.Class }
+
+// Classify returns the class of err. Backends report it through an error
+// with an ErrorClass method, such as Error; missing files, denied
+// operations and network failures are recognised by themselves.
+func Classify(err error) ErrorClass {
+	var classified interface{ ErrorClass() ErrorClass }
+	if errors.As(err, &classified) {
+		if c := classified.ErrorClass(); c != ClassUnknown {
+			return c
+		}
+	}
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ClassNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ClassPermissionDenied
+	case errors.As(err, &opErr), errors.As(err, &netErr),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return ClassNetwork
+	}
+	return ClassUnknown
+}
+
+// HTTPClass maps the status of a failed HTTP request to its class.
+func HTTPClass(status int) ErrorClass {
+	switch status {
+	case http.StatusNotFound:
+		return ClassNotFound
+	case http.StatusUnauthorized:
+		return ClassAuthExpired
+	case http.StatusForbidden:
+		return ClassPermissionDenied
+	case http.StatusTooManyRequests:
+		return ClassRateLimited
+	case http.StatusInsufficientStorage, http.StatusRequestEntityTooLarge:
+		return ClassQuotaExceeded
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return ClassNetwork
+	}
+	return ClassUnknown
+}
+
+// quotaPause is how long uploads stop after the remote reports it is full
+const quotaPause = 30 * time.Minute
+
+// pauses holds until when uploads to each backend are paused, by the
+// backend below any Sub, so one full remote does not stop the others.
+var pauses sync.Map // Backend -> time.Time
+
+// pauseKey returns the backend b is a part of
+func pauseKey(b Backend) Backend {
+	if s, ok := b.(*subBackend); ok {
+		return pauseKey(s.b)
+	}
+	return b
+}
+
+// pausedUntil returns when uploads to b may resume, or the zero time if
+// they are not paused.
+func pausedUntil(b Backend) time.Time {
+	v, ok := pauses.Load(pauseKey(b))
+	if !ok || time.Now().After(v.(time.Time)) {
+		return time.Time{}
+	}
+	return v.(time.Time)
+}
+
+func pauseUploads(b Backend, d time.Duration) {
+	until := time.Now().Add(d)
+	pauses.Store(pauseKey(b), until)
+	log.Printf("[BACKOFF] Remote quota exceeded, pausing uploads until %s", until.Format(time.TimeOnly))
+}
+
+// backoffAfter waits before retry number attempt of an operation on b that
+// failed with err, as long as suits its class. It reports false, without
+// waiting, when trying again cannot help, and when ctx is done.
+func backoffAfter(ctx context.Context, b Backend, err error, attempt int) bool {
+	switch class := Classify(err); class {
+	case ClassNotFound, ClassAuthExpired, ClassPermissionDenied:
+		return false
+	case ClassQuotaExceeded:
+		pauseUploads(b, quotaPause)
+		return false
+	case ClassRateLimited:
+		// Remotes count requests over minutes, so wait long enough to matter
+		wait := time.Duration(attempt) * 30 * time.Second
+		if wait > 5*time.Minute {
+			wait = 5 * time.Minute
+		}
+		log.Printf("[BACKOFF] Rate limited, waiting %v before retry (attempt %d)", wait, attempt)
+		return sleep(ctx, wait) == nil
+	}
+	return Backoff(ctx, attempt) == nil
+}
+
+// sleep waits for d, or returns ctx's error once it is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuotaPausePerBackend(t *testing.T) {
+	full, other := NewLocal(t.TempDir()), NewLocal(t.TempDir())
+	t.Cleanup(func() { pauses.Delete(full) })
+
+	quota := &Error{Class: ClassQuotaExceeded, Op: "upload", Err: errors.New("storage full")}
+	if backoffAfter(context.Background(), Sub(full, "pair"), quota, 1) {
+		t.Error("retrying while over quota")
+	}
+	// Every pair on the full remote is paused, other remotes are not
+	if pausedUntil(Sub(full, "other pair")).IsZero() {
+		t.Error("uploads to the full remote not paused")
+	}
+	if !pausedUntil(other).IsZero() {
+		t.Error("uploads to another remote paused")
+	}
+	_, err := withRetries(context.Background(), Sub(full, "pair"), "obj", "", func() (uploadSum, error) {
+		t.Error("upload attempted while paused")
+		return uploadSum{}, nil
+	})
+	if Classify(err) != ClassQuotaExceeded {
+		t.Errorf("upload to a paused remote: %v", err)
+	}
+}
+
+func TestBackoffCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := Backoff(ctx, 3); !errors.Is(err, context.Canceled) {
+		t.Errorf("backoff after cancel: %v", err)
+	}
+	limited := &Error{Class: ClassRateLimited, Op: "upload", Err: errors.New("slow down")}
+	if backoffAfter(ctx, NewLocal(t.TempDir()), limited, 1) {
+		t.Error("retrying after cancel")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("canceled backoff took %v", d)
+	}
+}
@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix starts the name of every file Local or WebDAV is still
+// writing. List leaves such files out, so it is reserved for them.
+const tempPrefix = ".syncase-tmp-"
+
+// Local is a backend that keeps objects as files below a plain directory,
+// such as a NAS mount, a USB drive or a temporary folder.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a backend storing objects below the directory root.
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// file returns the local path of p, which cannot leave the root
+func (l *Local) file(p string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// Put writes to a temporary file next to the object and renames it into
+// place, so readers never see a partial object.
+func (l *Local) Put(ctx context.Context, p string, r io.Reader) error {
+	dest := l.file(p)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, &ctxReader{ctx: ctx, r: r}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (l *Local) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	f, err := os.Open(l.file(p))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *Local) List(ctx context.Context, dir string) ([]Object, error) {
+	base := l.file(dir)
+	var objects []Object
+	err := filepath.WalkDir(base, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if file == base && errors.Is(err, fs.ErrNotExist) {
+				// Nothing has been stored yet
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, file)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *Local) Stat(ctx context.Context, p string) (*Object, error) {
+	info, err := os.Stat(l.file(p))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, NotFound(p)
+	}
+	return &Object{Path: p, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, p string) error {
+	file := l.file(p)
+	if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	l.pruneDirs(filepath.Dir(file))
+	return nil
+}
+
+func (l *Local) Move(ctx context.Context, from, to string) error {
+	src, dest := l.file(from), l.file(to)
+	if info, err := os.Stat(src); err != nil {
+		return err
+	} else if info.IsDir() {
+		return NotFound(from)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dest); err != nil {
+		return err
+	}
+	l.pruneDirs(filepath.Dir(src))
+	return nil
+}
+
+// Hash computes the named hash of the object at p from the file itself.
+func (l *Local) Hash(ctx context.Context, p, name string) (string, error) {
+	h, err := newHash(name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(l.file(p))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, &ctxReader{ctx: ctx, r: f}); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReportedHash is SHA-256, which Local computes as a Hasher and the sync
+// needs of every upload anyway.
+func (l *Local) ReportedHash(ctx context.Context) string {
+	return "sha256"
+}
+
+// pruneDirs removes dir and its parents up to the root while they are
+// empty, the way object stores have no empty directories.
+func (l *Local) pruneDirs(dir string) {
+	root := filepath.Clean(l.root)
+	for dir != root && strings.HasPrefix(dir, root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// ctxReader stops a copy once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
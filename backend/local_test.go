@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalListTempFiles(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	l := NewLocal(root)
+
+	// Names that merely contain the old temporary marker are objects too
+	want := []string{"a", "dir/report.tmp-final.docx"}
+	for _, p := range want {
+		if err := l.Put(ctx, p, strings.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A file still being written is not
+	if err := os.WriteFile(filepath.Join(root, "dir", tempPrefix+"123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := l.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, obj := range objects {
+		got = append(got, obj.Path)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+}
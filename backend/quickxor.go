@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+const (
+	quickXorWidth = 160 // bits of state
+	quickXorShift = 11  // bits between the positions of consecutive bytes
+	quickXorSize  = quickXorWidth / 8
+)
+
+// quickXor is Microsoft's QuickXorHash, the only content hash OneDrive
+// reports. Every byte is XORed into a 160-bit vector at a position 11 bits
+// on from the previous one, and the total length into the last 64 bits.
+type quickXor struct {
+	data   [quickXorSize]byte
+	shift  int
+	length uint64
+}
+
+func newQuickXor() hash.Hash { return &quickXor{} }
+
+func (q *quickXor) Write(p []byte) (int, error) {
+	for _, b := range p {
+		i, off := q.shift/8, q.shift%8
+		v := uint16(b) << off
+		q.data[i] ^= byte(v)
+		// Bits past the end of the vector wrap around to its start
+		q.data[(i+1)%quickXorSize] ^= byte(v >> 8)
+		q.shift = (q.shift + quickXorShift) % quickXorWidth
+	}
+	q.length += uint64(len(p))
+	return len(p), nil
+}
+
+func (q *quickXor) Sum(b []byte) []byte {
+	sum := q.data
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], q.length)
+	for i, c := range length {
+		sum[quickXorSize-8+i] ^= c
+	}
+	return append(b, sum[:]...)
+}
+
+func (q *quickXor) Reset() { *q = quickXor{} }
+
+func (q *quickXor) Size() int { return quickXorSize }
+
+func (q *quickXor) BlockSize() int { return 64 }
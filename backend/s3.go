@@ -0,0 +1,572 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// s3MaxCopySize is the largest object a single CopyObject can copy
+const s3MaxCopySize = 5 << 30
+
+// s3PartSize is the size of every part but the last of a multipart upload;
+// smaller objects are uploaded in one request. The "s3etag" hash splits
+// its input the same way.
+var s3PartSize = 16 << 20
+
+// S3Options configures an S3 backend.
+type S3Options struct {
+	Endpoint        string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region          string // "us-east-1" if empty
+	Bucket          string
+	Prefix          string // objects are stored below this key prefix
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// S3 is a backend talking to S3-compatible object storage directly, with
+// path-style requests so it works against MinIO and similar servers too.
+type S3 struct {
+	opts     S3Options
+	endpoint *url.URL
+	prefix   string
+	client   *http.Client
+	// opaqueETags is set once the bucket turned out to encrypt uploads
+	// with SSE-KMS or SSE-C, whose ETags are not MD5s of the content
+	opaqueETags atomic.Bool
+}
+
+// NewS3 returns a backend storing objects in the bucket described by opts.
+func NewS3(opts S3Options) (*S3, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3: no bucket configured")
+	}
+	if opts.AccessKeyID == "" || opts.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3: no credentials configured")
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", opts.Endpoint)
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{
+		opts:     opts,
+		endpoint: endpoint,
+		prefix:   strings.Trim(opts.Prefix, "/"),
+		client:   client,
+	}, nil
+}
+
+// key returns the object key of p
+func (s *S3) key(p string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, path.Clean("/"+p)), "/")
+}
+
+// s3Error is an error response of the server. Missing keys unwrap to
+// fs.ErrNotExist.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s (HTTP %d)", e.Code, e.Message, e.Status)
+}
+
+func (e *s3Error) Unwrap() error {
+	if e.Status == http.StatusNotFound || e.Code == "NoSuchKey" {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// ErrorClass maps the error code, or the status if there is none, to a
+// class for retries.
+func (e *s3Error) ErrorClass() ErrorClass {
+	switch e.Code {
+	case "SlowDown", "RequestLimitExceeded", "Throttling", "ThrottlingException", "TooManyRequests":
+		return ClassRateLimited
+	case "ExpiredToken", "TokenRefreshRequired", "InvalidAccessKeyId", "InvalidToken", "SignatureDoesNotMatch":
+		return ClassAuthExpired
+	case "QuotaExceeded", "EntityTooLarge", "XMinioStorageFull":
+		return ClassQuotaExceeded
+	case "NoSuchKey", "NoSuchBucket":
+		return ClassNotFound
+	case "AccessDenied", "AllAccessDisabled":
+		return ClassPermissionDenied
+	}
+	if e.Status == http.StatusServiceUnavailable {
+		// S3 answers 503 to requests it wants spread out
+		return ClassRateLimited
+	}
+	return HTTPClass(e.Status)
+}
+
+// parseError reads an error document; body may be empty, as for HEAD.
+func parseError(status int, body []byte) error {
+	e := &s3Error{Status: status}
+	var doc struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &doc) == nil {
+		e.Code, e.Message = doc.Code, doc.Message
+	}
+	return e
+}
+
+// do sends a signed request for key and returns the response of a
+// successful one; any other status is turned into an error.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.opts.Bucket + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		payloadHash = sha256Hex(body)
+	}
+	signV4(req, s.opts.AccessKeyID, s.opts.SecretAccessKey, s.opts.SessionToken, s.opts.Region, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		return nil, parseError(resp.StatusCode, data)
+	}
+	return resp, nil
+}
+
+// doXML sends a request and decodes its XML response into out. Some
+// operations report failures in the body of a 200 response, so an error
+// document is checked for first.
+func (s *S3) doXML(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte, out any) error {
+	resp, err := s.do(ctx, method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var root struct{ XMLName xml.Name }
+	if xml.Unmarshal(data, &root) == nil && root.XMLName.Local == "Error" {
+		return parseError(resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("s3: unexpected response: %w", err)
+	}
+	return nil
+}
+
+// Put uploads objects up to one part in a single request and larger ones
+// as a multipart upload. Every request carries the MD5 of its body, which
+// the server checks it against.
+func (s *S3) Put(ctx context.Context, p string, r io.Reader) error {
+	key := s.key(p)
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(ctx, key, buf[:n])
+	}
+	if err != nil {
+		return err
+	}
+	return s.putMultipart(ctx, key, buf, r)
+}
+
+func (s *S3) putObject(ctx context.Context, key string, data []byte) error {
+	sum := md5.Sum(data)
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	resp, err := s.do(ctx, http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.checkETag(key, resp.Header.Get("ETag"), hex.EncodeToString(sum[:]), sseETags(resp.Header))
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads buf, which is full, and the rest of r part by part.
+// A failed upload is aborted so no parts are left behind.
+func (s *S3) putMultipart(ctx context.Context, key string, buf []byte, r io.Reader) (err error) {
+	var initiated struct{ UploadId string }
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if err := s.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, &initiated); err != nil {
+		return err
+	}
+	uploadID := initiated.UploadId
+	defer func() {
+		if err != nil {
+			s.abortMultipart(key, uploadID)
+		}
+	}()
+
+	var parts []completedPart
+	var sums []byte
+	var sse bool
+	data := buf
+	for {
+		sum := md5.Sum(data)
+		partHeader := http.Header{}
+		partHeader.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		query := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {uploadID}}
+		resp, err := s.do(ctx, http.MethodPut, key, query, partHeader, data)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		sse = sse || sseETags(resp.Header)
+		if err := s.checkETag(key, etag, hex.EncodeToString(sum[:]), sse); err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: etag})
+		sums = append(sums, sum[:]...)
+
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		data = buf[:n]
+	}
+
+	etag, err := s.completeMultipart(ctx, key, uploadID, parts)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(sums)
+	return s.checkETag(key, etag, fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(parts)), sse)
+}
+
+// abortMultipart drops the parts of a failed upload. It uses a context of
+// its own, the upload may have failed because the caller's is done.
+func (s *S3) abortMultipart(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if resp, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// completeMultipart assembles the parts and returns the ETag of the result.
+func (s *S3) completeMultipart(ctx context.Context, key, uploadID string, parts []completedPart) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	var completed struct{ ETag string }
+	if err := s.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, &completed); err != nil {
+		return "", err
+	}
+	return completed.ETag, nil
+}
+
+// sseETags reports whether a response is for an object encrypted with
+// SSE-KMS or SSE-C, whose ETag is not derived from the content.
+func sseETags(header http.Header) bool {
+	return strings.HasPrefix(header.Get("X-Amz-Server-Side-Encryption"), "aws:kms") ||
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != ""
+}
+
+// checkETag compares the ETag the server gave an upload with want, the
+// MD5 of a single part or the MD5 of the part MD5s and the number of parts
+// of a multipart upload. Any difference fails the upload, unless the
+// object is encrypted with SSE-KMS or SSE-C: then the bucket's ETags are
+// not reported as hashes from then on.
+func (s *S3) checkETag(key, etag, want string, sse bool) error {
+	if sse {
+		if s.opaqueETags.CompareAndSwap(false, true) {
+			log.Printf("[S3] Bucket %s encrypts with SSE-KMS or SSE-C; ETags are not used as hashes", s.opts.Bucket)
+		}
+		return nil
+	}
+	if got := strings.ToLower(strings.Trim(etag, `"`)); got != want {
+		return fmt.Errorf("%w: ETag of %s is %s, uploaded %s", ErrUploadMismatch, key, got, want)
+	}
+	return nil
+}
+
+// etagHashes returns the hashes an ETag stands for: "s3etag" for every
+// ETag, and "md5" for those of objects uploaded in one part. The part
+// count of a multipart ETag is left out, the object's size implies it.
+func etagHashes(etag string) map[string]string {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	sum, parts, multipart := strings.Cut(etag, "-")
+	if len(sum) != 32 {
+		return nil
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return nil
+	}
+	if multipart {
+		if _, err := strconv.Atoi(parts); err != nil {
+			return nil
+		}
+		return map[string]string{"s3etag": sum}
+	}
+	return map[string]string{"s3etag": sum, "md5": sum}
+}
+
+func (s *S3) object(key string, size int64, modTime time.Time, etag string) Object {
+	obj := Object{
+		Path:    strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/"),
+		Size:    size,
+		ModTime: modTime,
+		ETag:    strings.Trim(etag, `"`),
+	}
+	if !s.opaqueETags.Load() {
+		obj.Hashes = etagHashes(etag)
+	}
+	return obj
+}
+
+// ReportedHash is the ETag of objects as Put uploads them, unless the
+// bucket encrypts with SSE-KMS or SSE-C.
+func (s *S3) ReportedHash(ctx context.Context) string {
+	if s.opaqueETags.Load() {
+		return ""
+	}
+	return "s3etag"
+}
+
+// etagHash computes the "s3etag" hash: the ETag S3 gives an upload by Put
+// without its part count. That is the MD5 of data smaller than a part and
+// the MD5 of the MD5s of its s3PartSize parts otherwise.
+type etagHash struct {
+	part hash.Hash
+	n    int
+	sums []byte
+}
+
+func newETagHash() *etagHash {
+	return &etagHash{part: md5.New()}
+}
+
+func (h *etagHash) Write(b []byte) (int, error) {
+	written := len(b)
+	for len(b) > 0 {
+		n := min(len(b), s3PartSize-h.n)
+		h.part.Write(b[:n])
+		h.n += n
+		b = b[n:]
+		if h.n == s3PartSize {
+			h.sums = h.part.Sum(h.sums)
+			h.part.Reset()
+			h.n = 0
+		}
+	}
+	return written, nil
+}
+
+func (h *etagHash) Sum(b []byte) []byte {
+	if len(h.sums) == 0 {
+		return h.part.Sum(b)
+	}
+	sums := h.sums
+	if h.n > 0 {
+		sums = h.part.Sum(slices.Clip(sums))
+	}
+	sum := md5.Sum(sums)
+	return append(b, sum[:]...)
+}
+
+func (h *etagHash) Reset() {
+	h.part.Reset()
+	h.n = 0
+	h.sums = nil
+}
+
+func (h *etagHash) Size() int      { return md5.Size }
+func (h *etagHash) BlockSize() int { return md5.BlockSize }
+
+func (s *S3) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(p), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) List(ctx context.Context, dir string) ([]Object, error) {
+	prefix := s.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+				ETag         string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := s.doXML(ctx, http.MethodGet, "", query, nil, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				// Folder placeholder made by some tools
+				continue
+			}
+			objects = append(objects, s.object(c.Key, c.Size, c.LastModified, c.ETag))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(ctx context.Context, p string) (*Object, error) {
+	key := s.key(p)
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	obj := s.object(key, resp.ContentLength, modTime, resp.Header.Get("ETag"))
+	if sseETags(resp.Header) {
+		obj.Hashes = nil
+	}
+	return &obj, nil
+}
+
+func (s *S3) Delete(ctx context.Context, p string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.key(p), nil, nil, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Already gone
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Move copies the object on the server, in parts if it is too large for a
+// single copy, and deletes the original.
+func (s *S3) Move(ctx context.Context, from, to string) error {
+	src, err := s.Stat(ctx, from)
+	if err != nil {
+		return err
+	}
+	source := "/" + s.opts.Bucket + "/" + uriEncode(s.key(from), false)
+	dest := s.key(to)
+
+	if src.Size <= s3MaxCopySize {
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", source)
+		if err := s.doXML(ctx, http.MethodPut, dest, nil, header, nil, nil); err != nil {
+			return err
+		}
+	} else if err := s.copyMultipart(ctx, source, dest, src.Size); err != nil {
+		return err
+	}
+	return s.Delete(ctx, from)
+}
+
+func (s *S3) copyMultipart(ctx context.Context, source, dest string, size int64) (err error) {
+	var initiated struct{ UploadId string }
+	if err := s.doXML(ctx, http.MethodPost, dest, url.Values{"uploads": {""}}, nil, nil, &initiated); err != nil {
+		return err
+	}
+	uploadID := initiated.UploadId
+	defer func() {
+		if err != nil {
+			s.abortMultipart(dest, uploadID)
+		}
+	}()
+
+	var parts []completedPart
+	for start := int64(0); start < size; start += s3MaxCopySize {
+		end := min(start+s3MaxCopySize, size) - 1
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", source)
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		query := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {uploadID}}
+		var copied struct{ ETag string }
+		if err := s.doXML(ctx, http.MethodPut, dest, query, header, nil, &copied); err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: copied.ETag})
+	}
+	// The copied parts carry no MD5 of ours to check the result against
+	_, err = s.completeMultipart(ctx, dest, uploadID, parts)
+	return err
+}
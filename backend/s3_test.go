@@ -0,0 +1,417 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process server with the part of the S3 API the backend
+// uses, for a single bucket.
+type fakeS3 struct {
+	// pageSize is the number of keys per page of a listing
+	pageSize int
+	// opaqueETags makes ETags random and objects encrypted with SSE-KMS
+	opaqueETags bool
+	// badETags makes ETags random without any encryption
+	badETags bool
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3) {
+	f := &fakeS3{pageSize: 2, objects: make(map[string][]byte), etags: make(map[string]string), uploads: make(map[string]map[int][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s, err := NewS3(S3Options{
+		Endpoint:        srv.URL,
+		Bucket:          "bucket",
+		Prefix:          "root",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partSize := s3PartSize
+	s3PartSize = 1024
+	t.Cleanup(func() { s3PartSize = partSize })
+	return f, s
+}
+
+func (f *fakeS3) etag(data []byte) string {
+	if f.opaqueETags || f.badETags {
+		b := make([]byte, 16)
+		rand.Read(b)
+		return `"` + hex.EncodeToString(b) + `"`
+	}
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// store keeps data at key with its ETag and returns the ETag
+func (f *fakeS3) store(w http.ResponseWriter, key string, data []byte, etag string) string {
+	f.objects[key] = data
+	f.etags[key] = etag
+	f.encrypted(w)
+	return etag
+}
+
+// objectETag returns the ETag of the object at key
+func (f *fakeS3) objectETag(key string) string {
+	if etag, ok := f.etags[key]; ok {
+		return etag
+	}
+	return f.etag(f.objects[key])
+}
+
+// encrypted marks a response as for an object encrypted with SSE-KMS if
+// the server encrypts
+func (f *fakeS3) encrypted(w http.ResponseWriter) {
+	if f.opaqueETags {
+		w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	}
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		f.fail(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, q.Get("prefix"), q.Get("continuation-token"))
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			data := f.objects[strings.TrimPrefix(src, "/bucket/")]
+			var start, end int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			parts[n] = data[start : end+1]
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", f.etag(parts[n]))
+			return
+		}
+		if !f.checkMD5(w, r, body) {
+			return
+		}
+		parts[n] = body
+		f.encrypted(w)
+		w.Header().Set("ETag", f.etag(body))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var doc struct {
+			Part []struct{ PartNumber int }
+		}
+		xml.Unmarshal(body, &doc)
+		var data, sums []byte
+		for _, p := range doc.Part {
+			data = append(data, parts[p.PartNumber]...)
+			sum := md5.Sum(parts[p.PartNumber])
+			sums = append(sums, sum[:]...)
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		sum := md5.Sum(sums)
+		etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(doc.Part))
+		if f.opaqueETags || f.badETags {
+			etag = f.etag(nil)
+		}
+		f.store(w, key, data, etag)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", etag)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		data, ok := f.objects[strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/bucket/")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", f.store(w, key, data, f.etag(data)))
+	case r.Method == http.MethodPut:
+		if !f.checkMD5(w, r, body) {
+			return
+		}
+		w.Header().Set("ETag", f.store(w, key, body, f.etag(body)))
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.encrypted(w)
+		w.Header().Set("ETag", f.objectETag(key))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.etags, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) checkMD5(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	sum := md5.Sum(body)
+	if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		f.fail(w, http.StatusBadRequest, "BadDigest")
+		return false
+	}
+	return true
+}
+
+// list answers ListObjectsV2 in pages of pageSize keys; the continuation
+// token is the last key of the previous page.
+func (f *fakeS3) list(w http.ResponseWriter, prefix, token string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > f.pageSize
+	if truncated {
+		keys = keys[:f.pageSize]
+	}
+	var b bytes.Buffer
+	b.WriteString("<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified><ETag>%s</ETag></Contents>",
+			key, len(f.objects[key]), time.Now().UTC().Format(time.RFC3339), f.objectETag(key))
+	}
+	fmt.Fprintf(&b, "<IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(&b, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	b.WriteString("</ListBucketResult>")
+	w.Write(b.Bytes())
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestS3PutGet(t *testing.T) {
+	ctx := context.Background()
+	f, s := newFakeS3(t)
+
+	for name, size := range map[string]int{"small": 100, "empty": 0, "multipart": 2*1024 + 10, "exact": 1024} {
+		data := randomBytes(t, size)
+		if err := s.Put(ctx, "dir/"+name, bytes.NewReader(data)); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+		if got := f.objects["root/dir/"+name]; !bytes.Equal(got, data) {
+			t.Errorf("%s: server holds %d bytes, want %d", name, len(got), len(data))
+		}
+		got, err := ReadAll(ctx, s, "dir/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: read back %d bytes, want %d", name, len(got), len(data))
+		}
+		obj, err := s.Stat(ctx, "dir/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Path != "dir/"+name || obj.Size != int64(size) {
+			t.Errorf("%s: stat = %s %d bytes", name, obj.Path, obj.Size)
+		}
+	}
+	if len(f.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open", len(f.uploads))
+	}
+	if _, err := s.Stat(ctx, "missing"); Classify(err) != ClassNotFound {
+		t.Errorf("stat of a missing object: %v", err)
+	}
+}
+
+func TestS3OpaqueETags(t *testing.T) {
+	ctx := context.Background()
+	f, s := newFakeS3(t)
+	f.opaqueETags = true
+
+	for _, size := range []int{100, 3000} {
+		if err := s.Put(ctx, "obj", bytes.NewReader(randomBytes(t, size))); err != nil {
+			t.Fatalf("put of %d bytes with SSE ETags: %v", size, err)
+		}
+	}
+	obj, err := s.Stat(ctx, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Hashes["md5"] != "" {
+		t.Errorf("ETag %s reported as MD5 after the server returned non-MD5 ETags", obj.ETag)
+	}
+	if h := s.ReportedHash(ctx); h != "" {
+		t.Errorf("bucket with SSE-KMS reports %s", h)
+	}
+}
+
+func TestS3ETagHash(t *testing.T) {
+	ctx := context.Background()
+	_, s := newFakeS3(t)
+
+	for _, size := range []int{0, 100, 1023, 1024, 2*1024 + 10, 3 * 1024} {
+		data := randomBytes(t, size)
+		if err := s.Put(ctx, "obj", bytes.NewReader(data)); err != nil {
+			t.Fatalf("put of %d bytes: %v", size, err)
+		}
+		obj, err := s.Stat(ctx, "obj")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _ := newHash("s3etag")
+		h.Write(data)
+		if want := hex.EncodeToString(h.Sum(nil)); obj.Hashes["s3etag"] != want {
+			t.Errorf("%d bytes: ETag %s reported as %q, computed %s", size, obj.ETag, obj.Hashes["s3etag"], want)
+		}
+		// Only ETags of single part uploads are MD5s
+		sum := md5.Sum(data)
+		if multipart := size >= 1024; multipart != (obj.Hashes["md5"] == "") || !multipart && obj.Hashes["md5"] != hex.EncodeToString(sum[:]) {
+			t.Errorf("%d bytes: ETag %s reported as MD5 %q", size, obj.ETag, obj.Hashes["md5"])
+		}
+	}
+
+	// Uploads of several parts are verified by it
+	write, _ := encrypted(t)
+	if _, err := Upload(ctx, s, "enc", write); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestS3BadETags(t *testing.T) {
+	ctx := context.Background()
+	f, s := newFakeS3(t)
+	f.badETags = true
+
+	// Without server-side encryption another ETag is another object
+	for _, size := range []int{100, 3000} {
+		if err := s.Put(ctx, "obj", bytes.NewReader(randomBytes(t, size))); !errors.Is(err, ErrUploadMismatch) {
+			t.Errorf("put of %d bytes with wrong ETags: %v", size, err)
+		}
+	}
+	if h := s.ReportedHash(ctx); h != "s3etag" {
+		t.Errorf("reported hash %q after a mismatch, want s3etag", h)
+	}
+}
+
+func TestS3ListPages(t *testing.T) {
+	ctx := context.Background()
+	f, s := newFakeS3(t)
+
+	want := []string{"a", "b/c", "b/d", "e", "f/g/h"}
+	for _, p := range want {
+		if err := s.Put(ctx, p, strings.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Outside the prefix and a folder placeholder
+	f.objects["other/x"] = []byte("x")
+	f.objects["root/b/"] = nil
+
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, obj := range objects {
+		got = append(got, obj.Path)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+
+	objects, err = s.List(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Path != "b/c" || objects[1].Path != "b/d" {
+		t.Errorf("listing of b = %v", objects)
+	}
+}
+
+func TestS3MoveDelete(t *testing.T) {
+	ctx := context.Background()
+	f, s := newFakeS3(t)
+
+	if err := s.Put(ctx, "from", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Move(ctx, "from", "to/here"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.objects["root/from"]; ok {
+		t.Error("moved object still at its old key")
+	}
+	if got := string(f.objects["root/to/here"]); got != "content" {
+		t.Errorf("moved object holds %q", got)
+	}
+	if err := s.Move(ctx, "from", "elsewhere"); Classify(err) != ClassNotFound {
+		t.Errorf("move of a missing object: %v", err)
+	}
+
+	if err := s.Delete(ctx, "to/here"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("objects left after delete: %v", f.objects)
+	}
+	if err := s.Delete(ctx, "to/here"); err != nil {
+		t.Errorf("delete of a missing object: %v", err)
+	}
+}
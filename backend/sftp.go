@@ -0,0 +1,438 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sftpBatch is how much of an upload is written before waiting for the
+	// server to acknowledge it; a dropped connection costs at most a batch
+	sftpBatch = 1 << 20
+	// maxResumes bounds how often one upload reconnects and carries on
+	maxResumes = 3
+	// partPrefix starts the name of every file still being uploaded
+	partPrefix = ".syncase-part-"
+	// partMaxAge is how long a partial file is kept after its last write
+	partMaxAge = 24 * time.Hour
+)
+
+// SFTPOptions configures an SFTP backend.
+type SFTPOptions struct {
+	Addr string // host:port
+	User string
+	// PrivateKey is the PEM encoded key to log in with, decrypted with
+	// Passphrase if it is protected
+	PrivateKey []byte
+	Passphrase string
+	// HostKey pins the server's key, as an authorized_keys style line
+	// ("ssh-ed25519 AAAA...") or a fingerprint ("SHA256:...")
+	HostKey string
+	// Root is the directory objects are stored below, relative to the
+	// login directory unless absolute
+	Root string
+}
+
+// SFTP is a backend storing objects as files on an SFTP server. Uploads go
+// to a partial file that is renamed into place once complete, and carry on
+// where they stopped when the connection drops.
+type SFTP struct {
+	addr   string
+	root   string
+	config *ssh.ClientConfig
+	// backoff waits before an upload reconnects
+	backoff func(ctx context.Context, attempt int) error
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+	// lost is closed once the connection of client has ended
+	lost chan struct{}
+}
+
+// NewSFTP returns a backend for the server described by opts. It connects
+// on first use.
+func NewSFTP(opts SFTPOptions) (*SFTP, error) {
+	if opts.Addr == "" || opts.User == "" {
+		return nil, fmt.Errorf("sftp: host and user must be configured")
+	}
+	if opts.HostKey == "" {
+		return nil, fmt.Errorf("sftp: no host key configured to pin the server to")
+	}
+	hostKey, err := pinHostKey(opts.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if opts.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(opts.PrivateKey, []byte(opts.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(opts.PrivateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sftp: invalid private key: %w", err)
+	}
+	root := strings.TrimSuffix(opts.Root, "/")
+	if root == "" {
+		root = "."
+	}
+	return &SFTP{
+		addr:    opts.Addr,
+		root:    root,
+		backoff: Backoff,
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKey,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// pinHostKey accepts only the server key described by pin.
+func pinHostKey(pin string) (ssh.HostKeyCallback, error) {
+	pin = strings.TrimSpace(pin)
+	if strings.HasPrefix(pin, "SHA256:") {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != pin {
+				return fmt.Errorf("sftp: host key %s does not match pinned %s", got, pin)
+			}
+			return nil
+		}, nil
+	}
+	want, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pin))
+	if err != nil {
+		return nil, fmt.Errorf("sftp: invalid host key: %w", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), want.Marshal()) {
+			return fmt.Errorf("sftp: host key %s does not match pinned %s",
+				ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(want))
+		}
+		return nil
+	}, nil
+}
+
+// session returns the open SFTP session, connecting if there is none or
+// the last one died.
+func (s *SFTP) session(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		select {
+		case <-s.lost:
+		default:
+			return s.client, nil
+		}
+	}
+	s.closeLocked()
+
+	dialer := net.Dialer{Timeout: s.config.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(nc, s.addr, s.config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(sc, chans, reqs)
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true), sftp.UseConcurrentReads(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sftp: failed to start the sftp subsystem: %w", err)
+	}
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+	}()
+	s.conn, s.client, s.lost = conn, client, lost
+	return client, nil
+}
+
+// drop closes the session c after it failed, unless it was replaced already
+func (s *SFTP) drop(c *sftp.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == c {
+		s.closeLocked()
+	}
+}
+
+func (s *SFTP) closeLocked() {
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Close disconnects from the server.
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+	return nil
+}
+
+// file returns the server path of p, which cannot leave the root
+func (s *SFTP) file(p string) string {
+	return path.Join(s.root, path.Clean("/"+p))
+}
+
+// connectionLost tells failures of the connection, which a new one may get
+// past, from errors the server reported
+func connectionLost(err error) bool {
+	var status *sftp.StatusError
+	return !errors.As(err, &status) && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission)
+}
+
+// Put streams r into a partial file next to the object and renames it into
+// place once the server has acknowledged every byte. If the connection
+// drops, Put reconnects and resends the batch that was not acknowledged,
+// so large uploads do not start over. If reading r fails the partial file
+// is removed.
+func (s *SFTP) Put(ctx context.Context, p string, r io.Reader) error {
+	return s.upload(ctx, p, partPrefix+path.Base(s.file(p)), 0, r)
+}
+
+// PutFile uploads the file at localPath like Put, to a partial file named
+// after the local file. A later call for the same, unchanged file carries
+// on where an earlier one stopped.
+func (s *SFTP) PutFile(ctx context.Context, p, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return &sourceError{err}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return &sourceError{err}
+	}
+
+	dest := s.file(p)
+	id := sha256.Sum256(fmt.Appendf(nil, "%s\x00%s\x00%d\x00%d", dest, localPath, info.Size(), info.ModTime().UnixNano()))
+	part := partPrefix + hex.EncodeToString(id[:8]) + "-" + path.Base(dest)
+
+	var start int64
+	if c, err := s.session(ctx); err == nil {
+		if pi, err := c.Stat(path.Join(path.Dir(dest), part)); err == nil && pi.Size() <= info.Size() {
+			// Batches are written one after another, so only the last one
+			// the partial file reaches into can be incomplete
+			start = max(0, (pi.Size()+sftpBatch-1)/sftpBatch-1) * sftpBatch
+		}
+	}
+	if start > 0 {
+		log.Printf("[UPLOAD] resuming %s at %d of %d bytes", p, start, info.Size())
+	}
+	return s.upload(ctx, p, part, start, io.NewSectionReader(f, start, info.Size()-start))
+}
+
+// upload writes r from offset start on into the partial file part, in the
+// directory of the object at p, and renames it into place.
+func (s *SFTP) upload(ctx context.Context, p, part string, start int64, r io.Reader) error {
+	dest := s.file(p)
+	part = path.Join(path.Dir(dest), part)
+
+	c, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if start == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := c.OpenFile(part, flags)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, sftpBatch)
+	off := start
+	resumes := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			f.Close()
+			return err
+		}
+		n, rerr := io.ReadFull(r, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			f.Close()
+			c.Remove(part)
+			return rerr
+		}
+
+		for n > 0 {
+			_, err := f.WriteAt(buf[:n], off)
+			if err == nil {
+				break
+			}
+			if !connectionLost(err) {
+				f.Close()
+				return err
+			}
+			s.drop(c)
+			if resumes == maxResumes {
+				return err
+			}
+
+			// Reconnect and send the batch again
+			resumes++
+			log.Printf("[UPLOAD] connection lost after %d bytes of %s, resuming", off, p)
+			if err := s.backoff(ctx, resumes); err != nil {
+				return err
+			}
+			if c, err = s.session(ctx); err != nil {
+				return err
+			}
+			if f, err = c.OpenFile(part, os.O_WRONLY); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+		if rerr != nil {
+			break
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	info, err := c.Stat(part)
+	if err != nil {
+		return err
+	}
+	if info.Size() != off {
+		c.Remove(part)
+		return fmt.Errorf("sftp: partial file has %d bytes, wrote %d", info.Size(), off)
+	}
+	return s.rename(c, part, dest)
+}
+
+// rename moves from to to, replacing what is there
+func (s *SFTP) rename(c *sftp.Client, from, to string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(from, to)
+	}
+	if err := c.Remove(to); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return c.Rename(from, to)
+}
+
+func (s *SFTP) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	c, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(s.file(p))
+}
+
+// List returns the objects below dir. Partial files are left out, and
+// removed once no upload has written to them for partMaxAge.
+func (s *SFTP) List(ctx context.Context, dir string) ([]Object, error) {
+	c, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+
+	var objects []Object
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entries, err := c.ReadDirContext(ctx, s.file(rel))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := path.Join(rel, e.Name())
+			switch {
+			case e.IsDir():
+				if err := walk(name); err != nil {
+					return err
+				}
+			case strings.HasPrefix(e.Name(), partPrefix):
+				if time.Since(e.ModTime()) > partMaxAge {
+					log.Printf("[SFTP] Removing abandoned partial file %s", name)
+					c.Remove(s.file(name))
+				}
+			default:
+				objects = append(objects, Object{Path: name, Size: e.Size(), ModTime: e.ModTime()})
+			}
+		}
+		return nil
+	}
+	if err := walk(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) && objects == nil {
+			// Nothing has been stored yet
+			return nil, nil
+		}
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *SFTP) Stat(ctx context.Context, p string) (*Object, error) {
+	c, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Stat(s.file(p))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, NotFound(p)
+	}
+	return &Object{Path: p, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *SFTP) Delete(ctx context.Context, p string) error {
+	c, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.Remove(s.file(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *SFTP) Move(ctx context.Context, from, to string) error {
+	c, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	dest := s.file(to)
+	if err := c.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	return s.rename(c, s.file(from), dest)
+}
@@ -0,0 +1,362 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer is an in-process SSH server with the sftp subsystem, serving
+// a temporary directory. Connections go through a proxy that can cut them
+// after a number of bytes from the client.
+type sftpServer struct {
+	dir string
+	// cut is the number of bytes after which connections are dropped, if
+	// positive; cuts is how many more are dropped
+	cut  atomic.Int64
+	cuts atomic.Int32
+	// sent counts the bytes from all clients
+	sent atomic.Int64
+}
+
+func newSFTPServer(t *testing.T) (*sftpServer, *SFTP) {
+	t.Helper()
+	srv := &sftpServer{dir: t.TempDir()}
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPub, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(userPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), sshPub.Marshal()) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				srv.serve(srv.proxy(nc), config)
+			}()
+		}
+	}()
+
+	block, err := ssh.MarshalPrivateKey(userKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSFTP(SFTPOptions{
+		Addr:       ln.Addr().String(),
+		User:       "user",
+		PrivateKey: pem.EncodeToMemory(block),
+		HostKey:    string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+		Root:       srv.dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.backoff = func(context.Context, int) error { return nil }
+	t.Cleanup(func() { s.Close() })
+	return srv, s
+}
+
+// proxy returns nc, or a pipe that drops nc after cut bytes from the
+// client while cuts remain
+func (srv *sftpServer) proxy(nc net.Conn) net.Conn {
+	limit := int64(-1)
+	if srv.cuts.Add(-1) >= 0 {
+		limit = srv.cut.Load()
+	}
+	return &countingConn{Conn: nc, srv: srv, limit: limit}
+}
+
+type countingConn struct {
+	net.Conn
+	srv   *sftpServer
+	n     int64
+	limit int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	if c.limit >= 0 && c.n >= c.limit {
+		c.Conn.Close()
+		return 0, io.EOF
+	}
+	if c.limit >= 0 && int64(len(b)) > c.limit-c.n {
+		b = b[:c.limit-c.n]
+	}
+	n, err := c.Conn.Read(b)
+	c.n += int64(n)
+	c.srv.sent.Add(int64(n))
+	return n, err
+}
+
+func (srv *sftpServer) serve(nc net.Conn, config *ssh.ServerConfig) {
+	defer nc.Close()
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(ch)
+				if err != nil {
+					ch.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+			}
+		}()
+	}
+}
+
+func TestSFTPPutGet(t *testing.T) {
+	ctx := context.Background()
+	srv, s := newSFTPServer(t)
+
+	for name, size := range map[string]int{"small": 100, "empty": 0, "large": 3*sftpBatch + 10} {
+		data := randomBytes(t, size)
+		if err := s.Put(ctx, "dir/"+name, bytes.NewReader(data)); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(srv.dir, "dir", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: server holds %d bytes, want %d", name, len(got), len(data))
+		}
+		if got, err = ReadAll(ctx, s, "dir/"+name); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: read back %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+
+	// A replaced object holds the new content only
+	if err := s.Put(ctx, "dir/small", strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := s.Stat(ctx, "dir/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Path != "dir/small" || obj.Size != 3 {
+		t.Errorf("stat = %s %d bytes", obj.Path, obj.Size)
+	}
+	if _, err := s.Stat(ctx, "dir"); Classify(err) != ClassNotFound {
+		t.Errorf("stat of a directory: %v", err)
+	}
+	if _, err := s.Stat(ctx, "missing"); Classify(err) != ClassNotFound {
+		t.Errorf("stat of a missing object: %v", err)
+	}
+}
+
+func TestSFTPResume(t *testing.T) {
+	ctx := context.Background()
+	srv, s := newSFTPServer(t)
+	data := randomBytes(t, 6*sftpBatch)
+
+	// A connection dropped in the middle of a streamed upload is resumed
+	srv.cut.Store(sftpBatch * 3 / 2)
+	srv.cuts.Store(1)
+	if err := s.Put(ctx, "streamed", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(srv.dir, "streamed")); !bytes.Equal(got, data) {
+		t.Errorf("streamed upload: server holds %d bytes, want %d", len(got), len(data))
+	}
+
+	// A file upload that runs out of resumes carries on in the next call
+	local := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(local, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	srv.sent.Store(0)
+	srv.cuts.Store(maxResumes + 1)
+	if err := s.PutFile(ctx, "file", local); err == nil {
+		t.Fatal("upload succeeded through dropped connections")
+	}
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Path != "streamed" {
+		t.Errorf("listing shows partial files: %v", objects)
+	}
+	if err := s.PutFile(ctx, "file", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(srv.dir, "file")); !bytes.Equal(got, data) {
+		t.Errorf("resumed upload: server holds %d bytes, want %d", len(got), len(data))
+	}
+	if sent := srv.sent.Load(); sent > int64(len(data))*3/2 {
+		t.Errorf("sent %d bytes for a %d byte file", sent, len(data))
+	}
+	entries, _ := os.ReadDir(srv.dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), partPrefix) {
+			t.Errorf("partial file %s left", e.Name())
+		}
+	}
+}
+
+func TestSFTPList(t *testing.T) {
+	ctx := context.Background()
+	srv, s := newSFTPServer(t)
+
+	if objects, err := s.List(ctx, ""); err != nil || objects != nil {
+		t.Fatalf("listing of an empty root = %v, %v", objects, err)
+	}
+	want := []string{"a", "b/c", "b/d", "e/f/g"}
+	for _, p := range want {
+		if err := s.Put(ctx, p, strings.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Names that merely resemble partial files are objects too
+	want = append(want, "report.tmp-final.docx")
+	if err := s.Put(ctx, "report.tmp-final.docx", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	// A partial file of a running upload is hidden, an abandoned one removed
+	running := filepath.Join(srv.dir, "b", partPrefix+"x")
+	abandoned := filepath.Join(srv.dir, partPrefix+"y")
+	for _, p := range []string{running, abandoned} {
+		if err := os.WriteFile(p, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * partMaxAge)
+	if err := os.Chtimes(abandoned, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, obj := range objects {
+		got[obj.Path] = true
+	}
+	if len(got) != len(want) {
+		t.Errorf("listed %v, want %v", objects, want)
+	}
+	for _, p := range want {
+		if !got[p] {
+			t.Errorf("%s not listed", p)
+		}
+	}
+	if _, err := os.Stat(running); err != nil {
+		t.Errorf("partial file of a running upload removed: %v", err)
+	}
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Errorf("abandoned partial file kept: %v", err)
+	}
+
+	objects, err = s.List(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || !strings.HasPrefix(objects[0].Path, "b/") || !strings.HasPrefix(objects[1].Path, "b/") {
+		t.Errorf("listing of b = %v", objects)
+	}
+}
+
+func TestSFTPMoveDelete(t *testing.T) {
+	ctx := context.Background()
+	srv, s := newSFTPServer(t)
+
+	for _, p := range []string{"from", "to/here"} {
+		if err := s.Put(ctx, p, strings.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Moving replaces the object at the destination
+	if err := s.Move(ctx, "from", "to/here"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(srv.dir, "from")); !os.IsNotExist(err) {
+		t.Errorf("moved object still at its old path: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(srv.dir, "to", "here")); string(got) != "from" {
+		t.Errorf("moved object holds %q", got)
+	}
+	if err := s.Move(ctx, "from", "new/dir/obj"); Classify(err) != ClassNotFound {
+		t.Errorf("move of a missing object: %v", err)
+	}
+
+	if err := s.Delete(ctx, "to/here"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(srv.dir, "to", "here")); !os.IsNotExist(err) {
+		t.Errorf("deleted object still there: %v", err)
+	}
+	if err := s.Delete(ctx, "to/here"); err != nil {
+		t.Errorf("delete of a missing object: %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"Syncase-silent-app-main/crypto"
+)
+
+const maxUploadAttempts = 3
+
+// ErrPlaintextUpload is returned instead of uploading data that does not
+// start with an encrypted file header.
+var ErrPlaintextUpload = errors.New("refusing to upload data that is not encrypted")
+
+// errUploadAborted stops the producer of an upload whose transfer failed.
+var errUploadAborted = errors.New("upload aborted")
+
+// ErrUploadMismatch is wrapped by the verification error of an upload
+// whose stored object differs in size or content from what was uploaded.
+var ErrUploadMismatch = errors.New("stored object does not match the upload")
+
+// verifyHashes are the hashes uploads can be verified with, in the order
+// a remote's hash is picked from those it supports. Between them they
+// cover what most remotes report: MD5 (S3, Google Drive, ...), SHA-1 (B2,
+// Box, ...), QuickXorHash (OneDrive) and SHA-256 (local disks).
+var verifyHashes = []string{"md5", "sha1", "quickxor", "sha256"}
+
+// PreferredHash returns the first hash of names that uploads can be
+// verified with, or "" if there is none.
+func PreferredHash(names []string) string {
+	for _, name := range verifyHashes {
+		if slices.Contains(names, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Upload stores whatever write produces at p, retrying failed transfers.
+// write is called again from the start on every attempt and must produce an
+// encrypted file; anything else is rejected before it reaches the backend.
+// The size and the hash the backend reports of the stored object are
+// checked against what was written. Upload returns the stored object with
+// the named hashes of what was written.
+func Upload(ctx context.Context, b Backend, p string, write func(w io.Writer) error, hashes ...string) (*Object, error) {
+	log.Printf("[UPLOAD] stream -> %s", p)
+
+	verify := reportedHash(ctx, b)
+	names := sumNames(verify, hashes)
+	return withRetries(ctx, b, p, verify, func() (uploadSum, error) {
+		pr, pw := io.Pipe()
+		summer := newSumWriter(pw, names)
+		done := make(chan error, 1)
+		go func() {
+			guard := &guardWriter{w: summer}
+			err := write(guard)
+			if err == nil {
+				err = guard.finish()
+			}
+			pw.CloseWithError(err)
+			done <- err
+		}()
+
+		err := b.Put(ctx, p, pr)
+		pr.CloseWithError(errUploadAborted)
+		if werr := <-done; werr != nil && !errors.Is(werr, errUploadAborted) {
+			return uploadSum{}, &sourceError{werr}
+		}
+		return summer.sum(), err
+	})
+}
+
+// sourceError is a failure of the data being uploaded rather than of the
+// upload, which retrying will not fix.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string { return e.err.Error() }
+
+// withRetries runs attempt, which uploads to p and returns the size and
+// hashes of what it uploaded, until the upload succeeds and verifies by the
+// hash verify. How often and how long after a failure it tries again
+// depends on the class of the failure; while the remote is over quota no
+// upload is attempted at all.
+func withRetries(ctx context.Context, b Backend, p, verify string, attempt func() (uploadSum, error)) (*Object, error) {
+	if until := pausedUntil(b); !until.IsZero() {
+		return nil, &Error{
+			Class: ClassQuotaExceeded,
+			Op:    "upload " + p,
+			Err:   fmt.Errorf("uploads paused until %s", until.Format(time.TimeOnly)),
+		}
+	}
+
+	var lastErr error
+	var i int
+
+	for i = 1; i <= maxUploadAttempts; i++ {
+		sum, err := attempt()
+		var src *sourceError
+		if errors.As(err, &src) {
+			return nil, src.err
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("upload failed (attempt %d): %w", i, err)
+			log.Println(lastErr)
+			if i == maxUploadAttempts || !backoffAfter(ctx, b, err, i) {
+				break
+			}
+			continue
+		}
+
+		// Hard verification
+		obj, err := verifyUpload(ctx, b, p, verify, sum)
+		if err != nil {
+			lastErr = fmt.Errorf("verification failed (attempt %d): %w", i, err)
+			log.Println(lastErr)
+			if i == maxUploadAttempts {
+				break
+			}
+			// Eventually consistent remotes, such as Google Drive, may not
+			// show a new object straight away
+			if Classify(err) == ClassNotFound {
+				if Backoff(ctx, i) != nil {
+					break
+				}
+				continue
+			}
+			if !backoffAfter(ctx, b, err, i) {
+				break
+			}
+			continue
+		}
+
+		log.Printf("[UPLOAD OK] %s verified on remote", p)
+		return obj, nil
+	}
+
+	return nil, fmt.Errorf("upload failed after %d attempts: %w", i, lastErr)
+}
+
+// verifyUpload checks that the object at p exists with the uploaded size
+// and content, and returns it with the hashes of the upload. The content
+// is compared by the hash name, as reported with the object or computed by
+// the backend as a Hasher. Without one it is checked by size only.
+func verifyUpload(ctx context.Context, b Backend, p, name string, want uploadSum) (*Object, error) {
+	obj, err := b.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Size != want.size {
+		return nil, fmt.Errorf("%w: remote object has %d bytes, uploaded %d", ErrUploadMismatch, obj.Size, want.size)
+	}
+
+	got := obj.Hashes[name]
+	if hb, ok := b.(Hasher); ok && name != "" && got == "" {
+		got, err = hb.Hash(ctx, p, name)
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return nil, err
+		}
+	}
+	if got == "" {
+		log.Printf("[UPLOAD] %s: remote reports no supported hash, verified by size only", p)
+	} else if err := want.check(name, got); err != nil {
+		return nil, err
+	}
+
+	hashes := maps.Clone(obj.Hashes)
+	if hashes == nil {
+		hashes = make(map[string]string, len(want.hashes))
+	}
+	maps.Copy(hashes, want.hashes)
+	obj.Hashes = hashes
+	return obj, nil
+}
+
+// reportedHash returns the hash uploads to b are verified with, "" if none
+func reportedHash(ctx context.Context, b Backend) string {
+	if hr, ok := b.(HashReporter); ok {
+		return hr.ReportedHash(ctx)
+	}
+	return ""
+}
+
+// sumNames returns the hashes to compute of an upload verified by verify
+// whose caller asked for hashes
+func sumNames(verify string, hashes []string) []string {
+	if verify == "" || slices.Contains(hashes, verify) {
+		return hashes
+	}
+	return append(slices.Clip(hashes), verify)
+}
+
+// uploadSum is the size and hashes of the bytes of an upload.
+type uploadSum struct {
+	size   int64
+	hashes map[string]string
+}
+
+// check compares the named hash the remote reported with the uploaded one
+func (s uploadSum) check(name, got string) error {
+	if want := s.hashes[name]; !strings.EqualFold(got, want) {
+		return fmt.Errorf("%w: remote %s is %s, uploaded %s", ErrUploadMismatch, name, got, want)
+	}
+	return nil
+}
+
+// sumFile returns the size and the named hashes of the file at path
+func sumFile(path string, names []string) (uploadSum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return uploadSum{}, err
+	}
+	defer f.Close()
+	summer := newSumWriter(io.Discard, names)
+	if _, err := io.Copy(summer, f); err != nil {
+		return uploadSum{}, err
+	}
+	return summer.sum(), nil
+}
+
+// Backoff sleeps before retry number attempt, exponentially with jitter.
+// It returns ctx's error if ctx is done first.
+func Backoff(ctx context.Context, attempt int) error {
+	baseDelay := time.Duration(attempt*attempt) * time.Second
+	jitter := time.Duration(attempt*500) * time.Millisecond
+	sleepTime := baseDelay + jitter
+
+	if sleepTime > 30*time.Second {
+		sleepTime = 30 * time.Second
+	}
+
+	log.Printf("[BACKOFF] Waiting %v before retry (attempt %d)", sleepTime, attempt)
+	return sleep(ctx, sleepTime)
+}
+
+// CheckEncrypted fails unless head starts with an encrypted file header.
+func CheckEncrypted(head []byte) error {
+	if _, err := crypto.ReadHeader(bytes.NewReader(head)); err != nil {
+		return fmt.Errorf("%w: %v", ErrPlaintextUpload, err)
+	}
+	return nil
+}
+
+// guardWriter holds back the start of a stream until it has seen a valid
+// encrypted file header, so plaintext never reaches the backend.
+type guardWriter struct {
+	w       io.Writer
+	head    []byte
+	checked bool
+}
+
+func (g *guardWriter) Write(b []byte) (int, error) {
+	if g.checked {
+		return g.w.Write(b)
+	}
+	g.head = append(g.head, b...)
+	if len(g.head) < crypto.MaxHeaderSize {
+		return len(b), nil
+	}
+	if err := g.finish(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// finish checks and flushes a stream shorter than the held-back header size.
+func (g *guardWriter) finish() error {
+	if g.checked {
+		return nil
+	}
+	if err := CheckEncrypted(g.head); err != nil {
+		return err
+	}
+	g.checked = true
+	_, err := g.w.Write(g.head)
+	g.head = nil
+	return err
+}
+
+// sumWriter counts and hashes the bytes handed to the backend.
+type sumWriter struct {
+	w      io.Writer
+	n      int64
+	hashes map[string]hash.Hash
+}
+
+// newSumWriter returns a sumWriter computing the named hashes; names it
+// does not know are left out.
+func newSumWriter(w io.Writer, names []string) *sumWriter {
+	s := &sumWriter{w: w, hashes: make(map[string]hash.Hash, len(names))}
+	for _, name := range names {
+		if h, err := newHash(name); err == nil {
+			s.hashes[name] = h
+		}
+	}
+	return s
+}
+
+func (s *sumWriter) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	s.n += int64(n)
+	for _, h := range s.hashes {
+		h.Write(b[:n])
+	}
+	return n, err
+}
+
+func (s *sumWriter) sum() uploadSum {
+	sum := uploadSum{size: s.n, hashes: make(map[string]string, len(s.hashes))}
+	for name, h := range s.hashes {
+		sum.hashes[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sum
+}
+
+// UploadFile uploads the encrypted file at localPath to p, see Upload.
+// Backends that are FilePutters are handed the file itself.
+func UploadFile(ctx context.Context, b Backend, p, localPath string, hashes ...string) (*Object, error) {
+	if err := CheckEncryptedFile(localPath); err != nil {
+		return nil, err
+	}
+	verify := reportedHash(ctx, b)
+	sum, err := sumFile(localPath, sumNames(verify, hashes))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[UPLOAD] %s -> %s", localPath, p)
+	return withRetries(ctx, b, p, verify, func() (uploadSum, error) {
+		return sum, PutFile(ctx, b, p, localPath)
+	})
+}
+
+// PutFile stores the file at localPath at p, through FilePutter if b
+// implements it.
+func PutFile(ctx context.Context, b Backend, p, localPath string) error {
+	if fp, ok := b.(FilePutter); ok {
+		return fp.PutFile(ctx, p, localPath)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return &sourceError{err}
+	}
+	defer f.Close()
+	return b.Put(ctx, p, f)
+}
+
+// CheckEncryptedFile fails unless the file at path starts with an
+// encrypted file header.
+func CheckEncryptedFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, crypto.MaxHeaderSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	return CheckEncrypted(head[:n])
+}
+
+// Download copies the object at p to localPath with retries. The file only
+// appears once the whole object has been read.
+func Download(ctx context.Context, b Backend, p, localPath string) error {
+	log.Printf("[DOWNLOAD] %s -> %s", p, localPath)
+
+	var lastErr error
+	var attempt int
+
+	for attempt = 1; attempt <= maxUploadAttempts; attempt++ {
+		err := download(ctx, b, p, localPath)
+		if err == nil || errors.Is(err, fs.ErrNotExist) || ctx.Err() != nil {
+			return err
+		}
+		lastErr = fmt.Errorf("download failed (attempt %d): %w", attempt, err)
+		log.Println(lastErr)
+		// Over quota only uploads are paused, but retrying will not help
+		if attempt == maxUploadAttempts || Classify(err) == ClassQuotaExceeded || !backoffAfter(ctx, b, err, attempt) {
+			break
+		}
+	}
+
+	return fmt.Errorf("download failed after %d attempts: %w", attempt, lastErr)
+}
+
+func download(ctx context.Context, b Backend, p, localPath string) error {
+	r, err := b.Get(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), localPath)
+}
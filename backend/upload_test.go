@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"Syncase-silent-app-main/crypto"
+)
+
+// flakyBackend is a Local that reports an MD5 hash with its objects, and
+// does not show new objects to the first misses calls of Stat.
+type flakyBackend struct {
+	*Local
+	misses int
+	stats  int
+}
+
+func (f *flakyBackend) ReportedHash(ctx context.Context) string { return "md5" }
+
+func (f *flakyBackend) Stat(ctx context.Context, p string) (*Object, error) {
+	f.stats++
+	if f.stats <= f.misses {
+		return nil, NotFound(p)
+	}
+	obj, err := f.Local.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := f.Local.Hash(ctx, p, "md5")
+	if err != nil {
+		return nil, err
+	}
+	obj.Hashes = map[string]string{"md5": sum}
+	return obj, nil
+}
+
+// encrypted returns the writer of an encrypted file for Upload
+func encrypted(t *testing.T) (func(w io.Writer) error, *bytes.Buffer) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := new(bytes.Buffer)
+	plain := randomBytes(t, 1000)
+	return func(w io.Writer) error {
+		written.Reset()
+		return crypto.EncryptStream(key, io.MultiWriter(w, written), bytes.NewReader(plain), int64(len(plain)), crypto.Binding{Path: "obj"}, crypto.CodecNone)
+	}, written
+}
+
+func TestUploadRetriesUnlistedObject(t *testing.T) {
+	ctx := context.Background()
+	b := &flakyBackend{Local: NewLocal(t.TempDir()), misses: 1}
+	write, written := encrypted(t)
+
+	obj, err := Upload(ctx, b, "obj", write, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.stats != 2 {
+		t.Errorf("object stated %d times, want 2", b.stats)
+	}
+	sum := sha256.Sum256(written.Bytes())
+	if obj.Size != int64(written.Len()) || obj.Hashes["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("upload returned %d bytes with sha256 %s", obj.Size, obj.Hashes["sha256"])
+	}
+	// Only the hash the backend reports and the one asked for are computed
+	for name := range obj.Hashes {
+		if name != "md5" && name != "sha256" {
+			t.Errorf("upload computed %s", name)
+		}
+	}
+}
+
+// corruptingBackend is a flakyBackend that stores something other than
+// what it is given: the upload with its last byte flipped or cut off.
+type corruptingBackend struct {
+	flakyBackend
+	truncate bool
+	// cancel is called after every Stat
+	cancel context.CancelFunc
+	puts   int
+}
+
+func (c *corruptingBackend) Stat(ctx context.Context, p string) (*Object, error) {
+	defer c.cancel()
+	return c.flakyBackend.Stat(ctx, p)
+}
+
+func (c *corruptingBackend) Put(ctx context.Context, p string, r io.Reader) error {
+	c.puts++
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if c.truncate {
+		data = data[:len(data)-1]
+	} else {
+		data[len(data)-1] ^= 1
+	}
+	return c.Local.Put(ctx, p, bytes.NewReader(data))
+}
+
+func TestUploadMismatch(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		// Canceling after the first attempt spares the test the backoff
+		// before the retries
+		ctx, cancel := context.WithCancel(context.Background())
+		b := &corruptingBackend{flakyBackend: flakyBackend{Local: NewLocal(t.TempDir())}, truncate: truncate, cancel: cancel}
+		write, _ := encrypted(t)
+
+		obj, err := Upload(ctx, b, "obj", write, "sha256")
+		if !errors.Is(err, ErrUploadMismatch) || obj != nil {
+			t.Errorf("truncate %v: upload = %v, %v", truncate, obj, err)
+		}
+		if b.puts != 1 {
+			t.Errorf("truncate %v: %d attempts", truncate, b.puts)
+		}
+	}
+
+	// Files are checked against their own hashes the same way
+	path := filepath.Join(t.TempDir(), "file.enc")
+	write, written := encrypted(t)
+	if err := write(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, written.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &corruptingBackend{flakyBackend: flakyBackend{Local: NewLocal(t.TempDir())}, cancel: cancel}
+	if obj, err := UploadFile(ctx, b, "obj", path); !errors.Is(err, ErrUploadMismatch) || obj != nil {
+		t.Errorf("upload of a file = %v, %v", obj, err)
+	}
+}
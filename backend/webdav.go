@@ -0,0 +1,396 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// propfindBody asks for the properties List and Stat use. oc:checksums is
+// the ownCloud extension Nextcloud and ownCloud report content hashes with.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:prop>
+<d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/>
+<oc:checksums/>
+</d:prop></d:propfind>`
+
+// WebDAVOptions configures a WebDAV backend.
+type WebDAVOptions struct {
+	// URL is the collection objects are stored below, for Nextcloud e.g.
+	// "https://cloud.example.com/remote.php/dav/files/alice/Syncase"
+	URL      string
+	User     string
+	Password string
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// WebDAV is a backend for WebDAV servers such as Nextcloud. Uploads are
+// streamed with chunked transfer encoding to a temporary name and moved
+// into place once complete.
+//
+// Plain WebDAV has no content hashes: ETags are opaque version tags on
+// Nextcloud and Apache alike, so they are never taken for one. Hashes are
+// only known from the oc:checksums property of servers that keep them,
+// and uploads are verified by size until the server has reported one.
+type WebDAV struct {
+	base   *url.URL
+	user   string
+	pass   string
+	client *http.Client
+
+	// dirs remembers collections known to exist
+	dirs sync.Map
+
+	mu sync.Mutex
+	// hash is the hash the server was last seen to report, "" until then
+	hash string
+}
+
+// NewWebDAV returns a backend storing objects below opts.URL.
+func NewWebDAV(opts WebDAVOptions) (*WebDAV, error) {
+	base, err := url.Parse(opts.URL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("webdav: invalid URL %q", opts.URL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	base.RawPath = ""
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebDAV{base: base, user: opts.User, pass: opts.Password, client: client}, nil
+}
+
+// webdavError is an unexpected status. Missing resources unwrap to
+// fs.ErrNotExist.
+type webdavError struct {
+	Method string
+	Path   string
+	Status int
+}
+
+func (e *webdavError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+}
+
+func (e *webdavError) Unwrap() error {
+	if e.Status == http.StatusNotFound {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (e *webdavError) ErrorClass() ErrorClass { return HTTPClass(e.Status) }
+
+// davPath returns p relative to the base collection, without leading or
+// trailing slashes
+func davPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// url returns the URL of the resource at p
+func (w *WebDAV) url(p string) string {
+	u := *w.base
+	u.Path += davPath(p)
+	u.RawPath = uriEncode(u.Path, false)
+	return u.String()
+}
+
+// do sends a request for p and fails unless the status is one of ok.
+func (w *WebDAV) do(ctx context.Context, method, p string, header http.Header, body io.Reader, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.url(p), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.pass)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return nil, &webdavError{Method: method, Path: p, Status: resp.StatusCode}
+}
+
+// mkcolAll creates the collection dir and its missing parents.
+func (w *WebDAV) mkcolAll(ctx context.Context, dir string) error {
+	dir = davPath(dir)
+	if dir == "" {
+		return nil
+	}
+	if _, ok := w.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := w.mkcolAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	// 405 means the collection exists already
+	resp, err := w.do(ctx, "MKCOL", dir+"/", nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.dirs.Store(dir, true)
+	return nil
+}
+
+// Put streams r to a temporary name with chunked transfer encoding, then
+// moves it over the object, so a failed upload leaves the object as it was.
+func (w *WebDAV) Put(ctx context.Context, p string, r io.Reader) error {
+	p = davPath(p)
+	if err := w.mkcolAll(ctx, path.Dir(p)); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	tmp := path.Join(path.Dir(p), tempPrefix+hex.EncodeToString(suffix))
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	// Hide the length so the body is sent chunked as it is produced
+	resp, err := w.do(ctx, http.MethodPut, tmp, header, io.MultiReader(r),
+		http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		// Whatever arrived before the failure is not wanted
+		w.Delete(context.Background(), tmp)
+		return err
+	}
+	resp.Body.Close()
+
+	if err := w.move(ctx, tmp, p); err != nil {
+		w.Delete(context.Background(), tmp)
+		return err
+	}
+	return nil
+}
+
+func (w *WebDAV) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	resp, err := w.do(ctx, http.MethodGet, davPath(p), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// davResource is one resource of a PROPFIND answer.
+type davResource struct {
+	path    string
+	dir     bool
+	size    int64
+	modTime time.Time
+	etag    string
+	hashes  map[string]string
+}
+
+// propfind describes p, and with depth "1" its direct children too.
+func (w *WebDAV) propfind(ctx context.Context, p, depth string) ([]davResource, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := w.do(ctx, "PROPFIND", p, header, strings.NewReader(propfindBody), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms struct {
+		Responses []struct {
+			Href      string `xml:"DAV: href"`
+			Propstats []struct {
+				Status string `xml:"DAV: status"`
+				Prop   struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"DAV: collection"`
+					} `xml:"DAV: resourcetype"`
+					ContentLength int64    `xml:"DAV: getcontentlength"`
+					LastModified  string   `xml:"DAV: getlastmodified"`
+					ETag          string   `xml:"DAV: getetag"`
+					Checksums     []string `xml:"http://owncloud.org/ns checksums>checksum"`
+				} `xml:"DAV: prop"`
+			} `xml:"DAV: propstat"`
+		} `xml:"DAV: response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav: unexpected PROPFIND response: %w", err)
+	}
+
+	resources := make([]davResource, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		rel, err := w.relative(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		res := davResource{path: rel}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			res.dir = ps.Prop.ResourceType.Collection != nil
+			res.size = ps.Prop.ContentLength
+			res.modTime, _ = http.ParseTime(ps.Prop.LastModified)
+			res.etag = strings.Trim(strings.TrimPrefix(ps.Prop.ETag, "W/"), `"`)
+			res.hashes = w.checksums(ps.Prop.Checksums)
+		}
+		resources = append(resources, res)
+	}
+	return resources, nil
+}
+
+// relative turns an href of a PROPFIND answer into a path below the base.
+func (w *WebDAV) relative(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("webdav: invalid href %q: %w", href, err)
+	}
+	rel, ok := strings.CutPrefix(u.Path, w.base.Path)
+	if !ok {
+		if u.Path+"/" == w.base.Path {
+			// The base collection without its trailing slash
+			return "", nil
+		}
+		return "", fmt.Errorf("webdav: href %q is outside %s", href, w.base.Path)
+	}
+	return davPath(rel), nil
+}
+
+// checksums parses oc:checksums values such as "SHA1:ab12 MD5:cd34" into
+// hashes by name, and remembers which hash the server reports.
+func (w *WebDAV) checksums(values []string) map[string]string {
+	var hashes map[string]string
+	for _, v := range values {
+		for _, field := range strings.Fields(v) {
+			name, sum, ok := strings.Cut(field, ":")
+			if !ok || sum == "" {
+				continue
+			}
+			if hashes == nil {
+				hashes = make(map[string]string)
+			}
+			hashes[strings.ToLower(name)] = strings.ToLower(sum)
+		}
+	}
+	if name := PreferredHash(slices.Collect(maps.Keys(hashes))); name != "" {
+		w.mu.Lock()
+		w.hash = name
+		w.mu.Unlock()
+	}
+	return hashes
+}
+
+// ReportedHash returns the hash the server reported with its objects, ""
+// while it has not reported any.
+func (w *WebDAV) ReportedHash(ctx context.Context) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.hash
+}
+
+func (w *WebDAV) object(res davResource) Object {
+	return Object{Path: res.path, Size: res.size, ModTime: res.modTime, ETag: res.etag, Hashes: res.hashes}
+}
+
+// List walks the collections below dir one level at a time, since many
+// servers, Nextcloud among them, refuse "Depth: infinity".
+func (w *WebDAV) List(ctx context.Context, dir string) ([]Object, error) {
+	var objects []Object
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		resources, err := w.propfind(ctx, dir+"/", "1")
+		if err != nil {
+			return err
+		}
+		for _, res := range resources {
+			switch {
+			case res.path == dir:
+				// The collection itself
+			case res.dir:
+				if err := walk(res.path); err != nil {
+					return err
+				}
+			case strings.HasPrefix(path.Base(res.path), tempPrefix):
+				// An upload in progress
+			default:
+				objects = append(objects, w.object(res))
+			}
+		}
+		return nil
+	}
+	if err := walk(davPath(dir)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) && objects == nil {
+			// Nothing has been stored yet
+			return nil, nil
+		}
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (w *WebDAV) Stat(ctx context.Context, p string) (*Object, error) {
+	resources, err := w.propfind(ctx, davPath(p), "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(resources) == 0 || resources[0].dir {
+		return nil, NotFound(p)
+	}
+	obj := w.object(resources[0])
+	return &obj, nil
+}
+
+func (w *WebDAV) Delete(ctx context.Context, p string) error {
+	resp, err := w.do(ctx, http.MethodDelete, davPath(p), nil, nil, http.StatusOK, http.StatusNoContent)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Already gone
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *WebDAV) Move(ctx context.Context, from, to string) error {
+	to = davPath(to)
+	if err := w.mkcolAll(ctx, path.Dir(to)); err != nil {
+		return err
+	}
+	return w.move(ctx, davPath(from), to)
+}
+
+// move renames from to to on the server, replacing any object there.
+func (w *WebDAV) move(ctx context.Context, from, to string) error {
+	header := http.Header{}
+	header.Set("Destination", w.url(to))
+	header.Set("Overwrite", "T")
+	resp, err := w.do(ctx, "MOVE", from, header, nil, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
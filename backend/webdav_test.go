@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVServer serves a temporary directory with the x/net/webdav
+// handler and returns it with a backend for its "root" collection.
+func newWebDAVServer(t *testing.T) (string, *WebDAV) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	w, err := NewWebDAV(WebDAVOptions{URL: srv.URL + "/dav/root", User: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "root"), w
+}
+
+func TestWebDAVPutGet(t *testing.T) {
+	ctx := context.Background()
+	dir, w := newWebDAVServer(t)
+
+	for name, size := range map[string]int{"small": 100, "empty": 0, "large": 1 << 20} {
+		data := randomBytes(t, size)
+		if err := w.Put(ctx, "dir/sub/"+name, bytes.NewReader(data)); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+		got, err := ReadAll(ctx, w, "dir/sub/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: read back %d bytes, want %d", name, len(got), len(data))
+		}
+		obj, err := w.Stat(ctx, "dir/sub/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Path != "dir/sub/"+name || obj.Size != int64(size) {
+			t.Errorf("%s: stat = %s %d bytes", name, obj.Path, obj.Size)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "dir", "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+
+	if _, err := w.Stat(ctx, "dir"); Classify(err) != ClassNotFound {
+		t.Errorf("stat of a collection: %v", err)
+	}
+	if _, err := w.Stat(ctx, "missing"); Classify(err) != ClassNotFound {
+		t.Errorf("stat of a missing object: %v", err)
+	}
+	if _, err := ReadAll(ctx, w, "missing"); Classify(err) != ClassNotFound {
+		t.Errorf("get of a missing object: %v", err)
+	}
+}
+
+func TestWebDAVList(t *testing.T) {
+	ctx := context.Background()
+	dir, w := newWebDAVServer(t)
+
+	if objects, err := w.List(ctx, "none"); err != nil || objects != nil {
+		t.Fatalf("listing of a missing collection = %v, %v", objects, err)
+	}
+	// Names that merely contain the old temporary marker are objects too
+	want := []string{"a", "b/c d", "b/report.tmp-final.docx", "e/f/g"}
+	for _, p := range want {
+		if err := w.Put(ctx, p, strings.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An upload in progress is not
+	if err := os.WriteFile(filepath.Join(dir, "b", tempPrefix+"0123abcd"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := w.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, obj := range objects {
+		got = append(got, obj.Path)
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+}
+
+func TestWebDAVMoveDelete(t *testing.T) {
+	ctx := context.Background()
+	dir, w := newWebDAVServer(t)
+
+	for _, p := range []string{"from", "to/here"} {
+		if err := w.Put(ctx, p, strings.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Moving replaces the object at the destination
+	if err := w.Move(ctx, "from", "to/here"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "to", "here")); string(got) != "from" {
+		t.Errorf("moved object holds %q", got)
+	}
+	// x/net/webdav answers 403 rather than 404 here
+	if err := w.Move(ctx, "from", "new/obj"); err == nil {
+		t.Error("move of a missing object succeeded")
+	}
+
+	if err := w.Delete(ctx, "to/here"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "to", "here")); !os.IsNotExist(err) {
+		t.Errorf("deleted object still there: %v", err)
+	}
+	if err := w.Delete(ctx, "to/here"); err != nil {
+		t.Errorf("delete of a missing object: %v", err)
+	}
+}
+
+func TestWebDAVRelative(t *testing.T) {
+	w, err := NewWebDAV(WebDAVOptions{URL: "https://cloud.example.com/dav/files/alice/Syncase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for href, want := range map[string]string{
+		"/dav/files/alice/Syncase/":                            "",
+		"/dav/files/alice/Syncase":                             "",
+		"/dav/files/alice/Syncase/a/b%20c":                     "a/b c",
+		"https://cloud.example.com/dav/files/alice/Syncase/d/": "d",
+	} {
+		if got, err := w.relative(href); err != nil || got != want {
+			t.Errorf("relative(%q) = %q, %v, want %q", href, got, err, want)
+		}
+	}
+	if got, err := w.relative("/dav/files/alice/Other/a"); err == nil {
+		t.Errorf("href outside the base taken as %q", got)
+	}
+}
+
+// checksumMultistatus answers a PROPFIND of "a" the way ownCloud does
+const checksumMultistatus = `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+<d:response><d:href>/dav/root/a</d:href><d:propstat><d:prop>
+<d:resourcetype/><d:getcontentlength>5</d:getcontentlength>
+<d:getetag>"5f1e2a"</d:getetag>
+<oc:checksums><oc:checksum>SHA1:ABCD MD5:1234 ADLER32:99</oc:checksum></oc:checksums>
+</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+</d:multistatus>`
+
+func TestWebDAVChecksums(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(checksumMultistatus))
+	}))
+	t.Cleanup(srv.Close)
+	w, err := NewWebDAV(WebDAVOptions{URL: srv.URL + "/dav/root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h := w.ReportedHash(ctx); h != "" {
+		t.Errorf("hash %q reported before the server reported one", h)
+	}
+	obj, err := w.Stat(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Hashes["sha1"] != "abcd" || obj.Hashes["md5"] != "1234" {
+		t.Errorf("hashes = %v", obj.Hashes)
+	}
+	if h := w.ReportedHash(ctx); h != "md5" {
+		t.Errorf("reported hash = %q, want md5", h)
+	}
+
+	// Servers without oc:checksums report none
+	_, plain := newWebDAVServer(t)
+	if err := plain.Put(ctx, "a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := plain.Stat(ctx, "a"); err != nil || obj.Hashes != nil {
+		t.Errorf("stat = %v, %v", obj, err)
+	}
+	if h := plain.ReportedHash(ctx); h != "" {
+		t.Errorf("reported hash = %q", h)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+	"Syncase-silent-app-main/manifest"
+	syncpkg "Syncase-silent-app-main/sync"
+	"Syncase-silent-app-main/uploader"
+)
+
+// runCommand runs the CLI subcommand named by args[0]. It reports false when
+// args name no subcommand, in which case the caller starts the sync agent.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "rotate":
+		return true, rotateCommand(args[1:])
+	case "passphrase":
+		return true, passphraseCommand(args[1:])
+	case "vault":
+		return true, vaultCommand(args[1:])
+	case "shares":
+		return true, sharesCommand(args[1:])
+	case "identity":
+		return true, identityCommand(args[1:])
+	case "verify":
+		return true, verifyCommand(args[1:])
+	case "devices":
+		return true, devicesCommand(args[1:])
+	case "restore":
+		return true, restoreCommand(args[1:])
+	default:
+		return false, nil
+	}
+}
+
+// loadConfig loads config.json and resolves the watched folder like the agent does
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.LoadConfigFromFile("config.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	cfg.WatchedFolder, err = filepath.Abs(cfg.WatchedFolder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve watched folder path: %w", err)
+	}
+	return cfg, nil
+}
+
+// loadPairConfig loads config.json and returns the config of the sync pair
+// called name, which may be empty when there is only one
+func loadPairConfig(name string) (*config.Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg, err = cfg.Pair(name); err != nil {
+		return nil, err
+	}
+	cfg.WatchedFolder, err = filepath.Abs(cfg.WatchedFolder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve watched folder path: %w", err)
+	}
+	return cfg, nil
+}
+
+// commandContext is cancelled on Ctrl+C so long-running commands can save their progress
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+func rotateCommand(args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	newKey := fs.Bool("new-key", false, "generate a new active key before rotating")
+	pair := fs.String("pair", "", "sync pair to rotate, when config.json lists several")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadPairConfig(*pair)
+	if err != nil {
+		return err
+	}
+	src, err := crypto.OpenKeySource(cfg)
+	if err != nil {
+		return err
+	}
+	keyring, err := src.Keyring()
+	if err != nil {
+		return err
+	}
+
+	if *newKey {
+		store, ok := src.(crypto.KeyStore)
+		if !ok {
+			return fmt.Errorf("key source %q cannot store new keys", cfg.KeySource)
+		}
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return err
+		}
+		if err := keyring.Add(key); err != nil {
+			return err
+		}
+		if err := keyring.SetActive(key.ID); err != nil {
+			return err
+		}
+		if err := store.SaveKeyring(keyring); err != nil {
+			return fmt.Errorf("failed to save keyring: %w", err)
+		}
+		fmt.Println("🔑 New active key:", key.ID)
+		if err := markSharedRotations(cfg, key.ID); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	store, err := uploader.NewBackend(cfg)
+	if err != nil {
+		return err
+	}
+	defer backend.Close(store)
+	mf, err := syncpkg.OpenManifest(ctx, cfg, store)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("🔁 Rotating remote to key", keyring.Active().ID)
+	err = syncpkg.RotateRemote(ctx, cfg, store, keyring, mf, func(p syncpkg.RotationProgress) {
+		fmt.Printf("   %d/%d done, %d already current, %d failed  %s\n",
+			p.Done, p.Total, p.Skipped, p.Failed, p.Current)
+	})
+	if err == context.Canceled {
+		fmt.Println("⏸ Rotation interrupted, run rotate again to resume")
+		return nil
+	}
+	return err
+}
+
+// markSharedRotations leaves a pending rotation to keyID for every other
+// pair that writes with the same keys as cfg, so their next run or rotate
+// moves them to the new key as well.
+func markSharedRotations(cfg *config.Config, keyID string) error {
+	if cfg.KeyringPath != "" {
+		// The pair has a key of its own
+		return nil
+	}
+	root, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	pairs, err := root.SyncPairs()
+	if err != nil {
+		return err
+	}
+	for _, pc := range pairs {
+		// Pull-only pairs never write to their remote
+		if pc.Name == cfg.Name || pc.KeyringPath != "" || pc.SyncDirection() == config.DirectionPull {
+			continue
+		}
+		if err := syncpkg.MarkRotation(pc, keyID); err != nil {
+			return fmt.Errorf("failed to mark sync pair %s for rotation: %w", pc.Name, err)
+		}
+		fmt.Printf("ℹ️  Sync pair %s uses the same keys and is rotated on its next run (or: rotate -pair %s)\n", pc.Name, pc.Name)
+	}
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	download := fs.Bool("download", false, "download objects to hash them when the remote has no SHA-256 support")
+	accept := fs.Bool("accept", false, "sign the current remote contents as the new manifest")
+	pair := fs.String("pair", "", "sync pair to verify, when config.json lists several")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadPairConfig(*pair)
+	if err != nil {
+		return err
+	}
+	key, err := manifest.LoadDeviceKey(manifest.DefaultDeviceKeyPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	store, err := uploader.NewBackend(cfg)
+	if err != nil {
+		return err
+	}
+	defer backend.Close(store)
+	m, err := manifest.Fetch(ctx, cfg, store, key)
+	if err != nil {
+		if !*accept {
+			return fmt.Errorf("remote manifest cannot be trusted: %w", err)
+		}
+		// Start from what this device last published
+		m = manifest.LoadLocal(cfg)
+	}
+	// Objects other devices wrote are checked against their manifests, as
+	// long as this device trusts them
+	trusted, err := manifest.LoadTrusted(manifest.DefaultTrustPath)
+	if err != nil {
+		return err
+	}
+	others, untrusted, err := manifest.FetchOthers(ctx, cfg, store, key, trusted)
+	if err != nil {
+		return err
+	}
+	all := []*manifest.Manifest{m}
+	for _, other := range others {
+		all = append(all, other)
+	}
+	merged := manifest.Merge(all...)
+
+	tree := syncpkg.RemoteTree(cfg, store)
+	objects, err := tree.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	if *download || *accept {
+		if err := manifest.FillHashes(ctx, tree, objects); err != nil {
+			return err
+		}
+	}
+
+	if *accept {
+		entries := make(map[string]manifest.Entry, len(objects))
+		for _, obj := range objects {
+			entries[obj.Path] = manifest.Entry{Size: obj.Size, SHA256: obj.Hashes["sha256"], Version: merged.Entries[obj.Path].Version}
+		}
+		m.Entries = entries
+		if err := m.Publish(ctx, cfg, store, key); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Manifest now lists %d objects\n", len(entries))
+		return nil
+	}
+
+	fmt.Printf("🔍 Verifying against manifest #%d from %s and %d of other devices\n",
+		m.Sequence, m.Updated.Local().Format("2006-01-02 15:04"), len(others))
+	report := merged.Compare(objects)
+	for _, id := range untrusted {
+		fmt.Println("   ❓ manifest of untrusted device", id)
+	}
+	for _, path := range report.Missing {
+		fmt.Println("   ❌ missing: ", path)
+	}
+	for _, path := range report.Extra {
+		fmt.Println("   ❓ extra:   ", path)
+	}
+	for _, path := range report.Tampered {
+		fmt.Println("   ⚠️  tampered:", path)
+	}
+	if len(report.Unhashed) > 0 {
+		fmt.Printf("   ℹ️  %d objects checked by size only, use -download to hash them\n", len(report.Unhashed))
+	}
+
+	if len(untrusted) > 0 {
+		fmt.Println("   ℹ️  Trust a device with: devices trust <key>, using the key its \"devices id\" prints")
+	}
+
+	if !report.OK() || len(untrusted) > 0 {
+		return fmt.Errorf("remote does not match manifest: %d missing, %d extra, %d tampered, %d untrusted devices",
+			len(report.Missing), len(report.Extra), len(report.Tampered), len(untrusted))
+	}
+	fmt.Println("✅ Remote matches manifest")
+	return nil
+}
+
+// devicesCommand manages the devices whose manifests this device trusts.
+func devicesCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: devices id|list|trust <key>|untrust <key>")
+	}
+	trusted, err := manifest.LoadTrusted(manifest.DefaultTrustPath)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "id":
+		key, err := manifest.LoadDeviceKey(manifest.DefaultDeviceKeyPath)
+		if err != nil {
+			return err
+		}
+		pub := key.Public().(ed25519.PublicKey)
+		fmt.Printf("This device is %s. Its key is:\n\n    %s\n\n", manifest.DeviceID(pub), manifest.DeviceKey(pub))
+		fmt.Println("   Run \"devices trust <key>\" with it on every other device writing to the same remote.")
+		return nil
+	case "list":
+		if len(trusted) == 0 {
+			fmt.Println("No trusted devices, add one with: devices trust <key>")
+		}
+		for id, pub := range trusted {
+			fmt.Printf("%s  %s\n", id, manifest.DeviceKey(pub))
+		}
+		return nil
+	case "trust", "untrust":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: devices %s <key>", args[0])
+		}
+		pub, err := manifest.ParseDeviceKey(args[1])
+		if err != nil {
+			return err
+		}
+		id := manifest.DeviceID(pub)
+		if args[0] == "trust" {
+			trusted.Add(pub)
+		} else {
+			delete(trusted, id)
+		}
+		if err := manifest.SaveTrusted(manifest.DefaultTrustPath, trusted); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Device %s %sed\n", id, args[0])
+		return nil
+	default:
+		return fmt.Errorf("unknown devices command %q", args[0])
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+)
+
+const minPassphraseLen = 12
+
+// readNewPassphrase asks for a passphrase twice. SYNCASE_PASSPHRASE is used
+// instead when fromEnv is set, so setup can run unattended.
+func readNewPassphrase(prompt string, fromEnv bool) (string, error) {
+	read := crypto.PromptPassphrase
+	if fromEnv {
+		read = crypto.ReadPassphrase
+	}
+
+	passphrase, err := read(prompt)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := os.LookupEnv(crypto.PassphraseEnv); !ok || !fromEnv {
+		again, err := crypto.PromptPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+	if len(passphrase) < minPassphraseLen {
+		return "", fmt.Errorf("passphrase must be at least %d characters", minPassphraseLen)
+	}
+	return passphrase, nil
+}
+
+func passphraseCommand(args []string) error {
+	if len(args) == 0 || args[0] != "init" {
+		return errors.New("usage: passphrase init [-kdf argon2id|scrypt] [-force]")
+	}
+
+	fs := flag.NewFlagSet("passphrase init", flag.ContinueOnError)
+	kdf := fs.String("kdf", crypto.KDFArgon2id, "key derivation function (argon2id or scrypt)")
+	force := fs.Bool("force", false, "replace existing key metadata")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(crypto.DefaultKeyMetadataPath); err == nil && !*force {
+		return fmt.Errorf("%s already exists, files encrypted with it would become unreadable (use -force)", crypto.DefaultKeyMetadataPath)
+	}
+
+	passphrase, err := readNewPassphrase("New passphrase: ", true)
+	if err != nil {
+		return err
+	}
+
+	key, err := crypto.InitPassphraseKey(crypto.DefaultKeyMetadataPath, passphrase, *kdf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🔑 Passphrase key %s created (%s), set \"key_source\": \"passphrase\" in config.json to use it\n", key.ID, *kdf)
+	return nil
+}
+
+func vaultCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: vault init|unlock|export|passwd")
+	}
+
+	switch args[0] {
+	case "init":
+		return vaultInit(args[1:])
+	case "unlock":
+		return vaultUnlock()
+	case "export":
+		return vaultExport(args[1:])
+	case "passwd":
+		return vaultPasswd(args[1:])
+	default:
+		return fmt.Errorf("unknown vault command %q", args[0])
+	}
+}
+
+// vaultInit creates the vault, importing the keys of the current key source
+// so that everything already on the remote stays readable.
+func vaultInit(args []string) error {
+	fs := flag.NewFlagSet("vault init", flag.ContinueOnError)
+	kdf := fs.String("kdf", crypto.KDFArgon2id, "key derivation function (argon2id or scrypt)")
+	masterKey := fs.Bool("master-key", false, "seal with a generated master key instead of a passphrase")
+	generate := fs.Bool("generate", false, "start with a new random data key instead of importing existing keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(crypto.DefaultVaultPath); err == nil {
+		return fmt.Errorf("%s already exists", crypto.DefaultVaultPath)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var keyring *crypto.Keyring
+	if *generate {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return err
+		}
+		if keyring, err = crypto.NewKeyring([]*crypto.Key{key}, key.ID); err != nil {
+			return err
+		}
+	} else {
+		if cfg.KeySource == crypto.SourceVault {
+			return errors.New("key_source is already vault, nothing to import (use -generate for new keys)")
+		}
+		if keyring, err = crypto.LoadKeys(cfg); err != nil {
+			return fmt.Errorf("failed to import existing keys (use -generate for new keys): %w", err)
+		}
+	}
+
+	var vault *crypto.Vault
+	if *masterKey {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		wrap, err := crypto.NewKey(secret)
+		if err != nil {
+			return err
+		}
+		if vault, err = crypto.SealVault(keyring, wrap, nil); err != nil {
+			return err
+		}
+		fmt.Printf("🔐 Master key (shown once, store it safely and set %s for the service):\n%s\n",
+			crypto.MasterKeyEnv, base64.StdEncoding.EncodeToString(secret))
+	} else {
+		passphrase, err := readNewPassphrase("Vault passphrase: ", true)
+		if err != nil {
+			return err
+		}
+		wrap, params, err := crypto.NewPassphraseWrap(passphrase, *kdf)
+		if err != nil {
+			return err
+		}
+		if vault, err = crypto.SealVault(keyring, wrap, params); err != nil {
+			return err
+		}
+	}
+
+	if err := vault.Save(crypto.DefaultVaultPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Vault created at %s with %d key(s), active key %s\n",
+		crypto.DefaultVaultPath, len(keyring.Keys()), keyring.Active().ID)
+	fmt.Println(`   Set "key_source": "vault" in config.json, then remove "encryption_key"`)
+	fmt.Println("   and", crypto.DefaultKeyringPath, "so no plaintext key is left on disk.")
+	return nil
+}
+
+// vaultUnlock checks that the vault opens and lists the keys it holds.
+func vaultUnlock() error {
+	src := &crypto.VaultSource{Path: crypto.DefaultVaultPath}
+	keyring, err := src.Keyring()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("🔓 Vault unlocked")
+	for i, key := range keyring.Keys() {
+		if i == 0 {
+			fmt.Println("   *", key.ID, "(active)")
+		} else {
+			fmt.Println("    ", key.ID)
+		}
+	}
+	return nil
+}
+
+// vaultExport writes a recovery copy of the vault sealed with its own
+// passphrase, meant to be kept offline.
+func vaultExport(args []string) error {
+	fs := flag.NewFlagSet("vault export", flag.ContinueOnError)
+	out := fs.String("out", "", "path of the recovery copy")
+	kdf := fs.String("kdf", crypto.KDFArgon2id, "key derivation function (argon2id or scrypt)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("usage: vault export -out FILE")
+	}
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%s already exists", *out)
+	}
+
+	src := &crypto.VaultSource{Path: crypto.DefaultVaultPath}
+	keyring, err := src.Keyring()
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := readNewPassphrase("Recovery passphrase: ", false)
+	if err != nil {
+		return err
+	}
+	wrap, params, err := crypto.NewPassphraseWrap(passphrase, *kdf)
+	if err != nil {
+		return err
+	}
+	vault, err := crypto.SealVault(keyring, wrap, params)
+	if err != nil {
+		return err
+	}
+	if err := vault.Save(*out); err != nil {
+		return err
+	}
+
+	fmt.Printf("💾 Recovery copy with %d key(s) written to %s\n", len(keyring.Keys()), *out)
+	fmt.Println("   Copy it to", crypto.DefaultVaultPath, "on a new machine and unlock it with the recovery passphrase.")
+	return nil
+}
+
+// vaultPasswd re-seals the vault under a new passphrase.
+func vaultPasswd(args []string) error {
+	fs := flag.NewFlagSet("vault passwd", flag.ContinueOnError)
+	kdf := fs.String("kdf", crypto.KDFArgon2id, "key derivation function (argon2id or scrypt)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	src := &crypto.VaultSource{
+		Path:       crypto.DefaultVaultPath,
+		Passphrase: func() (string, error) { return crypto.ReadPassphrase("Current passphrase: ") },
+	}
+	keyring, err := src.Keyring()
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := readNewPassphrase("New passphrase: ", false)
+	if err != nil {
+		return err
+	}
+	wrap, params, err := crypto.NewPassphraseWrap(passphrase, *kdf)
+	if err != nil {
+		return err
+	}
+	vault, err := crypto.SealVault(keyring, wrap, params)
+	if err != nil {
+		return err
+	}
+	if err := vault.Save(crypto.DefaultVaultPath); err != nil {
+		return err
+	}
+
+	fmt.Println("✅ Vault passphrase changed")
+	if _, ok := os.LookupEnv(crypto.PassphraseEnv); ok {
+		fmt.Println("   Remember to update", crypto.PassphraseEnv, "for the service.")
+	}
+	return nil
+}
+
+func sharesCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: shares split|recover")
+	}
+
+	switch args[0] {
+	case "split":
+		return sharesSplit(args[1:])
+	case "recover":
+		return sharesRecover(args[1:])
+	default:
+		return fmt.Errorf("unknown shares command %q", args[0])
+	}
+}
+
+func sharesSplit(args []string) error {
+	fs := flag.NewFlagSet("shares split", flag.ContinueOnError)
+	n := fs.Int("n", 5, "number of shares to create")
+	m := fs.Int("m", 3, "number of shares needed to recover the keyring")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	keyring, err := crypto.LoadKeys(cfg)
+	if err != nil {
+		return err
+	}
+
+	shares, err := crypto.SplitKeyring(keyring, *n, *m)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🧩 Keyring with active key %s split into %d shares, any %d of them recover it.\n", keyring.Active().ID, *n, *m)
+	fmt.Println("   Give each share to a different person and keep them offline.")
+	for i, share := range shares {
+		fmt.Printf("\nShare %d/%d:\n%s\n", i+1, *n, share)
+	}
+	return nil
+}
+
+func sharesRecover(args []string) error {
+	fs := flag.NewFlagSet("shares recover", flag.ContinueOnError)
+	out := fs.String("out", crypto.DefaultKeyringPath, "keyring file to add the recovered keys to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	fmt.Println("Enter one share per line:")
+	var shares []*crypto.Share
+	scanner := bufio.NewScanner(os.Stdin)
+	for len(shares) == 0 || len(shares) < shares[0].Threshold {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("input ended after %d shares", len(shares))
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		share, err := crypto.ParseShare(line)
+		if err != nil {
+			fmt.Println("❌", err)
+			continue
+		}
+		shares = append(shares, share)
+		fmt.Printf("✅ Share %d accepted (%d of %d)\n", share.Index, len(shares), shares[0].Threshold)
+	}
+
+	recovered, err := crypto.CombineShares(shares)
+	if err != nil {
+		return err
+	}
+
+	// Keep any keys already in the keyring file so older files stay readable
+	keyring := recovered
+	if _, err := os.Stat(*out); err == nil {
+		existing, err := crypto.LoadKeyring(&config.Config{}, *out)
+		if err != nil {
+			return err
+		}
+		if err := existing.Merge(recovered); err != nil {
+			return err
+		}
+		keyring = existing
+	}
+	if err := crypto.SaveKeyring(keyring, *out); err != nil {
+		return err
+	}
+
+	fmt.Printf("🔑 Keyring with active key %s recovered into %s\n", recovered.Active().ID, *out)
+	cfg, err := loadConfig()
+	if err == nil && cfg.KeySource != "" && cfg.KeySource != crypto.SourceConfig {
+		fmt.Println("   Set \"key_source\": \"config\" in config.json to use it")
+	}
+	return nil
+}
+
+func identityCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: identity new|list")
+	}
+	if args[0] != "new" && args[0] != "list" {
+		return fmt.Errorf("unknown identity command %q", args[0])
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	src, err := crypto.OpenKeySource(cfg)
+	if err != nil {
+		return err
+	}
+	keyring, err := src.Keyring()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		if len(keyring.Identities()) == 0 {
+			fmt.Println("No identities, create one with: identity new")
+		}
+		for _, id := range keyring.Identities() {
+			fmt.Println(id.Recipient())
+		}
+		return nil
+	}
+
+	store, ok := src.(crypto.KeyStore)
+	if !ok {
+		return fmt.Errorf("key source %q cannot store identities", cfg.KeySource)
+	}
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+	keyring.AddIdentity(id)
+	if err := store.SaveKeyring(keyring); err != nil {
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+	fmt.Println("🔑 New identity added to the keyring. Its recipient is:")
+	fmt.Println()
+	fmt.Println("   ", id.Recipient())
+	fmt.Println()
+	fmt.Println("   Add it to \"recipients\" in config.json of write-only devices, with \"key_source\": \"none\".")
+	fmt.Println("   Back up the keyring: files for this recipient cannot be read without it.")
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+	syncpkg "Syncase-silent-app-main/sync"
+	"Syncase-silent-app-main/uploader"
+)
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// restoreCommand decrypts a remote, or a local copy of it, into a fresh
+// folder for disaster recovery. It runs without the agent and never touches
+// the watched folder, so config.json is optional.
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := fs.String("from", "", "rclone path or local folder of .enc files (default: the configured remote)")
+	to := fs.String("to", "", "folder to write the restored files to")
+	keySource := fs.String("key-source", "", "key source to unlock: config, passphrase or vault (default: from config.json)")
+	names := fs.String("names", "", "whether object names are encrypted: true or false (default: from config.json)")
+	workers := fs.Int("workers", 4, "files to restore in parallel")
+	pair := fs.String("pair", "", "sync pair whose remote and key to use, when config.json lists several")
+	var include stringList
+	fs.Var(&include, "include", "only restore paths matching this pattern, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("restore needs -to, the folder to restore into")
+	}
+
+	cfg, err := loadPairConfig(*pair)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		cfg = &config.Config{}
+	}
+	if *keySource != "" {
+		cfg.KeySource = *keySource
+	}
+	if *names != "" {
+		cfg.EncryptNames = *names == "true"
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	// Folders are read directly, other paths go through rclone
+	var src backend.Backend
+	var mf *syncpkg.Manifest
+	source := *from
+	switch {
+	case source == "":
+		store, err := uploader.NewBackend(cfg)
+		if err != nil {
+			return fmt.Errorf("no remote to restore from, pass -from: %w", err)
+		}
+		defer backend.Close(store)
+		src = syncpkg.RemoteTree(cfg, store)
+		source = "the configured remote"
+		// The manifests beside the remote name the version of every file
+		if mf, err = syncpkg.OpenManifest(ctx, cfg, store); err != nil {
+			return err
+		}
+	case isDir(source):
+		src = backend.NewLocal(source)
+	default:
+		src = uploader.NewRclone(source)
+	}
+
+	target, err := filepath.Abs(*to)
+	if err != nil {
+		return err
+	}
+	if cfg.WatchedFolder != "" {
+		if rel, err := filepath.Rel(cfg.WatchedFolder, target); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("refusing to restore into the watched folder %s", cfg.WatchedFolder)
+		}
+	}
+
+	keyring, err := crypto.LoadKeys(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to unlock keys: %w", err)
+	}
+
+	fmt.Printf("📦 Restoring %s into %s\n", source, target)
+	if mf == nil {
+		fmt.Println("   ℹ️  Without the remote's manifests, file versions are not checked")
+	}
+	report, err := syncpkg.Restore(ctx, cfg, src, keyring, syncpkg.RestoreOptions{
+		Target:   target,
+		Include:  include,
+		Workers:  *workers,
+		Manifest: mf,
+	}, func(rel string, err error) {
+		if err != nil {
+			fmt.Printf("   ❌ %s: %v\n", rel, err)
+		} else {
+			fmt.Println("   ✅", rel)
+		}
+	})
+	if report == nil {
+		return err
+	}
+
+	fmt.Printf("\n%d restored, %d skipped by filters, %d failed\n", report.Restored, report.Skipped, len(report.Failed))
+	for _, f := range report.Failed {
+		fmt.Printf("   ❌ %s: %v\n", f.Path, f.Err)
+	}
+	if err == context.Canceled {
+		fmt.Println("⏸ Restore interrupted")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d files could not be restored", len(report.Failed))
+	}
+	return nil
+}
@@ -2,7 +2,11 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
 type ConflictStrategy string
@@ -14,12 +18,279 @@ const (
 	ConflictManual     ConflictStrategy = "manual"
 )
 
+// DefaultRemoteRoot is the folder of the remote holding the encrypted tree.
+const DefaultRemoteRoot = "Watched_folder"
+
+// DefaultStateDir holds the agent's state files.
+const DefaultStateDir = "storage"
+
+// Direction says which way a sync pair copies changes.
+type Direction string
+
+const (
+	// DirectionBoth pulls the remote at start and then pushes local changes
+	DirectionBoth Direction = "bidirectional"
+	// DirectionPush only uploads local changes
+	DirectionPush Direction = "push"
+	// DirectionPull only brings the remote down, at start and periodically
+	DirectionPull Direction = "pull"
+)
+
+// valid reports whether d is a known direction or empty.
+func (d Direction) valid() bool {
+	switch d {
+	case "", DirectionBoth, DirectionPush, DirectionPull:
+		return true
+	}
+	return false
+}
+
+// DefaultEncryptedFolder is where the encrypted remote is mirrored before decryption.
+const DefaultEncryptedFolder = "synced/encrypted_files"
+
 type Config struct {
-	WatchedFolder     string `json:"watchedFolder"`
-	RcloneRemote      string `json:"rclone_remote"`
-	EncryptionKey     string `json:"encryption_key"`
-	MaxDepth          int    `json:"max_depth"`
-	IgnoreLocalEvents bool   `json:"-"`
+	WatchedFolder   string `json:"watchedFolder"`
+	EncryptedFolder string `json:"encrypted_folder"`
+	RcloneRemote    string `json:"rclone_remote"`
+	// RemoteRoot is the folder of the remote holding the encrypted tree,
+	// DefaultRemoteRoot if empty
+	RemoteRoot string    `json:"remote_root"`
+	Direction  Direction `json:"direction"` // DirectionBoth if empty
+	// Pairs, if any, replace the watched folder, remote and root above
+	// with one sync per pair; the other settings are shared
+	Pairs []SyncPair `json:"pairs"`
+	// RcloneDaemon runs one "rclone rcd" for all transfers instead of an
+	// rclone process per operation
+	RcloneDaemon bool `json:"rclone_daemon"`
+	// Backend selects the storage: "rclone" (the default), "local" for a
+	// plain directory at LocalPath such as a NAS mount or USB drive, or
+	// "s3", "sftp" or "webdav" for the servers described by S3, SFTP and
+	// WebDAV
+	Backend       string       `json:"backend"`
+	LocalPath     string       `json:"local_path"`
+	S3            S3Config     `json:"s3"`
+	SFTP          SFTPConfig   `json:"sftp"`
+	WebDAV        WebDAVConfig `json:"webdav"`
+	EncryptNames  bool         `json:"encrypt_names"`
+	Compression   string       `json:"compression"` // "", "gzip" or "zstd"
+	EncryptionKey string       `json:"encryption_key"`
+	KeySource     string       `json:"key_source"`
+	// Recipients are X25519 public keys new files are encrypted to instead
+	// of the active key, see crypto.Recipient
+	Recipients        []string `json:"recipients"`
+	MaxDepth          int      `json:"max_depth"`
+	IgnoreLocalEvents bool     `json:"-"`
+
+	// Name is the sync pair this config was made for, if any
+	Name string `json:"-"`
+	// StateDir holds the sync state, DefaultStateDir if empty
+	StateDir string `json:"-"`
+	// KeyringPath overrides where the keyring of key_source "config" is kept
+	KeyringPath string `json:"-"`
+}
+
+// SyncPair is one local folder synced to its own place on a remote.
+type SyncPair struct {
+	Name        string `json:"name"`
+	LocalFolder string `json:"local_folder"`
+	// Remote is the rclone remote, rclone_remote if empty. Other backends
+	// keep the configured server and differ by RemoteRoot only.
+	Remote     string `json:"remote"`
+	RemoteRoot string `json:"remote_root"` // the pair's name if empty
+	// EncryptionKey gives the pair a key of its own, kept apart from the
+	// shared keys and recipients
+	EncryptionKey string    `json:"encryption_key"`
+	Direction     Direction `json:"direction"`
+}
+
+// Root returns the folder of the remote holding the encrypted tree.
+func (c *Config) Root() string {
+	if c.RemoteRoot == "" {
+		return DefaultRemoteRoot
+	}
+	return strings.Trim(c.RemoteRoot, "/")
+}
+
+// SyncDirection returns the direction to sync in.
+func (c *Config) SyncDirection() Direction {
+	if c.Direction == "" {
+		return DirectionBoth
+	}
+	return c.Direction
+}
+
+// StatePath returns the path of the state file name.
+func (c *Config) StatePath(name string) string {
+	if c.StateDir == "" {
+		return filepath.Join(DefaultStateDir, name)
+	}
+	return filepath.Join(c.StateDir, name)
+}
+
+// SyncPairs returns a config for every sync pair, with the pair's folder,
+// remote, root, key and direction in place of the top-level ones and its
+// own state directory. Without pairs it returns c itself.
+func (c *Config) SyncPairs() ([]*Config, error) {
+	// Pairs without a direction of their own inherit it
+	if !c.Direction.valid() {
+		return nil, fmt.Errorf("unknown direction %q", c.Direction)
+	}
+	if len(c.Pairs) == 0 {
+		return []*Config{c}, nil
+	}
+	seen := make(map[string]bool)
+	pairs := make([]*Config, 0, len(c.Pairs))
+	for _, p := range c.Pairs {
+		if p.Name == "" || strings.ContainsAny(p.Name, `/\:`) || p.Name == "." || p.Name == ".." {
+			return nil, fmt.Errorf("sync pair name %q is not a valid folder name", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("sync pair %q is listed twice", p.Name)
+		}
+		seen[p.Name] = true
+		if p.LocalFolder == "" {
+			return nil, fmt.Errorf("sync pair %q has no local_folder", p.Name)
+		}
+		if !p.Direction.valid() {
+			return nil, fmt.Errorf("sync pair %q: unknown direction %q", p.Name, p.Direction)
+		}
+
+		pc := *c
+		pc.Pairs = nil
+		pc.Name = p.Name
+		pc.WatchedFolder = p.LocalFolder
+		pc.EncryptedFolder = filepath.Join(c.EncryptedFolder, p.Name)
+		pc.StateDir = filepath.Join(c.StatePath("pairs"), p.Name)
+		pc.RemoteRoot = p.RemoteRoot
+		if pc.RemoteRoot == "" {
+			pc.RemoteRoot = p.Name
+		}
+		if p.Remote != "" {
+			pc.RcloneRemote = p.Remote
+		}
+		if p.Direction != "" {
+			pc.Direction = p.Direction
+		}
+		if p.EncryptionKey != "" {
+			pc.EncryptionKey = p.EncryptionKey
+			pc.KeySource = ""
+			pc.Recipients = nil
+			pc.KeyringPath = filepath.Join(pc.StateDir, "keyring.json")
+		}
+		pairs = append(pairs, &pc)
+	}
+	if err := checkOverlap(pairs); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// checkOverlap rejects pairs that would sync the same files twice: one
+// local folder inside another, or one remote root inside another on the
+// same remote.
+func checkOverlap(pairs []*Config) error {
+	for i, a := range pairs {
+		for _, b := range pairs[i+1:] {
+			if localOverlap(a.WatchedFolder, b.WatchedFolder) {
+				return fmt.Errorf("sync pairs %q and %q overlap: local folders %s and %s", a.Name, b.Name, a.WatchedFolder, b.WatchedFolder)
+			}
+			if a.remote() == b.remote() && remoteOverlap(a.Root(), b.Root()) {
+				return fmt.Errorf("sync pairs %q and %q overlap: remote roots %q and %q", a.Name, b.Name, a.Root(), b.Root())
+			}
+		}
+	}
+	return nil
+}
+
+// remote names the storage the config's root is on; only rclone pairs can
+// use different remotes
+func (c *Config) remote() string {
+	if c.Backend == "" || c.Backend == "rclone" {
+		return "rclone:" + c.RcloneRemote
+	}
+	return c.Backend
+}
+
+// localOverlap reports whether one of the folders is or contains the other
+func localOverlap(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return within(a, b) || within(b, a)
+}
+
+// within reports whether path is dir or below it
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// remoteOverlap reports whether one of the remote roots is or contains the
+// other; the empty root is the whole remote
+func remoteOverlap(a, b string) bool {
+	a, b = path.Clean("/"+a), path.Clean("/"+b)
+	return a == b || a == "/" || b == "/" ||
+		strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// Pair returns the config of the sync pair called name. An empty name
+// selects the only sync there is.
+func (c *Config) Pair(name string) (*Config, error) {
+	pairs, err := c.SyncPairs()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		if len(pairs) == 1 {
+			return pairs[0], nil
+		}
+		names := make([]string, len(pairs))
+		for i, p := range pairs {
+			names[i] = p.Name
+		}
+		return nil, fmt.Errorf("config has %d sync pairs, choose one of %s", len(pairs), strings.Join(names, ", "))
+	}
+	for _, p := range pairs {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no sync pair called %q", name)
+}
+
+// S3Config points the "s3" backend at a bucket of any S3-compatible store.
+// Empty credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN.
+type S3Config struct {
+	Endpoint        string `json:"endpoint"` // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// SFTPConfig points the "sftp" backend at a directory on an SFTP server.
+// Only key-based logins to a server whose host key is pinned are accepted.
+type SFTPConfig struct {
+	Host          string `json:"host"` // host or host:port, port 22 by default
+	User          string `json:"user"`
+	KeyFile       string `json:"key_file"`
+	KeyPassphrase string `json:"key_passphrase"`
+	// HostKey is the server's public key as in known_hosts without the host
+	// name ("ssh-ed25519 AAAA..."), or its fingerprint ("SHA256:...")
+	HostKey string `json:"host_key"`
+	Root    string `json:"root"`
+}
+
+// WebDAVConfig points the "webdav" backend at a collection on a WebDAV
+// server such as Nextcloud, logging in with an app password.
+type WebDAVConfig struct {
+	URL      string `json:"url"` // e.g. "https://cloud.example.com/remote.php/dav/files/alice/Syncase"
+	User     string `json:"user"`
+	Password string `json:"password"`
 }
 
 func LoadConfigFromFile(path string) (*Config, error) {
@@ -32,6 +303,9 @@ func LoadConfigFromFile(path string) (*Config, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if cfg.EncryptedFolder == "" {
+		cfg.EncryptedFolder = DefaultEncryptedFolder
+	}
 
 	return &cfg, nil
 }
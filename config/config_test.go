@@ -0,0 +1,77 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectionValidated(t *testing.T) {
+	for _, c := range []*Config{
+		{Direction: "pul"},
+		{Direction: "pul", Pairs: []SyncPair{{Name: "a", LocalFolder: "a", Direction: DirectionPush}}},
+		{Pairs: []SyncPair{{Name: "a", LocalFolder: "a", Direction: "both"}}},
+	} {
+		if _, err := c.SyncPairs(); err == nil {
+			t.Errorf("config with direction %q and pairs %v accepted", c.Direction, c.Pairs)
+		}
+	}
+
+	c := &Config{Direction: DirectionPull}
+	pairs, err := c.SyncPairs()
+	if err != nil || len(pairs) != 1 || pairs[0].SyncDirection() != DirectionPull {
+		t.Errorf("pairs = %v, %v", pairs, err)
+	}
+}
+
+func TestPairsOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{"separate", Config{Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "docs"},
+			{Name: "b", LocalFolder: "docs2"},
+		}}, true},
+		{"same folder", Config{Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "docs"},
+			{Name: "b", LocalFolder: "docs/"},
+		}}, false},
+		{"nested folder", Config{Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "docs"},
+			{Name: "b", LocalFolder: filepath.Join("docs", "work")},
+		}}, false},
+		{"same root", Config{Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "a", RemoteRoot: "backup"},
+			{Name: "b", LocalFolder: "b", RemoteRoot: "/backup/"},
+		}}, false},
+		{"nested root", Config{Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "a", RemoteRoot: "backup"},
+			{Name: "b", LocalFolder: "b", RemoteRoot: "backup/b"},
+		}}, false},
+		{"root named like another pair", Config{Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "a"},
+			{Name: "b", LocalFolder: "b", RemoteRoot: "a"},
+		}}, false},
+		{"prefix of another root", Config{Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "a", RemoteRoot: "backup"},
+			{Name: "b", LocalFolder: "b", RemoteRoot: "backup2"},
+		}}, true},
+		{"same root on other remotes", Config{RcloneRemote: "gdrive", Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "a", RemoteRoot: "backup"},
+			{Name: "b", LocalFolder: "b", RemoteRoot: "backup", Remote: "dropbox"},
+		}}, true},
+		{"same root on one server", Config{Backend: "s3", Pairs: []SyncPair{
+			{Name: "a", LocalFolder: "a", RemoteRoot: "backup"},
+			{Name: "b", LocalFolder: "b", RemoteRoot: "backup", Remote: "ignored"},
+		}}, false},
+	} {
+		_, err := tc.cfg.SyncPairs()
+		if tc.valid && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: overlapping pairs accepted", tc.name)
+		}
+	}
+}
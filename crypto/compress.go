@@ -0,0 +1,177 @@
+package crypto
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies how the plaintext was compressed before encryption.
+type Codec uint8
+
+const (
+	CodecNone Codec = 0
+	CodecGzip Codec = 1
+	CodecZstd Codec = 2
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// ParseCodec maps config.json's compression setting to a codec. An empty
+// setting disables compression.
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return CodecNone, nil
+	case "gzip":
+		return CodecGzip, nil
+	case "zstd":
+		return CodecZstd, nil
+	default:
+		return CodecNone, fmt.Errorf("unknown compression %q", name)
+	}
+}
+
+// UnsupportedCodecError is returned when the header names an unknown codec.
+type UnsupportedCodecError struct {
+	Codec Codec
+}
+
+func (e *UnsupportedCodecError) Error() string {
+	return fmt.Sprintf("unsupported compression %s", e.Codec)
+}
+
+// compressedExts are formats that are already compressed and would only
+// waste CPU time on a second pass.
+var compressedExts = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".7z": true, ".rar": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".heic": true, ".mp3": true, ".m4a": true, ".aac": true, ".ogg": true,
+	".flac": true, ".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true,
+	".avi": true, ".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true,
+	".ods": true, ".odp": true, ".epub": true, ".jar": true, ".apk": true,
+}
+
+const (
+	entropySample = 64 * 1024
+	// maxEntropy in bits per byte above which a sample is treated as
+	// incompressible; text sits around 4-5, compressed data close to 8
+	maxEntropy = 7.5
+)
+
+// chooseCodec returns codec, or CodecNone when f looks already compressed
+// by its extension or a sample of its content. f is rewound afterwards.
+func chooseCodec(f *os.File, codec Codec) (Codec, error) {
+	if codec == CodecNone || compressedExts[strings.ToLower(filepath.Ext(f.Name()))] {
+		return CodecNone, nil
+	}
+
+	sample := make([]byte, entropySample)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return CodecNone, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return CodecNone, err
+	}
+	if n == 0 || entropy(sample[:n]) > maxEntropy {
+		return CodecNone, nil
+	}
+	return codec, nil
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// compress writes exactly size bytes of src to dst through codec.
+func compress(codec Codec, dst io.Writer, src io.Reader, size int64) error {
+	var zw io.WriteCloser
+	switch codec {
+	case CodecGzip:
+		zw = gzip.NewWriter(dst)
+	case CodecZstd:
+		w, err := zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+		zw = w
+	default:
+		return &UnsupportedCodecError{Codec: codec}
+	}
+
+	n, err := io.Copy(zw, src)
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	if n != size {
+		zw.Close()
+		return fmt.Errorf("source changed while encrypting: expected %d bytes, read %d", size, n)
+	}
+	return zw.Close()
+}
+
+// decompress writes the decompressed form of src to dst, failing unless it
+// is exactly size bytes long.
+func decompress(codec Codec, dst io.Writer, src io.Reader, size int64) error {
+	var zr io.Reader
+	switch codec {
+	case CodecGzip:
+		r, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		zr = r
+	case CodecZstd:
+		r, err := zstd.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		zr = r
+	default:
+		return &UnsupportedCodecError{Codec: codec}
+	}
+
+	// Read one byte past size so an oversized stream is caught without
+	// decompressing all of it
+	n, err := io.Copy(dst, io.LimitReader(zr, size+1))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return ErrSizeMismatch
+	}
+	return nil
+}
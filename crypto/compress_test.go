@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compressible is text spanning several chunks
+func compressible() []byte {
+	return []byte(strings.Repeat("every line of a log file looks much like the last one\n", 3*DefaultChunkSize/50))
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	kr := testKeyring(t)
+	b := Binding{Path: "log.txt"}
+	for _, codec := range []Codec{CodecGzip, CodecZstd} {
+		for _, plain := range [][]byte{compressible(), {}, []byte("x")} {
+			file := encrypt(t, kr.Active(), plain, b, codec)
+			h, err := ReadHeader(bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Codec != codec || h.OriginalSize != uint64(len(plain)) {
+				t.Errorf("%s: header has %s and %d bytes", codec, h.Codec, h.OriginalSize)
+			}
+			if len(plain) > DefaultChunkSize && len(file) > len(plain)/10 {
+				t.Errorf("%s: %d bytes encrypted into %d", codec, len(plain), len(file))
+			}
+			got, err := decrypt(kr, file, b)
+			if err != nil {
+				t.Fatalf("%s: %v", codec, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("%s: decrypted %d bytes that differ", codec, len(got))
+			}
+		}
+	}
+}
+
+func TestChooseCodec(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name    string
+		content []byte
+		codec   Codec
+		want    Codec
+	}{
+		{"notes.txt", compressible(), CodecZstd, CodecZstd},
+		{"notes.txt", compressible(), CodecNone, CodecNone},
+		// Already compressed by its extension or its content
+		{"photo.JPG", compressible(), CodecGzip, CodecNone},
+		{"random.bin", randomPlaintext(t, 2*entropySample), CodecGzip, CodecNone},
+		{"empty.txt", nil, CodecGzip, CodecNone},
+	} {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := chooseCodec(f, tt.codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s with %s: chose %s, want %s", tt.name, tt.codec, got, tt.want)
+		}
+		// The file is read from the start afterwards
+		if pos, _ := f.Seek(0, io.SeekCurrent); pos != 0 {
+			t.Errorf("%s left at offset %d", tt.name, pos)
+		}
+		f.Close()
+	}
+}
+
+func TestReencryptKeepsCodec(t *testing.T) {
+	kr := testKeyring(t)
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "log.txt")
+	if err := os.WriteFile(plainPath, compressible(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := Binding{Path: "log.txt", Version: 3}
+	oldPath, newPath := filepath.Join(dir, "old.enc"), filepath.Join(dir, "new.enc")
+	if err := EncryptFile(kr.Active(), plainPath, oldPath, b, CodecZstd); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.ID += "-next"
+	if err := kr.Add(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.SetActive(next.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReencryptFile(kr, oldPath, newPath, b); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h, err := ReadHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Codec != CodecZstd || h.KeyID != next.ID || h.FileVersion != 3 {
+		t.Errorf("re-encrypted header has %s, key %s and version %d", h.Codec, h.KeyID, h.FileVersion)
+	}
+	out := filepath.Join(dir, "out.txt")
+	if err := DecryptFile(kr, newPath, out, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, compressible()) {
+		t.Errorf("re-encrypted file decrypts to %d bytes that differ", len(got))
+	}
+}
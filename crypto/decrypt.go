@@ -1,39 +1,30 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"errors"
+	"io"
 	"os"
 )
 
-// DecryptFile reads an encrypted file (nonce + ciphertext) and writes plaintext to outputPath.
-func DecryptFile(key []byte, inputPath, outputPath string) error {
-	data, err := os.ReadFile(inputPath)
+// DecryptFile streams an encrypted file from inputPath and writes plaintext to outputPath,
+// using whichever key of kr the file was encrypted with. b is the binding the
+// file is expected to carry; a blob moved from another path is rejected.
+// The output only appears once every chunk has been authenticated.
+func DecryptFile(kr *Keyring, inputPath, outputPath string, b Binding) error {
+	in, err := os.Open(inputPath)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return err
-	}
-
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return errors.New("ciphertext too short")
-	}
-	nonce := data[:nonceSize]
-	ciphertext := data[nonceSize:]
-
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return err
-	}
+	return writeFileAtomic(outputPath, 0644, func(w io.Writer) error {
+		return DecryptStream(kr, w, in, b)
+	})
+}
 
-	return os.WriteFile(outputPath, plaintext, 0644)
+// DecryptReaderToFile is DecryptFile reading the encrypted file from src,
+// e.g. straight from a download.
+func DecryptReaderToFile(kr *Keyring, src io.Reader, outputPath string, b Binding) error {
+	return writeFileAtomic(outputPath, 0644, func(w io.Writer) error {
+		return DecryptStream(kr, w, src, b)
+	})
 }
@@ -1,64 +1,150 @@
-// encrypt.go - FIXED
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"io"
 	"os"
+	"path/filepath"
 )
 
-// EncryptFile encrypts a file (renamed from EncryptFileStream for consistency)
-func EncryptFile(key []byte, inputPath, outputPath string) error {
+// EncryptFile encrypts inputPath into outputPath using the chunked stream
+// format, bound to b. The plaintext is compressed with codec first unless it
+// looks already compressed.
+func EncryptFile(key KeyWrapper, inputPath, outputPath string, b Binding, codec Codec) error {
+	return writeFileAtomic(outputPath, 0644, func(w io.Writer) error {
+		return EncryptFileTo(key, w, inputPath, b, codec)
+	})
+}
+
+// EncryptFileTo is EncryptFile writing to w instead of a file, e.g. to
+// stream straight into an upload.
+func EncryptFileTo(key KeyWrapper, w io.Writer, inputPath string, b Binding, codec Codec) error {
 	in, err := os.Open(inputPath)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	info, err := in.Stat()
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	codec, err = chooseCodec(in, codec)
+	if err != nil {
+		return err
+	}
+	return EncryptStream(key, w, in, info.Size(), b, codec)
+}
 
-	block, err := aes.NewCipher(key)
+// ReencryptFile decrypts inputPath with whichever key of kr it was written
+// under and encrypts it again into outputPath with the active key, keeping
+// its compression. The plaintext only ever exists in memory, one chunk at a
+// time.
+func ReencryptFile(kr *Keyring, inputPath, outputPath string, b Binding) error {
+	in, err := os.Open(inputPath)
 	if err != nil {
 		return err
 	}
-	gcm, err := cipher.NewGCM(block)
+	defer in.Close()
+
+	size, codec, err := plainInfo(in)
 	if err != nil {
 		return err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(DecryptStream(kr, pw, in, b))
+	}()
+	defer pr.Close()
+
+	return writeFileAtomic(outputPath, 0644, func(w io.Writer) error {
+		return EncryptStream(kr.Active(), w, pr, size, b, codec)
+	})
+}
+
+// RewrapFile moves inputPath to the active key of kr, writing the result to
+// outputPath. Only the header changes: the data key is unwrapped with the old
+// master key and wrapped again with the active one, and the chunks are copied
+// unchanged. Legacy files without a header are re-encrypted in full
+// instead, bound to b.
+func RewrapFile(kr *Keyring, inputPath, outputPath string, b Binding) error {
+	in, err := os.Open(inputPath)
+	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	// write nonce first
-	if _, err := out.Write(nonce); err != nil {
+	h, err := ReadHeader(in)
+	if err == ErrNotEncrypted {
+		return ReencryptFile(kr, inputPath, outputPath, b)
+	}
+	if err != nil {
 		return err
 	}
 
-	buffer := make([]byte, 1024*1024) // 1MB buffer
+	dataKey, err := h.openDataKey(kr)
+	if err != nil {
+		return err
+	}
+	if err := kr.Active().wrapKey(h, dataKey); err != nil {
+		return err
+	}
 
-	for {
-		n, err := in.Read(buffer)
-		if n > 0 {
-			encrypted := gcm.Seal(nil, nonce, buffer[:n], nil)
-			if _, wErr := out.Write(encrypted); wErr != nil {
-				return wErr
-			}
-		}
-		if err == io.EOF {
-			break
+	return writeFileAtomic(outputPath, 0644, func(w io.Writer) error {
+		if _, err := w.Write(h.marshal()); err != nil {
+			return err
 		}
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// plainInfo returns the plaintext size and codec recorded in f and rewinds
+// it.
+func plainInfo(f *os.File) (int64, Codec, error) {
+	h, err := ReadHeader(f)
+	var size int64
+	codec := CodecNone
+	switch err {
+	case nil:
+		size, codec = int64(h.OriginalSize), h.Codec
+	case ErrNotEncrypted:
+		info, err := f.Stat()
 		if err != nil {
-			return err
+			return 0, CodecNone, err
 		}
+		size = legacyPlainSize(info.Size())
+	default:
+		return 0, CodecNone, err
 	}
+	_, err = f.Seek(0, io.SeekStart)
+	return size, codec, err
+}
+
+// TempPrefix starts the names of the temporary files written next to a
+// file until it is complete. Files decrypted into the watched folder pass
+// through one, so the sync engine must never upload them.
+const TempPrefix = ".syncase-tmp-"
 
-	return nil
-}
\ No newline at end of file
+// writeFileAtomic writes to a temporary file next to path and renames it into
+// place only when fn succeeds, so a failed run never leaves a partial file.
+func writeFileAtomic(path string, perm os.FileMode, fn func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), TempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := fn(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
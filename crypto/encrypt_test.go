@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRewrapFile(t *testing.T) {
+	kr := testKeyring(t)
+	old := kr.Active()
+	dir := t.TempDir()
+	plain := randomPlaintext(t, DefaultChunkSize+100)
+	b := Binding{Path: "a.bin", Version: 2}
+	in, out := filepath.Join(dir, "in.enc"), filepath.Join(dir, "out.enc")
+	if err := os.WriteFile(in, encrypt(t, old, plain, b, CodecNone), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := NewKey(randomPlaintext(t, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Add(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.SetActive(next.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := RewrapFile(kr, in, out, b); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := os.ReadFile(in)
+	after, _ := os.ReadFile(out)
+	h, err := ReadHeader(bytes.NewReader(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.KeyID != next.ID {
+		t.Errorf("rewrapped file names key %s, want %s", h.KeyID, next.ID)
+	}
+	oldHeader, err := ReadHeader(bytes.NewReader(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the key id and wrapped data key change, the chunks are copied
+	// as they are
+	if !bytes.Equal(after[len(h.marshal()):], before[len(oldHeader.marshal()):]) {
+		t.Error("rewrapping changed the chunks")
+	}
+	if !bytes.Equal(h.fixed(), oldHeader.fixed()) {
+		t.Error("rewrapping changed the fixed header")
+	}
+
+	// The old key is no longer needed
+	alone, err := NewKeyring([]*Key{next}, next.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decrypt(alone, after, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("rewrapped file decrypts to other content")
+	}
+	if _, err := decrypt(alone, before, b); err == nil {
+		t.Error("original file decrypted without its key")
+	}
+}
@@ -0,0 +1,365 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// On-disk layout of an encrypted file (all integers big endian):
+//
+//	magic "SCEF" (4) | version (1) | suite (1) | chunk size (4) | original size (8) |
+//	file version (8) | codec (1) | file nonce (12) | wrap type (1) | wrapped key | chunk 0 | ...
+//
+// where the wrapped key is, for wrap type 1 (master key):
+//
+//	key id length (1) | key id | wrapped data key (60)
+//
+// and for wrap type 2 (public-key mode, see recipient.go):
+//
+//	recipient count (1) | one stanza (100) per recipient
+//
+// When the codec is not CodecNone the plaintext is compressed before it is
+// split into chunks; the original size is always that of the uncompressed file.
+//
+// Every file has its own random data key. It is sealed with AES-256-GCM
+// under the master key named by the key id and stored in the header, so
+// rotating the master key only rewrites headers, see RewrapFile. In
+// public-key mode it is sealed to X25519 recipients instead.
+//
+// Every chunk is a separate AES-256-GCM box holding up to chunkSize bytes of
+// plaintext under the data key. Its nonce is the file nonce XORed with the
+// chunk counter, with the top bit flipped on the last chunk so that
+// truncating or extending the stream fails authentication. The fixed part of
+// the header, up to and including the file nonce, is authenticated as
+// additional data of the wrapped data key and, followed by the file's
+// normalised relative path, of every chunk. A blob moved to another path or
+// substituted for another file therefore fails to decrypt, see Binding.
+//
+// Files written before the header existed are a single nonce followed by
+// 1MB GCM boxes that all share it. They are still readable, see
+// decryptLegacy.
+const (
+	FormatVersion    = 1
+	DefaultChunkSize = 1024 * 1024 // 1MB
+	maxChunkSize     = 16 * 1024 * 1024
+	maxKeyIDLen      = 255
+	fileNonceSize    = 12
+	dataKeySize      = 32
+	wrappedKeySize   = 12 + dataKeySize + 16 // nonce | key | tag
+	fixedHeaderSize  = 4 + 1 + 1 + 4 + 8
+
+	// MaxHeaderSize is enough bytes to read any header with ReadHeader.
+	MaxHeaderSize = 2048
+)
+
+var fileMagic = []byte("SCEF")
+
+// Suite identifies the AEAD used for the chunks of a file.
+type Suite uint8
+
+const (
+	SuiteAES256GCM Suite = 1
+)
+
+func (s Suite) String() string {
+	switch s {
+	case SuiteAES256GCM:
+		return "AES-256-GCM"
+	default:
+		return fmt.Sprintf("suite(%d)", uint8(s))
+	}
+}
+
+var (
+	ErrNotEncrypted = errors.New("not a syncase encrypted file")
+	ErrTruncated    = errors.New("encrypted file is truncated")
+	ErrAuthFailed   = errors.New("encrypted file failed authentication")
+	ErrSizeMismatch = errors.New("decrypted size does not match header")
+)
+
+// UnsupportedVersionError is returned for files written by a newer format version.
+type UnsupportedVersionError struct {
+	Version uint8
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported encrypted file version %d (this build reads up to %d)", e.Version, FormatVersion)
+}
+
+// UnsupportedSuiteError is returned when the header names an unknown cipher suite.
+type UnsupportedSuiteError struct {
+	Suite Suite
+}
+
+func (e *UnsupportedSuiteError) Error() string {
+	return fmt.Sprintf("unsupported cipher suite %s", e.Suite)
+}
+
+// InvalidHeaderError is returned when a header field is out of range.
+type InvalidHeaderError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidHeaderError) Error() string {
+	return fmt.Sprintf("invalid header %s: %s", e.Field, e.Reason)
+}
+
+// Header describes an encrypted file.
+type Header struct {
+	Version      uint8
+	Suite        Suite
+	ChunkSize    uint32
+	OriginalSize uint64
+	// FileVersion is the caller's version counter, see Binding
+	FileVersion uint64
+	Codec       Codec
+	// KeyID names the master key that wraps the data key
+	KeyID   string
+	nonce   [fileNonceSize]byte
+	wrapped []byte
+	// stanzas wrap the data key for each recipient in public-key mode
+	stanzas [][]byte
+}
+
+// Wrap types of the data key.
+const (
+	wrapMasterKey = 1
+	wrapX25519    = 2
+)
+
+// PublicKey reports whether the data key is wrapped for X25519 recipients
+// rather than under a master key.
+func (h *Header) PublicKey() bool {
+	return len(h.stanzas) > 0
+}
+
+// fixed returns the part of the header that does not change when the data
+// key is rewrapped.
+func (h *Header) fixed() []byte {
+	buf := make([]byte, 0, fixedHeaderSize+8+1+fileNonceSize)
+	buf = append(buf, fileMagic...)
+	buf = append(buf, h.Version, byte(h.Suite))
+	buf = binary.BigEndian.AppendUint32(buf, h.ChunkSize)
+	buf = binary.BigEndian.AppendUint64(buf, h.OriginalSize)
+	buf = binary.BigEndian.AppendUint64(buf, h.FileVersion)
+	buf = append(buf, byte(h.Codec))
+	buf = append(buf, h.nonce[:]...)
+	return buf
+}
+
+func (h *Header) marshal() []byte {
+	buf := h.fixed()
+	if h.PublicKey() {
+		buf = append(buf, wrapX25519, byte(len(h.stanzas)))
+		for _, s := range h.stanzas {
+			buf = append(buf, s...)
+		}
+		return buf
+	}
+	buf = append(buf, wrapMasterKey, byte(len(h.KeyID)))
+	buf = append(buf, h.KeyID...)
+	buf = append(buf, h.wrapped...)
+	return buf
+}
+
+// ReadHeader reads and validates the header at the start of r without
+// decrypting anything, e.g. to find out which key a file needs.
+func ReadHeader(r io.Reader) (*Header, error) {
+	h, _, err := readHeader(r)
+	return h, err
+}
+
+// readHeader reads and validates the header, returning it together with the
+// bytes the chunks authenticate as additional data.
+func readHeader(r io.Reader) (*Header, []byte, error) {
+	raw := make([]byte, fixedHeaderSize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrNotEncrypted
+		}
+		return nil, nil, err
+	}
+	if !bytes.Equal(raw[:4], fileMagic) {
+		return nil, nil, ErrNotEncrypted
+	}
+
+	h := &Header{
+		Version:      raw[4],
+		Suite:        Suite(raw[5]),
+		ChunkSize:    binary.BigEndian.Uint32(raw[6:10]),
+		OriginalSize: binary.BigEndian.Uint64(raw[10:18]),
+	}
+	if h.Version != FormatVersion {
+		return nil, nil, &UnsupportedVersionError{Version: h.Version}
+	}
+	if h.Suite != SuiteAES256GCM {
+		return nil, nil, &UnsupportedSuiteError{Suite: h.Suite}
+	}
+	if h.ChunkSize == 0 || h.ChunkSize > maxChunkSize {
+		return nil, nil, &InvalidHeaderError{Field: "chunk size", Reason: fmt.Sprintf("%d out of range", h.ChunkSize)}
+	}
+
+	rest, err := readFull(r, 8+1+fileNonceSize+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.FileVersion = binary.BigEndian.Uint64(rest[:8])
+	h.Codec = Codec(rest[8])
+	if h.Codec > CodecZstd {
+		return nil, nil, &UnsupportedCodecError{Codec: h.Codec}
+	}
+	copy(h.nonce[:], rest[9:9+fileNonceSize])
+	switch wrap := rest[len(rest)-1]; wrap {
+	case wrapMasterKey:
+	case wrapX25519:
+		count, err := readFull(r, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if count[0] == 0 || count[0] > maxRecipients {
+			return nil, nil, &InvalidHeaderError{Field: "recipients", Reason: fmt.Sprintf("%d out of range", count[0])}
+		}
+		for i := 0; i < int(count[0]); i++ {
+			s, err := readFull(r, stanzaSize)
+			if err != nil {
+				return nil, nil, err
+			}
+			h.stanzas = append(h.stanzas, s)
+		}
+		return h, h.fixed(), nil
+	default:
+		return nil, nil, &InvalidHeaderError{Field: "wrap type", Reason: fmt.Sprintf("unknown type %d", wrap)}
+	}
+
+	if rest, err = readFull(r, 1); err != nil {
+		return nil, nil, err
+	}
+	idLen := int(rest[0])
+	if rest, err = readFull(r, idLen+wrappedKeySize); err != nil {
+		return nil, nil, err
+	}
+	h.KeyID = string(rest[:idLen])
+	h.wrapped = rest[idLen:]
+	return h, h.fixed(), nil
+}
+
+func readFull(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// wrapKey seals the data key under the master key, bound to the header.
+func (master *Key) wrapKey(h *Header, dataKey []byte) error {
+	if len(master.ID) > maxKeyIDLen {
+		return fmt.Errorf("key id %q is too long", master.ID)
+	}
+	gcm, err := newGCM(master.Secret)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	h.KeyID = master.ID
+	h.wrapped = gcm.Seal(nonce, nonce, dataKey, h.fixed())
+	h.stanzas = nil
+	return nil
+}
+
+// openDataKey unwraps the data key with the master key or identity of kr
+// the file was written for.
+func (h *Header) openDataKey(kr *Keyring) ([]byte, error) {
+	if h.PublicKey() {
+		for _, id := range kr.Identities() {
+			if key, ok := id.unwrap(h); ok {
+				return key, nil
+			}
+		}
+		return nil, ErrNoIdentity
+	}
+	key, err := kr.Lookup(h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	return h.dataKey(key)
+}
+
+// dataKey returns the key the chunks are sealed with.
+func (h *Header) dataKey(master *Key) ([]byte, error) {
+	gcm, err := newGCM(master.Secret)
+	if err != nil {
+		return nil, err
+	}
+	n := gcm.NonceSize()
+	key, err := gcm.Open(nil, h.wrapped[:n], h.wrapped[n:], h.fixed())
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return key, nil
+}
+
+// Binding ties an encrypted file to the place it belongs. Both fields are
+// authenticated with every chunk, so decrypting under a different path fails.
+type Binding struct {
+	// Path is the file's path relative to the synced folder
+	Path string
+	// Version is an optional counter stored in the header. When non-zero on
+	// decryption, a file carrying any other version is rejected.
+	Version uint64
+}
+
+// BindingError is returned when a file does not authenticate for the path it
+// was expected at, or carries another version than the one asked for.
+type BindingError struct {
+	Path   string
+	Reason string
+}
+
+func (e *BindingError) Error() string {
+	return fmt.Sprintf("encrypted file does not belong at %s: %s", e.Path, e.Reason)
+}
+
+func (e *BindingError) Unwrap() error {
+	return ErrAuthFailed
+}
+
+// normalisePath returns the canonical form of a relative path used in the
+// additional data, so the same file binds the same way on every platform.
+func normalisePath(p string) string {
+	p = path.Clean("/" + filepath.ToSlash(p))
+	return strings.TrimPrefix(p, "/")
+}
+
+// chunkAD returns the additional data of every chunk of a file.
+func (h *Header) chunkAD(fixed []byte, b Binding) []byte {
+	return append(fixed[:len(fixed):len(fixed)], normalisePath(b.Path)...)
+}
+
+// chunkNonce derives the nonce of chunk n from the file nonce.
+func chunkNonce(base [fileNonceSize]byte, n uint64, last bool) []byte {
+	nonce := base
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], n)
+	for i := range ctr {
+		nonce[fileNonceSize-8+i] ^= ctr[i]
+	}
+	if last {
+		nonce[0] ^= 0x80
+	}
+	return nonce[:]
+}
@@ -0,0 +1,89 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// legacyFile was written by the first release, before files had a header:
+// the nonce "legacynonce!" and one GCM box under the key 00 01 ... 1f.
+const legacyFile = "6c65676163796e6f6e6365215024b509e4d7a775a538ac0d8718260c9abe78c4" +
+	"8a35eac361e2c83496d88420245f597a83d5da58854ef96c0a"
+
+func TestLegacyFile(t *testing.T) {
+	secret := make([]byte, 32)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	legacy, err := NewKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file names no key, so every key is tried
+	kr := testKeyring(t)
+	if err := kr.Add(legacy); err != nil {
+		t.Fatal(err)
+	}
+	file, err := hex.DecodeString(legacyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadHeader(bytes.NewReader(file)); err != ErrNotEncrypted {
+		t.Errorf("header of a legacy file: %v", err)
+	}
+	got, err := decrypt(kr, file, Binding{Path: "any"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "written by the first release\n" {
+		t.Errorf("decrypted %q", got)
+	}
+	if _, err := decrypt(testKeyring(t), file, Binding{}); err != ErrAuthFailed {
+		t.Errorf("legacy file without its key: %v", err)
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	kr := testKeyring(t)
+	file := encrypt(t, kr.Active(), []byte("content"), Binding{Path: "p"}, CodecNone)
+	h, err := ReadHeader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != FormatVersion || h.KeyID != kr.Active().ID || h.OriginalSize != 7 || h.PublicKey() {
+		t.Errorf("header = %+v", h)
+	}
+
+	// set returns file with the bytes at off replaced
+	set := func(off int, b ...byte) []byte {
+		f := bytes.Clone(file)
+		copy(f[off:], b)
+		return f
+	}
+	var version *UnsupportedVersionError
+	var suite *UnsupportedSuiteError
+	var codec *UnsupportedCodecError
+	var invalid *InvalidHeaderError
+	for name, tt := range map[string]struct {
+		file []byte
+		ok   func(error) bool
+	}{
+		"bad magic":        {set(0, 'X'), func(err error) bool { return err == ErrNotEncrypted }},
+		"short file":       {file[:10], func(err error) bool { return err == ErrNotEncrypted }},
+		"newer version":    {set(4, FormatVersion+1), func(err error) bool { return errors.As(err, &version) && version.Version == FormatVersion+1 }},
+		"version zero":     {set(4, 0), func(err error) bool { return errors.As(err, &version) }},
+		"unknown suite":    {set(5, 9), func(err error) bool { return errors.As(err, &suite) }},
+		"zero chunk size":  {set(6, 0, 0, 0, 0), func(err error) bool { return errors.As(err, &invalid) && invalid.Field == "chunk size" }},
+		"huge chunk size":  {set(6, 0xff), func(err error) bool { return errors.As(err, &invalid) && invalid.Field == "chunk size" }},
+		"unknown codec":    {set(fixedHeaderSize+8, 9), func(err error) bool { return errors.As(err, &codec) }},
+		"unknown wrap":     {set(fixedHeaderSize+8+1+fileNonceSize, 9), func(err error) bool { return errors.As(err, &invalid) && invalid.Field == "wrap type" }},
+		"truncated header": {file[:fixedHeaderSize+4], func(err error) bool { return err == ErrTruncated }},
+	} {
+		if _, err := ReadHeader(bytes.NewReader(tt.file)); !tt.ok(err) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
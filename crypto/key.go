@@ -1,21 +1,42 @@
 package crypto
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 )
 
+// Key is a 32-byte AES key together with the identifier recorded in file headers.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// NewKey wraps a raw 32-byte key, deriving its ID from the key material.
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes")
+	}
+	return &Key{ID: KeyFingerprint(secret), Secret: secret}, nil
+}
+
+// KeyFingerprint returns a short, non-secret identifier for a key.
+func KeyFingerprint(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("syncase key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
 // LoadKeyFromConfig decodes a base64-encoded key from the config.
-func LoadKeyFromConfig(b64 string) ([]byte, error) {
+func LoadKeyFromConfig(b64 string) (*Key, error) {
 	if b64 == "" {
 		return nil, errors.New("encryption key is empty in config")
 	}
-	key, err := base64.StdEncoding.DecodeString(b64)
+	secret, err := base64.StdEncoding.DecodeString(b64)
 	if err != nil {
 		return nil, err
 	}
-	if len(key) != 32 {
-		return nil, errors.New("encryption key must be 32 bytes")
-	}
-	return key, nil
+	return NewKey(secret)
 }
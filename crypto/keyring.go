@@ -0,0 +1,277 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"Syncase-silent-app-main/config"
+)
+
+// DefaultKeyringPath is where generated keys are kept.
+const DefaultKeyringPath = "storage/keys/keyring.json"
+
+// UnknownKeyError is returned when a file needs a key the keyring does not hold.
+type UnknownKeyError struct {
+	ID string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("key %s is not in the keyring", e.ID)
+}
+
+// Keyring holds every key that may have encrypted a file. New files are
+// always encrypted with the active key; the others are kept for decryption.
+type Keyring struct {
+	active string
+	keys   map[string]*Key
+	// names is the pinned name encryption key, see NameKey
+	names []byte
+	// identities decrypt files written in public-key mode
+	identities []*Identity
+}
+
+// NewKeyring builds a keyring from keys, with activeID used for encryption.
+func NewKeyring(keys []*Key, activeID string) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]*Key)}
+	for _, k := range keys {
+		if err := kr.Add(k); err != nil {
+			return nil, err
+		}
+	}
+	if err := kr.SetActive(activeID); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Add puts k into the keyring. Re-adding the same key is a no-op.
+func (kr *Keyring) Add(k *Key) error {
+	if k.ID == "" {
+		return errors.New("key id is empty")
+	}
+	if existing, ok := kr.keys[k.ID]; ok && string(existing.Secret) != string(k.Secret) {
+		return fmt.Errorf("duplicate key id %s", k.ID)
+	}
+	kr.keys[k.ID] = k
+	return nil
+}
+
+// SetActive selects the key used for encryption.
+func (kr *Keyring) SetActive(id string) error {
+	if _, ok := kr.keys[id]; !ok {
+		return &UnknownKeyError{ID: id}
+	}
+	if kr.active != "" && kr.active != id && kr.names == nil {
+		// Remote names must not change with the data key, so keep deriving
+		// them from the key that was active until now
+		kr.names = kr.NameKey()
+	}
+	kr.active = id
+	return nil
+}
+
+// NameKey returns the secret that file and directory names are encrypted
+// with. It follows the active key until the first rotation pins it.
+func (kr *Keyring) NameKey() []byte {
+	if kr.names != nil {
+		return kr.names
+	}
+	key, err := hkdf.Key(sha256.New, kr.Active().Secret, nil, "syncase name key", 32)
+	if err != nil {
+		panic(err) // only fails for oversized lengths
+	}
+	return key
+}
+
+// Merge adds every key and identity of other to kr and switches to other's
+// active key and name key, e.g. to bring in a key recovered from shares.
+func (kr *Keyring) Merge(other *Keyring) error {
+	for _, k := range other.Keys() {
+		if err := kr.Add(k); err != nil {
+			return err
+		}
+	}
+	for _, id := range other.identities {
+		kr.AddIdentity(id)
+	}
+	kr.active = other.active
+	kr.names = other.names
+	return nil
+}
+
+// AddIdentity puts id into the keyring so files encrypted to its recipient
+// can be decrypted. Re-adding the same identity is a no-op.
+func (kr *Keyring) AddIdentity(id *Identity) {
+	for _, existing := range kr.identities {
+		if existing.priv.Equal(id.priv) {
+			return
+		}
+	}
+	kr.identities = append(kr.identities, id)
+}
+
+// Identities returns the X25519 identities of the keyring.
+func (kr *Keyring) Identities() []*Identity {
+	return kr.identities
+}
+
+// Active returns the key new files are encrypted with.
+func (kr *Keyring) Active() *Key {
+	return kr.keys[kr.active]
+}
+
+// Lookup returns the key with the given id.
+func (kr *Keyring) Lookup(id string) (*Key, error) {
+	k, ok := kr.keys[id]
+	if !ok {
+		return nil, &UnknownKeyError{ID: id}
+	}
+	return k, nil
+}
+
+// Keys returns every key, the active one first, if there is one, and the
+// rest sorted by id.
+func (kr *Keyring) Keys() []*Key {
+	keys := make([]*Key, 0, len(kr.keys))
+	for id, k := range kr.keys {
+		if id != kr.active {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	if active := kr.Active(); active != nil {
+		keys = append([]*Key{active}, keys...)
+	}
+	return keys
+}
+
+// GenerateKey creates a random key with an ID derived from the current date.
+func GenerateKey() (*Key, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Key{
+		ID:     time.Now().Format("20060102") + "-" + KeyFingerprint(secret)[:8],
+		Secret: secret,
+	}, nil
+}
+
+type keyringFile struct {
+	Active     string           `json:"active"`
+	NamesKey   string           `json:"names_key,omitempty"`
+	Keys       []keyringFileKey `json:"keys"`
+	Identities []string         `json:"identities,omitempty"`
+}
+
+type keyringFileKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// LoadKeyring loads the keyring file at path and adds the legacy
+// encryption_key from the config, which stays active until the file names another.
+func LoadKeyring(cfg *config.Config, path string) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]*Key)}
+
+	if cfg.EncryptionKey != "" {
+		k, err := LoadKeyFromConfig(cfg.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		kr.Add(k)
+		kr.active = k.ID
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := kr.unmarshal(data); err != nil {
+			return nil, fmt.Errorf("failed to parse keyring %s: %w", path, err)
+		}
+	}
+
+	if kr.active == "" {
+		return nil, errors.New("no encryption key configured")
+	}
+	return kr, nil
+}
+
+// SaveKeyring writes every key of kr to path, readable by the owner only.
+func SaveKeyring(kr *Keyring, path string) error {
+	data, err := kr.marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (kr *Keyring) marshal() ([]byte, error) {
+	f := keyringFile{Active: kr.active}
+	if kr.names != nil {
+		f.NamesKey = base64.StdEncoding.EncodeToString(kr.names)
+	}
+	for _, k := range kr.Keys() {
+		f.Keys = append(f.Keys, keyringFileKey{ID: k.ID, Key: base64.StdEncoding.EncodeToString(k.Secret)})
+	}
+	for _, id := range kr.identities {
+		f.Identities = append(f.Identities, id.String())
+	}
+	return json.MarshalIndent(f, "", "  ")
+}
+
+// unmarshal adds the keys in data to kr and activates the one it names.
+func (kr *Keyring) unmarshal(data []byte) error {
+	var f keyringFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	for _, fk := range f.Keys {
+		secret, err := base64.StdEncoding.DecodeString(fk.Key)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", fk.ID, err)
+		}
+		if len(secret) != 32 {
+			return fmt.Errorf("key %s: encryption key must be 32 bytes", fk.ID)
+		}
+		if err := kr.Add(&Key{ID: fk.ID, Secret: secret}); err != nil {
+			return err
+		}
+	}
+	for _, s := range f.Identities {
+		id, err := ParseIdentity(s)
+		if err != nil {
+			return err
+		}
+		kr.AddIdentity(id)
+	}
+	if f.NamesKey != "" {
+		names, err := base64.StdEncoding.DecodeString(f.NamesKey)
+		if err != nil {
+			return fmt.Errorf("names key: %w", err)
+		}
+		kr.names = names
+	}
+	if f.Active != "" {
+		return kr.SetActive(f.Active)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestKeysWithoutActiveKey(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A keyring with an identity but no master key
+	kr := &Keyring{keys: make(map[string]*Key)}
+	kr.AddIdentity(id)
+	if keys := kr.Keys(); len(keys) != 0 {
+		t.Errorf("keys = %v", keys)
+	}
+
+	// Legacy files are tried with every key, of which there are none
+	legacy := bytes.Repeat([]byte{1}, 100)
+	if err := DecryptStream(kr, io.Discard, bytes.NewReader(legacy), Binding{}); err != ErrAuthFailed {
+		t.Errorf("decrypting a legacy file: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// nameEncoding is lower-case base32hex without padding, which is safe on
+// case-insensitive filesystems and in every remote's name rules.
+var nameEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// MaxEncryptedName is the longest encrypted name EncryptName returns, the
+// file name limit of most filesystems and remotes. The SIV tag and base32
+// make a name about 1.6 times its length plus 26 characters, so folder
+// names of more than 143 bytes cannot be encrypted. Object names carry the
+// ".enc" suffix as well, which the sync package counts against the same
+// limit, so file names are limited to 140 bytes.
+const MaxEncryptedName = 255
+
+// NameCipher encrypts path segments deterministically with AES-SIV, so the
+// same folder or file name always maps to the same remote name.
+type NameCipher struct {
+	siv *siv
+}
+
+// NewNameCipher returns the name cipher of kr.
+func NewNameCipher(kr *Keyring) (*NameCipher, error) {
+	key, err := hkdf.Key(sha256.New, kr.NameKey(), nil, "syncase names", 64)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSIV(key)
+	if err != nil {
+		return nil, err
+	}
+	return &NameCipher{siv: s}, nil
+}
+
+// EncryptName encrypts a single path segment. It fails for segments whose
+// encrypted name would be longer than MaxEncryptedName.
+func (c *NameCipher) EncryptName(name string) (string, error) {
+	if n := nameEncoding.EncodedLen(aes.BlockSize + len(name)); n > MaxEncryptedName {
+		return "", fmt.Errorf("name %q is too long to encrypt: %d bytes make a %d character name, the limit is %d", name, len(name), n, MaxEncryptedName)
+	}
+	return nameEncoding.EncodeToString(c.siv.seal([]byte(name))), nil
+}
+
+// DecryptName reverses EncryptName.
+func (c *NameCipher) DecryptName(encrypted string) (string, error) {
+	raw, err := nameEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("name %q is not encrypted: %w", encrypted, err)
+	}
+	plain, err := c.siv.open(raw)
+	if err != nil {
+		return "", fmt.Errorf("name %q failed authentication", encrypted)
+	}
+
+	name := string(plain)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("decrypted name %q is not a valid path segment", name)
+	}
+	return name, nil
+}
+
+// EncryptPath encrypts every segment of a slash-separated relative path.
+func (c *NameCipher) EncryptPath(rel string) (string, error) {
+	segments := strings.Split(rel, "/")
+	for i, s := range segments {
+		name, err := c.EncryptName(s)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = name
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// DecryptPath reverses EncryptPath.
+func (c *NameCipher) DecryptPath(rel string) (string, error) {
+	if rel == "" {
+		return "", errors.New("empty path")
+	}
+	segments := strings.Split(rel, "/")
+	for i, s := range segments {
+		name, err := c.DecryptName(s)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = name
+	}
+	return strings.Join(segments, "/"), nil
+}
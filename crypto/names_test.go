@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptNameLength(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKeyring([]*Key{key}, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewNameCipher(kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longest := strings.Repeat("n", 143)
+	enc, err := c.EncryptName(longest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) > MaxEncryptedName {
+		t.Errorf("encrypted name has %d characters", len(enc))
+	}
+	if name, err := c.DecryptName(enc); err != nil || name != longest {
+		t.Errorf("decrypted name = %q, %v", name, err)
+	}
+
+	if _, err := c.EncryptName(longest + "n"); err == nil {
+		t.Error("encrypted a name past the limit")
+	}
+	if _, err := c.EncryptPath("dir/" + longest + "n" + "/file"); err == nil {
+		t.Error("encrypted a path with a segment past the limit")
+	}
+}
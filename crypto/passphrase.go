@@ -0,0 +1,167 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// DefaultKeyMetadataPath holds the salt and KDF parameters of a passphrase key.
+	DefaultKeyMetadataPath = "storage/keys/passphrase.json"
+	// PassphraseEnv unlocks passphrase keys without a prompt, e.g. for the service.
+	PassphraseEnv = "SYNCASE_PASSPHRASE"
+
+	KDFArgon2id = "argon2id"
+	KDFScrypt   = "scrypt"
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// KDFParams records how a key is derived from a passphrase.
+type KDFParams struct {
+	Algorithm string `json:"kdf"`
+	Salt      []byte `json:"salt"`
+
+	// argon2id
+	Time      uint32 `json:"time,omitempty"`
+	MemoryKiB uint32 `json:"memory_kib,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+
+	// scrypt
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+}
+
+// NewKDFParams returns default parameters for algorithm with a fresh random salt.
+func NewKDFParams(algorithm string) (*KDFParams, error) {
+	p := &KDFParams{Algorithm: algorithm, Salt: make([]byte, 16)}
+	switch algorithm {
+	case KDFArgon2id:
+		p.Time, p.MemoryKiB, p.Threads = 3, 64*1024, 4
+	case KDFScrypt:
+		p.N, p.R, p.P = 1<<15, 8, 1
+	default:
+		return nil, fmt.Errorf("unknown kdf %q", algorithm)
+	}
+	if _, err := rand.Read(p.Salt); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DeriveKey stretches passphrase into a 32-byte key.
+func (p *KDFParams) DeriveKey(passphrase string) ([]byte, error) {
+	if len(p.Salt) < 16 {
+		return nil, errors.New("kdf salt is too short")
+	}
+	switch p.Algorithm {
+	case KDFArgon2id:
+		if p.Time == 0 || p.MemoryKiB == 0 || p.Threads == 0 {
+			return nil, errors.New("invalid argon2id parameters")
+		}
+		return argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.MemoryKiB, p.Threads, 32), nil
+	case KDFScrypt:
+		return scrypt.Key([]byte(passphrase), p.Salt, p.N, p.R, p.P, 32)
+	default:
+		return nil, fmt.Errorf("unknown kdf %q", p.Algorithm)
+	}
+}
+
+// KeyMetadata is the small file kept next to the data that lets the same
+// passphrase derive the same key again. KeyID detects a wrong passphrase.
+type KeyMetadata struct {
+	KDFParams
+	KeyID string `json:"key_id"`
+}
+
+// LoadKeyMetadata reads a key metadata file.
+func LoadKeyMetadata(path string) (*KeyMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta KeyMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse key metadata %s: %w", path, err)
+	}
+	return &meta, nil
+}
+
+// InitPassphraseKey derives a new key from passphrase and writes its metadata to path.
+func InitPassphraseKey(path, passphrase, algorithm string) (*Key, error) {
+	params, err := NewKDFParams(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := params.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(KeyMetadata{KDFParams: *params, KeyID: key.ID}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	return key, err
+}
+
+// UnlockPassphraseKey derives the key described by meta from passphrase.
+func UnlockPassphraseKey(meta *KeyMetadata, passphrase string) (*Key, error) {
+	secret, err := meta.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	if key.ID != meta.KeyID {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// ReadPassphrase returns the passphrase from PassphraseEnv, or prompts for it
+// when running in a terminal.
+func ReadPassphrase(prompt string) (string, error) {
+	if p, ok := os.LookupEnv(PassphraseEnv); ok {
+		return p, nil
+	}
+	return PromptPassphrase(prompt)
+}
+
+// PromptPassphrase reads a passphrase from the terminal without echoing it.
+func PromptPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no terminal to prompt for the passphrase, set %s", PassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
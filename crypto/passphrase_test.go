@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPassphraseKey(t *testing.T) {
+	for _, algorithm := range []string{KDFArgon2id, KDFScrypt} {
+		path := filepath.Join(t.TempDir(), "passphrase.json")
+		key, err := InitPassphraseKey(path, "correct horse", algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The metadata file holds everything needed to derive the key again
+		meta, err := LoadKeyMetadata(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := NewKDFParams(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.Salt = meta.Salt
+		if meta.KDFParams.Algorithm != algorithm || len(meta.Salt) != 16 || !reflect.DeepEqual(meta.KDFParams, *want) {
+			t.Errorf("%s: stored parameters %+v, want %+v", algorithm, meta.KDFParams, *want)
+		}
+		unlocked, err := UnlockPassphraseKey(meta, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unlocked.ID != key.ID || !bytes.Equal(unlocked.Secret, key.Secret) {
+			t.Errorf("%s: unlocked another key", algorithm)
+		}
+		if _, err := UnlockPassphraseKey(meta, "correct horse "); err != ErrWrongPassphrase {
+			t.Errorf("%s: unlock with a wrong passphrase: %v", algorithm, err)
+		}
+	}
+}
+
+func TestDeriveKeyParams(t *testing.T) {
+	salt := make([]byte, 16)
+	for name, p := range map[string]*KDFParams{
+		"short salt":     {Algorithm: KDFScrypt, Salt: salt[:8], N: 1 << 10, R: 8, P: 1},
+		"unknown kdf":    {Algorithm: "pbkdf2", Salt: salt},
+		"argon2id zeros": {Algorithm: KDFArgon2id, Salt: salt},
+		"scrypt zeros":   {Algorithm: KDFScrypt, Salt: salt},
+	} {
+		if _, err := p.DeriveKey("passphrase"); err == nil {
+			t.Errorf("%s: derived a key", name)
+		}
+	}
+	if _, err := NewKDFParams("pbkdf2"); err == nil {
+		t.Error("parameters for an unknown kdf")
+	}
+}
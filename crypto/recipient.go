@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Public-key mode lets write-only devices encrypt files they cannot read
+// back. The data key of every file is wrapped once per X25519 recipient:
+//
+//	recipient id (8) | ephemeral public key (32) | wrapped data key (60)
+//
+// The wrapping key is derived with HKDF-SHA256 from the shared secret of an
+// ephemeral key and the recipient, salted with both public keys. Only
+// machines holding a recipient's identity (private key) can unwrap it.
+
+const (
+	recipientPrefix = "x25519:"
+	identityPrefix  = "x25519-secret:"
+	recipientIDSize = 8
+	stanzaSize      = recipientIDSize + 32 + wrappedKeySize
+	// maxRecipients keeps every header within MaxHeaderSize
+	maxRecipients = 16
+)
+
+var ErrNoIdentity = errors.New("encrypted file is for recipients whose identities are not in the keyring")
+
+// KeyWrapper seals the data key of a new file into its header: either a
+// master key or a list of recipients.
+type KeyWrapper interface {
+	wrapKey(h *Header, dataKey []byte) error
+}
+
+// Recipient is an X25519 public key files can be encrypted to.
+type Recipient struct {
+	pub *ecdh.PublicKey
+}
+
+// ParseRecipient decodes a recipient printed by Recipient.String.
+func ParseRecipient(s string) (*Recipient, error) {
+	b64, ok := strings.CutPrefix(strings.TrimSpace(s), recipientPrefix)
+	if !ok {
+		return nil, fmt.Errorf("recipient %q does not start with %s", s, recipientPrefix)
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("recipient %q: %w", s, err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("recipient %q: %w", s, err)
+	}
+	return &Recipient{pub: pub}, nil
+}
+
+func (r *Recipient) String() string {
+	return recipientPrefix + base64.StdEncoding.EncodeToString(r.pub.Bytes())
+}
+
+// ID returns the short identifier stored in headers to find the right identity.
+func (r *Recipient) ID() string {
+	return hex.EncodeToString(recipientID(r.pub))
+}
+
+func recipientID(pub *ecdh.PublicKey) []byte {
+	sum := sha256.Sum256(append([]byte("syncase recipient"), pub.Bytes()...))
+	return sum[:recipientIDSize]
+}
+
+// Recipients encrypts files so that any one of them can decrypt.
+type Recipients []*Recipient
+
+// ParseRecipients decodes every entry of config.json's recipients.
+func ParseRecipients(list []string) (Recipients, error) {
+	rs := make(Recipients, 0, len(list))
+	for _, s := range list {
+		r, err := ParseRecipient(s)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func (rs Recipients) wrapKey(h *Header, dataKey []byte) error {
+	if len(rs) == 0 || len(rs) > maxRecipients {
+		return fmt.Errorf("need 1 to %d recipients, got %d", maxRecipients, len(rs))
+	}
+	h.KeyID = ""
+	h.wrapped = nil
+	h.stanzas = h.stanzas[:0]
+	for _, r := range rs {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		shared, err := eph.ECDH(r.pub)
+		if err != nil {
+			return err
+		}
+		gcm, err := stanzaGCM(shared, eph.PublicKey(), r.pub)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		s := append(recipientID(r.pub), eph.PublicKey().Bytes()...)
+		s = append(s, gcm.Seal(nonce, nonce, dataKey, h.fixed())...)
+		h.stanzas = append(h.stanzas, s)
+	}
+	return nil
+}
+
+// stanzaGCM derives the cipher wrapping the data key for one recipient from
+// the X25519 shared secret and both public keys.
+func stanzaGCM(shared []byte, eph, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(eph.Bytes(), recipient.Bytes()...)
+	key, err := hkdf.Key(sha256.New, shared, salt, "syncase x25519 wrap", 32)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+// Identity is the X25519 private key of a recipient, held by admin machines.
+type Identity struct {
+	priv *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{priv: priv}, nil
+}
+
+// ParseIdentity decodes an identity printed by Identity.String.
+func ParseIdentity(s string) (*Identity, error) {
+	b64, ok := strings.CutPrefix(strings.TrimSpace(s), identityPrefix)
+	if !ok {
+		return nil, fmt.Errorf("identity does not start with %s", identityPrefix)
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("identity: %w", err)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("identity: %w", err)
+	}
+	return &Identity{priv: priv}, nil
+}
+
+func (id *Identity) String() string {
+	return identityPrefix + base64.StdEncoding.EncodeToString(id.priv.Bytes())
+}
+
+// Recipient returns the public key files are encrypted to for id.
+func (id *Identity) Recipient() *Recipient {
+	return &Recipient{pub: id.priv.PublicKey()}
+}
+
+// unwrap opens the stanza of id in h, if there is one.
+func (id *Identity) unwrap(h *Header) ([]byte, bool) {
+	rid := recipientID(id.priv.PublicKey())
+	for _, s := range h.stanzas {
+		if string(s[:recipientIDSize]) != string(rid) {
+			continue
+		}
+		eph, err := ecdh.X25519().NewPublicKey(s[recipientIDSize : recipientIDSize+32])
+		if err != nil {
+			return nil, false
+		}
+		shared, err := id.priv.ECDH(eph)
+		if err != nil {
+			return nil, false
+		}
+		gcm, err := stanzaGCM(shared, eph, id.priv.PublicKey())
+		if err != nil {
+			return nil, false
+		}
+		wrapped := s[recipientIDSize+32:]
+		n := gcm.NonceSize()
+		if key, err := gcm.Open(nil, wrapped[:n], wrapped[n:], h.fixed()); err == nil {
+			return key, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,343 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Shamir secret sharing over GF(2^8) lets a keyring be split into n shares
+// of which any m rebuild it, while fewer reveal nothing about it.
+//
+// A share is printed as base32 in groups of five characters and holds:
+//
+//	version (1) | threshold (1) | index (1) | flags (1) | key fingerprint (4) |
+//	key id length (1) | key id | share of the keyring | checksum (4)
+//
+// where the shared keyring is:
+//
+//	active key (32) | pinned name key (32, optional) | older key count (1) |
+//	per older key: key id length (1) | key id | key (32) |
+//	identity count (1) | one X25519 private key (32) per identity
+//
+// The key id and fingerprint are those of the active key. The fingerprint
+// stops shares of different keyrings being mixed and confirms the rebuilt
+// key, and the checksum catches typos when a share is typed back in.
+
+const (
+	shareVersion   = 1
+	shareHasNames  = 1 << 0
+	shareGroupSize = 5
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var (
+	ErrShareChecksum = errors.New("share checksum does not match, check for typos")
+	ErrShareMismatch = errors.New("shares belong to different keys or splits")
+)
+
+// gfExp and gfLog are exponent and logarithm tables of GF(2^8) with the AES
+// polynomial and generator 3.
+var gfExp, gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		// multiply by 3: x*2 ^ x
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+255-int(gfLog[b]))%255]
+}
+
+// splitSecret returns n shares of secret, any m of which rebuild it. Share
+// i is evaluated at x = i+1.
+func splitSecret(secret []byte, n, m int) ([][]byte, error) {
+	if m < 2 || m > n || n > 255 {
+		return nil, fmt.Errorf("invalid split: need 2 <= threshold (%d) <= shares (%d) <= 255", m, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coeffs := make([]byte, m)
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			// Horner's rule
+			x := byte(i + 1)
+			var y byte
+			for j := m - 1; j >= 0; j-- {
+				y = gfMul(y, x) ^ coeffs[j]
+			}
+			shares[i][b] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineSecret interpolates the secret from shares ys taken at points xs.
+func combineSecret(xs []byte, ys [][]byte) []byte {
+	secret := make([]byte, len(ys[0]))
+	for i, xi := range xs {
+		// Lagrange basis polynomial of xi at 0
+		l := byte(1)
+		for j, xj := range xs {
+			if i != j {
+				l = gfMul(l, gfDiv(xj, xj^xi))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(ys[i][b], l)
+		}
+	}
+	return secret
+}
+
+// Share is one decoded recovery share.
+type Share struct {
+	Threshold   int
+	Index       int
+	KeyID       string
+	fingerprint string
+	names       bool
+	value       []byte
+}
+
+// SplitKeyring splits kr into n printable shares of which any m recover
+// it: the active key, the pinned name key if any, the older keys files may
+// still be encrypted with and the identities.
+func SplitKeyring(kr *Keyring, n, m int) ([]string, error) {
+	if kr.Active() == nil {
+		return nil, errors.New("keyring has no active key")
+	}
+	secret, flags, err := kr.shareSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := splitSecret(secret, n, m)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := hex.DecodeString(KeyFingerprint(kr.Active().Secret)[:8])
+	if err != nil {
+		return nil, err
+	}
+	id := kr.Active().ID
+	if len(id) > maxKeyIDLen {
+		return nil, fmt.Errorf("key id %q is too long", id)
+	}
+	out := make([]string, n)
+	for i, v := range values {
+		raw := []byte{shareVersion, byte(m), byte(i + 1), flags}
+		raw = append(raw, fp...)
+		raw = append(raw, byte(len(id)))
+		raw = append(raw, id...)
+		raw = append(raw, v...)
+		sum := sha256.Sum256(raw)
+		raw = append(raw, sum[:4]...)
+		out[i] = groupShare(shareEncoding.EncodeToString(raw))
+	}
+	return out, nil
+}
+
+// shareSecret encodes the keys of kr as they are shared.
+func (kr *Keyring) shareSecret() ([]byte, byte, error) {
+	secret := append([]byte(nil), kr.Active().Secret...)
+	var flags byte
+	if kr.names != nil {
+		secret = append(secret, kr.names...)
+		flags |= shareHasNames
+	}
+
+	older := kr.Keys()[1:]
+	if len(older) > 255 || len(kr.identities) > 255 {
+		return nil, 0, errors.New("keyring has too many keys to split")
+	}
+	secret = append(secret, byte(len(older)))
+	for _, k := range older {
+		if len(k.ID) > maxKeyIDLen {
+			return nil, 0, fmt.Errorf("key id %q is too long", k.ID)
+		}
+		secret = append(secret, byte(len(k.ID)))
+		secret = append(secret, k.ID...)
+		secret = append(secret, k.Secret...)
+	}
+	secret = append(secret, byte(len(kr.identities)))
+	for _, id := range kr.identities {
+		secret = append(secret, id.priv.Bytes()...)
+	}
+	return secret, flags, nil
+}
+
+// addShared adds the older keys and identities of a rebuilt share secret,
+// which follow the active and name keys, to kr.
+func (kr *Keyring) addShared(rest []byte) error {
+	malformed := errors.New("recovered keyring is malformed")
+	if len(rest) < 1 {
+		return malformed
+	}
+	count := int(rest[0])
+	rest = rest[1:]
+	for i := 0; i < count; i++ {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0])+32 {
+			return malformed
+		}
+		idLen := int(rest[0])
+		k := &Key{ID: string(rest[1 : 1+idLen]), Secret: rest[1+idLen : 1+idLen+32]}
+		if err := kr.Add(k); err != nil {
+			return err
+		}
+		rest = rest[1+idLen+32:]
+	}
+
+	if len(rest) < 1 || len(rest) != 1+32*int(rest[0]) {
+		return malformed
+	}
+	for rest = rest[1:]; len(rest) > 0; rest = rest[32:] {
+		priv, err := ecdh.X25519().NewPrivateKey(rest[:32])
+		if err != nil {
+			return malformed
+		}
+		kr.AddIdentity(&Identity{priv: priv})
+	}
+	return nil
+}
+
+func groupShare(s string) string {
+	var groups []string
+	for len(s) > shareGroupSize {
+		groups = append(groups, s[:shareGroupSize])
+		s = s[shareGroupSize:]
+	}
+	return strings.Join(append(groups, s), " ")
+}
+
+// ParseShare decodes a share printed by SplitKeyring. Whitespace, dashes and
+// case are ignored.
+func ParseShare(text string) (*Share, error) {
+	clean := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(text))
+
+	raw, err := shareEncoding.DecodeString(clean)
+	if err != nil {
+		return nil, fmt.Errorf("share is not valid base32: %w", err)
+	}
+	if len(raw) < 9+4 {
+		return nil, errors.New("share is too short")
+	}
+	body, sum := raw[:len(raw)-4], raw[len(raw)-4:]
+	want := sha256.Sum256(body)
+	if !bytes.Equal(sum, want[:4]) {
+		return nil, ErrShareChecksum
+	}
+	if body[0] != shareVersion {
+		return nil, fmt.Errorf("unsupported share version %d", body[0])
+	}
+
+	idLen := int(body[8])
+	if len(body) < 9+idLen {
+		return nil, errors.New("share is malformed")
+	}
+	s := &Share{
+		Threshold:   int(body[1]),
+		Index:       int(body[2]),
+		KeyID:       string(body[9 : 9+idLen]),
+		fingerprint: hex.EncodeToString(body[4:8]),
+		names:       body[3]&shareHasNames != 0,
+		value:       body[9+idLen:],
+	}
+	// The active key, the name key and both counts
+	size := 32 + 2
+	if s.names {
+		size += 32
+	}
+	if len(s.value) < size || s.Index == 0 {
+		return nil, errors.New("share is malformed")
+	}
+	return s, nil
+}
+
+// CombineShares rebuilds the keyring split by SplitKeyring from at least
+// threshold shares.
+func CombineShares(shares []*Share) (*Keyring, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+	first := shares[0]
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("need %d shares, got %d", first.Threshold, len(shares))
+	}
+
+	xs := make([]byte, 0, len(shares))
+	ys := make([][]byte, 0, len(shares))
+	seen := make(map[int]bool)
+	for _, s := range shares {
+		if s.Threshold != first.Threshold || s.KeyID != first.KeyID || s.fingerprint != first.fingerprint || s.names != first.names || len(s.value) != len(first.value) {
+			return nil, ErrShareMismatch
+		}
+		if seen[s.Index] {
+			return nil, fmt.Errorf("share %d given twice", s.Index)
+		}
+		seen[s.Index] = true
+		xs = append(xs, byte(s.Index))
+		ys = append(ys, s.value)
+	}
+
+	secret := combineSecret(xs, ys)
+	if KeyFingerprint(secret[:32])[:8] != first.fingerprint {
+		// Every share was well formed, so they must come from different splits
+		return nil, ErrShareMismatch
+	}
+	key := &Key{ID: first.KeyID, Secret: secret[:32]}
+	rest := secret[32:]
+
+	kr, err := NewKeyring([]*Key{key}, key.ID)
+	if err != nil {
+		return nil, err
+	}
+	if first.names {
+		kr.names, rest = rest[:32], rest[32:]
+	}
+	if err := kr.addShared(rest); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
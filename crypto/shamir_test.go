@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitKeyringKeepsOlderKeys(t *testing.T) {
+	old, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKeyring([]*Key{old}, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr.AddIdentity(id)
+
+	// Files written before a rotation still need the old key
+	var oldFile, sealedFile bytes.Buffer
+	plain := []byte("written before the rotation")
+	if err := EncryptStream(old, &oldFile, bytes.NewReader(plain), int64(len(plain)), Binding{Path: "a"}, CodecNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptStream(Recipients{id.Recipient()}, &sealedFile, bytes.NewReader(plain), int64(len(plain)), Binding{Path: "b"}, CodecNone); err != nil {
+		t.Fatal(err)
+	}
+	active := &Key{ID: old.ID + "-new", Secret: bytes.Repeat([]byte{7}, 32)}
+	if err := kr.Add(active); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.SetActive(active.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	printed, err := SplitKeyring(kr, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shares []*Share
+	for _, i := range []int{4, 0, 2} {
+		s, err := ParseShare(printed[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, s)
+	}
+	recovered, err := CombineShares(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered.Active().ID != active.ID || !bytes.Equal(recovered.NameKey(), kr.NameKey()) {
+		t.Errorf("recovered active key %s with another name key", recovered.Active().ID)
+	}
+	if len(recovered.Keys()) != 2 || len(recovered.Identities()) != 1 {
+		t.Errorf("recovered %d keys and %d identities, want 2 and 1", len(recovered.Keys()), len(recovered.Identities()))
+	}
+	for p, file := range map[string]*bytes.Buffer{"a": &oldFile, "b": &sealedFile} {
+		var out bytes.Buffer
+		if err := DecryptStream(recovered, &out, bytes.NewReader(file.Bytes()), Binding{Path: p}); err != nil || !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("file %s with the recovered keyring: %v", p, err)
+		}
+	}
+
+	if _, err := CombineShares(shares[:2]); err == nil {
+		t.Error("combined fewer shares than the threshold")
+	}
+}
@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// AES-SIV (RFC 5297): deterministic authenticated encryption, used for
+// names where the same input must always map to the same output.
+
+var errSIVOpen = errors.New("siv: message authentication failed")
+
+type siv struct {
+	mac cipher.Block
+	ctr cipher.Block
+}
+
+// newSIV takes a double-length key: the first half for S2V, the second for CTR.
+func newSIV(key []byte) (*siv, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("siv: key must be 32, 48 or 64 bytes")
+	}
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &siv{mac: mac, ctr: ctr}, nil
+}
+
+// seal returns V || C.
+func (s *siv) seal(plaintext []byte, ad ...[]byte) []byte {
+	v := s.s2v(plaintext, ad)
+	out := make([]byte, aes.BlockSize+len(plaintext))
+	copy(out, v[:])
+	s.xorCTR(out[aes.BlockSize:], plaintext, v)
+	return out
+}
+
+func (s *siv) open(ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errSIVOpen
+	}
+	var v [aes.BlockSize]byte
+	copy(v[:], ciphertext)
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	s.xorCTR(plaintext, ciphertext[aes.BlockSize:], v)
+
+	want := s.s2v(plaintext, ad)
+	if subtle.ConstantTimeCompare(want[:], v[:]) != 1 {
+		return nil, errSIVOpen
+	}
+	return plaintext, nil
+}
+
+func (s *siv) xorCTR(dst, src []byte, v [aes.BlockSize]byte) {
+	// Clear the top bit of the last two 32-bit words so implementations
+	// can use 64-bit counter arithmetic
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(s.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+func (s *siv) s2v(plaintext []byte, ad [][]byte) [aes.BlockSize]byte {
+	var zero [aes.BlockSize]byte
+	d := cmac(s.mac, zero[:])
+	for _, a := range ad {
+		d = dbl(d)
+		xorBlock(&d, cmac(s.mac, a))
+	}
+
+	if len(plaintext) >= aes.BlockSize {
+		t := append([]byte(nil), plaintext...)
+		tail := t[len(t)-aes.BlockSize:]
+		for i := range tail {
+			tail[i] ^= d[i]
+		}
+		return cmac(s.mac, t)
+	}
+
+	d = dbl(d)
+	var padded [aes.BlockSize]byte
+	copy(padded[:], plaintext)
+	padded[len(plaintext)] = 0x80
+	xorBlock(&d, padded)
+	return cmac(s.mac, d[:])
+}
+
+// cmac computes AES-CMAC (RFC 4493).
+func cmac(b cipher.Block, msg []byte) [aes.BlockSize]byte {
+	var l [aes.BlockSize]byte
+	b.Encrypt(l[:], l[:])
+	k1 := dbl(l)
+	k2 := dbl(k1)
+
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(msg)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+
+	var last [aes.BlockSize]byte
+	copy(last[:], msg[(n-1)*aes.BlockSize:])
+	if complete {
+		xorBlock(&last, k1)
+	} else {
+		last[len(msg)-(n-1)*aes.BlockSize] = 0x80
+		xorBlock(&last, k2)
+	}
+
+	var x [aes.BlockSize]byte
+	for i := 0; i < n-1; i++ {
+		var block [aes.BlockSize]byte
+		copy(block[:], msg[i*aes.BlockSize:])
+		xorBlock(&x, block)
+		b.Encrypt(x[:], x[:])
+	}
+	xorBlock(&x, last)
+	b.Encrypt(x[:], x[:])
+	return x
+}
+
+// dbl multiplies by x in GF(2^128).
+func dbl(in [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	carry := in[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = in[i]<<1 | in[i+1]>>7
+	}
+	out[aes.BlockSize-1] = in[aes.BlockSize-1] << 1
+	out[aes.BlockSize-1] ^= 0x87 * carry
+	return out
+}
+
+func xorBlock(dst *[aes.BlockSize]byte, src [aes.BlockSize]byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,110 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+
+	"Syncase-silent-app-main/config"
+)
+
+// Key source names accepted in config.json's key_source.
+const (
+	SourceConfig     = "config"
+	SourcePassphrase = "passphrase"
+	SourceVault      = "vault"
+	// SourceNone holds no keys at all: the device only encrypts to its
+	// recipients and can never read the remote back
+	SourceNone = "none"
+)
+
+// KeySource supplies the keyring used to encrypt and decrypt files.
+type KeySource interface {
+	Keyring() (*Keyring, error)
+}
+
+// KeyStore is a KeySource that can also persist new keys, e.g. during rotation.
+type KeyStore interface {
+	KeySource
+	SaveKeyring(kr *Keyring) error
+}
+
+// ConfigSource reads the base64 encryption_key from the config plus any keys
+// added to the keyring file by rotation.
+type ConfigSource struct {
+	Config      *config.Config
+	KeyringPath string
+}
+
+func (s *ConfigSource) Keyring() (*Keyring, error) {
+	return LoadKeyring(s.Config, s.KeyringPath)
+}
+
+func (s *ConfigSource) SaveKeyring(kr *Keyring) error {
+	return SaveKeyring(kr, s.KeyringPath)
+}
+
+// PassphraseSource derives a single key from a passphrase using the KDF
+// parameters in its metadata file.
+type PassphraseSource struct {
+	MetadataPath string
+	// Passphrase supplies the passphrase; ReadPassphrase is used when nil
+	Passphrase func() (string, error)
+}
+
+func (s *PassphraseSource) Keyring() (*Keyring, error) {
+	meta, err := LoadKeyMetadata(s.MetadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("passphrase key is not initialised: %w", err)
+	}
+
+	read := s.Passphrase
+	if read == nil {
+		read = func() (string, error) { return ReadPassphrase("Passphrase: ") }
+	}
+	passphrase, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := UnlockPassphraseKey(meta, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring([]*Key{key}, key.ID)
+}
+
+// OpenKeySource returns the key source selected by the config.
+func OpenKeySource(cfg *config.Config) (KeySource, error) {
+	switch cfg.KeySource {
+	case "", SourceConfig:
+		path := DefaultKeyringPath
+		if cfg.KeyringPath != "" {
+			// A sync pair with a key of its own
+			path = cfg.KeyringPath
+		}
+		return &ConfigSource{Config: cfg, KeyringPath: path}, nil
+	case SourcePassphrase:
+		return &PassphraseSource{MetadataPath: DefaultKeyMetadataPath}, nil
+	case SourceVault:
+		return &VaultSource{Path: DefaultVaultPath}, nil
+	case SourceNone:
+		return nil, errors.New("key_source \"none\" holds no keys, this device can only encrypt to its recipients")
+	default:
+		return nil, fmt.Errorf("unknown key_source %q", cfg.KeySource)
+	}
+}
+
+// WriteOnly reports whether cfg describes a write-only device, one that
+// encrypts to its recipients and holds no key to decrypt with.
+func WriteOnly(cfg *config.Config) bool {
+	return cfg.KeySource == SourceNone
+}
+
+// LoadKeys opens the configured key source and unlocks its keyring.
+func LoadKeys(cfg *config.Config) (*Keyring, error) {
+	src, err := OpenKeySource(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return src.Keyring()
+}
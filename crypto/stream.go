@@ -0,0 +1,277 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const legacyChunkSize = 1024 * 1024
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptStream reads size bytes of plaintext from src and writes the
+// encrypted file format to dst, bound to b and compressed with codec. The
+// data key is wrapped by key, a master key or a list of recipients. It
+// fails if src does not hold exactly size bytes.
+func EncryptStream(key KeyWrapper, dst io.Writer, src io.Reader, size int64, b Binding, codec Codec) error {
+	h := &Header{
+		Version:      FormatVersion,
+		Suite:        SuiteAES256GCM,
+		ChunkSize:    DefaultChunkSize,
+		OriginalSize: uint64(size),
+		FileVersion:  b.Version,
+		Codec:        codec,
+	}
+	if _, err := rand.Read(h.nonce[:]); err != nil {
+		return err
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	if err := key.wrapKey(h, dataKey); err != nil {
+		return err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(h.marshal()); err != nil {
+		return err
+	}
+	ad := h.chunkAD(h.fixed(), b)
+
+	if codec == CodecNone {
+		return sealChunks(gcm, h, ad, dst, src, size)
+	}
+
+	// The compressed size is not known up front, so compress checks the
+	// source size instead
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(compress(codec, pw, src, size))
+	}()
+	return sealChunks(gcm, h, ad, dst, pr, -1)
+}
+
+// sealChunks encrypts src into chunks of h.ChunkSize. Unless size is
+// negative, it fails if src does not hold exactly size bytes.
+func sealChunks(gcm cipher.AEAD, h *Header, ad []byte, dst io.Writer, src io.Reader, size int64) error {
+	in := bufio.NewReaderSize(src, int(h.ChunkSize))
+	buf := make([]byte, h.ChunkSize)
+	sealed := make([]byte, 0, int(h.ChunkSize)+gcm.Overhead())
+	var total int64
+
+	for n := uint64(0); ; n++ {
+		read, err := io.ReadFull(in, buf)
+		last := false
+		switch err {
+		case nil:
+			// Full chunk: it is the last one only if nothing follows
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		default:
+			return err
+		}
+
+		total += int64(read)
+		if last && size >= 0 && total != size {
+			return fmt.Errorf("source changed while encrypting: expected %d bytes, read %d", size, total)
+		}
+
+		sealed = gcm.Seal(sealed[:0], chunkNonce(h.nonce, n, last), buf[:read], ad)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// DecryptStream reads the encrypted file format from src and writes plaintext
+// to dst, using the key or identity of kr named in the header. Files that bind their path
+// must have been encrypted for b, see Binding. Only one chunk is held in
+// memory at a time.
+func DecryptStream(kr *Keyring, dst io.Writer, src io.Reader, b Binding) error {
+	in := bufio.NewReaderSize(src, DefaultChunkSize+64)
+	if magic, err := in.Peek(len(fileMagic)); err == nil && !bytes.Equal(magic, fileMagic) {
+		return decryptLegacy(kr, dst, in)
+	}
+
+	h, ad, err := readHeader(in)
+	if err != nil {
+		return err
+	}
+	ad = h.chunkAD(ad, b)
+	if b.Version != 0 && h.FileVersion != b.Version {
+		return &BindingError{
+			Path:   normalisePath(b.Path),
+			Reason: fmt.Sprintf("it has version %d, expected %d", h.FileVersion, b.Version),
+		}
+	}
+	dataKey, err := h.openDataKey(kr)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	if h.Codec == CodecNone {
+		total, err := openChunks(gcm, h, ad, b, dst, in)
+		if err == nil && total != h.OriginalSize {
+			return ErrSizeMismatch
+		}
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := decompress(h.Codec, dst, pr, int64(h.OriginalSize))
+		if err == nil {
+			// Let the last chunk finish writing
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	_, err = openChunks(gcm, h, ad, b, pw, in)
+	pw.CloseWithError(err)
+	if derr := <-done; err == nil {
+		err = derr
+	}
+	return err
+}
+
+// openChunks authenticates and decrypts every chunk of in, writing the
+// chunk plaintext to dst. It returns the number of bytes written.
+func openChunks(gcm cipher.AEAD, h *Header, ad []byte, b Binding, dst io.Writer, in *bufio.Reader) (uint64, error) {
+	sealedSize := int(h.ChunkSize) + gcm.Overhead()
+	if in.Size() < sealedSize {
+		in = bufio.NewReaderSize(in, sealedSize)
+	}
+	buf := make([]byte, sealedSize)
+	var total uint64
+
+	for n := uint64(0); ; n++ {
+		read, err := io.ReadFull(in, buf)
+		last := false
+		switch err {
+		case nil:
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return total, err
+			}
+		case io.ErrUnexpectedEOF:
+			last = true
+		case io.EOF:
+			// The final chunk is always written, even when empty
+			return total, ErrTruncated
+		default:
+			return total, err
+		}
+		if read < gcm.Overhead() {
+			return total, ErrTruncated
+		}
+
+		plain, err := gcm.Open(buf[:0], chunkNonce(h.nonce, n, last), buf[:read], ad)
+		if err != nil {
+			if n == 0 {
+				// The data key unwrapped, so the path is the likely culprit
+				return total, &BindingError{Path: normalisePath(b.Path), Reason: "it was moved, substituted or corrupted"}
+			}
+			return total, ErrAuthFailed
+		}
+		total += uint64(len(plain))
+		if _, err := dst.Write(plain); err != nil {
+			return total, err
+		}
+		if last {
+			return total, nil
+		}
+	}
+}
+
+// decryptLegacy reads the pre-header format: a nonce followed by GCM boxes
+// of up to 1MB plaintext each, all sealed with that same nonce. The file
+// names no key, so every key of kr is tried on the first box.
+func decryptLegacy(kr *Keyring, dst io.Writer, in *bufio.Reader) error {
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(in, nonce); err != nil {
+		return errors.New("ciphertext too short")
+	}
+
+	var gcm cipher.AEAD
+	buf := make([]byte, legacyChunkSize+16)
+	for {
+		read, err := io.ReadFull(in, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		var plain []byte
+		if gcm == nil {
+			if gcm, plain = openLegacyFirst(kr, nonce, buf[:read]); gcm == nil {
+				return ErrAuthFailed
+			}
+		} else if plain, err = gcm.Open(buf[:0], nonce, buf[:read], nil); err != nil {
+			return ErrAuthFailed
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if read < len(buf) {
+			return nil
+		}
+	}
+}
+
+func openLegacyFirst(kr *Keyring, nonce, box []byte) (cipher.AEAD, []byte) {
+	for _, k := range kr.Keys() {
+		gcm, err := newGCM(k.Secret)
+		if err != nil {
+			continue
+		}
+		if plain, err := gcm.Open(nil, nonce, box, nil); err == nil {
+			return gcm, plain
+		}
+	}
+	return nil, nil
+}
+
+// legacyPlainSize computes the plaintext size of a legacy file from its
+// ciphertext size.
+func legacyPlainSize(size int64) int64 {
+	body := size - 12
+	if body <= 0 {
+		return 0
+	}
+	boxes := (body + legacyChunkSize + 16 - 1) / (legacyChunkSize + 16)
+	return body - 16*boxes
+}
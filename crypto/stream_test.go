@@ -0,0 +1,121 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKeyring([]*Key{key}, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func randomPlaintext(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func encrypt(t *testing.T, key KeyWrapper, plain []byte, b Binding, codec Codec) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := EncryptStream(key, &out, bytes.NewReader(plain), int64(len(plain)), b, codec); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decrypt(kr *Keyring, file []byte, b Binding) ([]byte, error) {
+	var out bytes.Buffer
+	err := DecryptStream(kr, &out, bytes.NewReader(file), b)
+	return out.Bytes(), err
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	kr := testKeyring(t)
+	b := Binding{Path: "dir/file.txt"}
+	for _, size := range []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, DefaultChunkSize + 1, 2*DefaultChunkSize + DefaultChunkSize/2} {
+		plain := randomPlaintext(t, size)
+		file := encrypt(t, kr.Active(), plain, b, CodecNone)
+		got, err := decrypt(kr, file, b)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted %d bytes that differ", size, len(got))
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	kr := testKeyring(t)
+	b := Binding{Path: "file"}
+	plain := randomPlaintext(t, 3*DefaultChunkSize)
+	file := encrypt(t, kr.Active(), plain, b, CodecNone)
+
+	// Three full chunks, the last one full too
+	sealed := DefaultChunkSize + 16
+	header := len(file) - 3*sealed
+	chunk := func(n int) []byte { return file[header+n*sealed : header+(n+1)*sealed] }
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for name, tampered := range map[string][]byte{
+		"last chunk dropped":   file[:header+2*sealed],
+		"two chunks dropped":   file[:header+sealed],
+		"chunks reordered":     join(file[:header], chunk(1), chunk(0), chunk(2)),
+		"chunk repeated":       join(file[:header], chunk(0), chunk(0), chunk(1), chunk(2)),
+		"trailing data":        join(file, []byte{0}),
+		"chunk appended":       join(file, chunk(2)),
+		"bit flipped in chunk": join(file[:header+sealed+5], []byte{file[header+sealed+5] ^ 1}, file[header+sealed+6:]),
+	} {
+		if _, err := decrypt(kr, tampered, b); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := decrypt(kr, file[:header], b); err != ErrTruncated {
+		t.Errorf("every chunk dropped: %v", err)
+	}
+}
+
+func TestBinding(t *testing.T) {
+	kr := testKeyring(t)
+	plain := []byte("bound content")
+	file := encrypt(t, kr.Active(), plain, Binding{Path: "dir/a.txt", Version: 5}, CodecNone)
+
+	for _, b := range []Binding{
+		{Path: "dir/a.txt", Version: 5},
+		// The path is normalised, and no version asks for none in particular
+		{Path: "./dir//a.txt"},
+	} {
+		if got, err := decrypt(kr, file, b); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("decrypt as %+v: %v", b, err)
+		}
+	}
+
+	for _, b := range []Binding{
+		{Path: "dir/b.txt", Version: 5},
+		{Path: "a.txt"},
+		// An older copy replayed where a newer version is expected
+		{Path: "dir/a.txt", Version: 6},
+		{Path: "dir/a.txt", Version: 4},
+	} {
+		_, err := decrypt(kr, file, b)
+		var be *BindingError
+		if !errors.As(err, &be) || !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("decrypt as %+v: %v", b, err)
+		}
+	}
+}
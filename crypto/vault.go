@@ -0,0 +1,213 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DefaultVaultPath is the encrypted keyring used when key_source is "vault".
+	DefaultVaultPath = "storage/keys/vault.json"
+	// MasterKeyEnv holds the base64 master key of a vault not sealed by a passphrase.
+	MasterKeyEnv = "SYNCASE_MASTER_KEY"
+
+	vaultVersion = 1
+)
+
+var vaultAD = []byte("syncase vault v1")
+
+var ErrVaultLocked = errors.New("vault is locked")
+
+// Vault is an encrypted keyring file. The data keys are sealed with a
+// wrapping key derived from a passphrase, or with a random master key when
+// KDF is empty.
+type Vault struct {
+	Version   int        `json:"version"`
+	KDF       *KDFParams `json:"kdf,omitempty"`
+	WrapKeyID string     `json:"wrap_key_id"`
+	Nonce     []byte     `json:"nonce"`
+	Sealed    []byte     `json:"sealed"`
+}
+
+// NewPassphraseWrap derives a fresh wrapping key from passphrase.
+func NewPassphraseWrap(passphrase, kdf string) (*Key, *KDFParams, error) {
+	params, err := NewKDFParams(kdf)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := params.DeriveKey(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := NewKey(secret)
+	return key, params, err
+}
+
+// SealVault encrypts kr under wrap. kdf records how wrap was derived and is
+// nil for a master key.
+func SealVault(kr *Keyring, wrap *Key, kdf *KDFParams) (*Vault, error) {
+	plain, err := kr.marshal()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(wrap.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vault{Version: vaultVersion, KDF: kdf, WrapKeyID: wrap.ID, Nonce: make([]byte, gcm.NonceSize())}
+	if _, err := rand.Read(v.Nonce); err != nil {
+		return nil, err
+	}
+	v.Sealed = gcm.Seal(nil, v.Nonce, plain, vaultAD)
+	return v, nil
+}
+
+// LoadVault reads a vault file.
+func LoadVault(path string) (*Vault, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var v Vault
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("failed to parse vault %s: %w", path, err)
+	}
+	if v.Version != vaultVersion {
+		return nil, fmt.Errorf("unsupported vault version %d", v.Version)
+	}
+	return &v, nil
+}
+
+// Save writes the vault to path, readable by the owner only.
+func (v *Vault) Save(path string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// UsesPassphrase reports whether the vault is sealed by a passphrase rather than a master key.
+func (v *Vault) UsesPassphrase() bool {
+	return v.KDF != nil
+}
+
+// PassphraseKey derives the wrapping key of a passphrase vault.
+func (v *Vault) PassphraseKey(passphrase string) (*Key, error) {
+	if v.KDF == nil {
+		return nil, errors.New("vault is sealed with a master key, not a passphrase")
+	}
+	secret, err := v.KDF.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	if key.ID != v.WrapKeyID {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// Open decrypts the keyring sealed in the vault.
+func (v *Vault) Open(wrap *Key) (*Keyring, error) {
+	if wrap.ID != v.WrapKeyID {
+		return nil, fmt.Errorf("vault is sealed with key %s, not %s", v.WrapKeyID, wrap.ID)
+	}
+	gcm, err := newGCM(wrap.Secret)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, v.Nonce, v.Sealed, vaultAD)
+	if err != nil {
+		return nil, errors.New("vault is corrupted")
+	}
+
+	kr := &Keyring{keys: make(map[string]*Key)}
+	if err := kr.unmarshal(plain); err != nil {
+		return nil, err
+	}
+	if kr.active == "" {
+		return nil, errors.New("vault has no active key")
+	}
+	return kr, nil
+}
+
+// VaultSource reads keys from a vault file, unlocking it with a passphrase
+// or with the master key in MasterKeyEnv.
+type VaultSource struct {
+	Path string
+	// Passphrase supplies the passphrase; ReadPassphrase is used when nil
+	Passphrase func() (string, error)
+
+	wrap *Key
+	kdf  *KDFParams
+}
+
+func (s *VaultSource) Keyring() (*Keyring, error) {
+	v, err := LoadVault(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("key vault is not initialised: %w", err)
+	}
+
+	var wrap *Key
+	if v.UsesPassphrase() {
+		read := s.Passphrase
+		if read == nil {
+			read = func() (string, error) { return ReadPassphrase("Vault passphrase: ") }
+		}
+		passphrase, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if wrap, err = v.PassphraseKey(passphrase); err != nil {
+			return nil, err
+		}
+	} else {
+		b64, ok := os.LookupEnv(MasterKeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("vault is sealed with a master key, set %s", MasterKeyEnv)
+		}
+		secret, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", MasterKeyEnv, err)
+		}
+		if wrap, err = NewKey(secret); err != nil {
+			return nil, err
+		}
+	}
+
+	kr, err := v.Open(wrap)
+	if err != nil {
+		return nil, err
+	}
+	s.wrap, s.kdf = wrap, v.KDF
+	return kr, nil
+}
+
+// SaveKeyring seals kr back into the vault under the key it was unlocked with.
+func (s *VaultSource) SaveKeyring(kr *Keyring) error {
+	if s.wrap == nil {
+		return ErrVaultLocked
+	}
+	v, err := SealVault(kr, s.wrap, s.kdf)
+	if err != nil {
+		return err
+	}
+	return v.Save(s.Path)
+}
@@ -0,0 +1,146 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+)
+
+// fastWrap derives a wrapping key with parameters cheap enough for tests
+func fastWrap(t *testing.T, passphrase string) (*Key, *KDFParams) {
+	t.Helper()
+	params, err := NewKDFParams(KDFArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Time, params.MemoryKiB, params.Threads = 1, 64, 1
+	secret, err := params.DeriveKey(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, params
+}
+
+// unlockVault opens the vault at path with passphrase
+func unlockVault(path, passphrase string) (*Keyring, error) {
+	src := &VaultSource{Path: path, Passphrase: func() (string, error) { return passphrase, nil }}
+	return src.Keyring()
+}
+
+func TestVaultLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault.json")
+	kr := testKeyring(t)
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr.AddIdentity(id)
+
+	// init
+	wrap, params := fastWrap(t, "first")
+	v, err := SealVault(kr, wrap, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// unlock
+	if _, err := unlockVault(path, "wrong"); err != ErrWrongPassphrase {
+		t.Errorf("unlock with a wrong passphrase: %v", err)
+	}
+	opened, err := unlockVault(path, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Active().ID != kr.Active().ID || len(opened.Identities()) != 1 {
+		t.Errorf("vault opened with key %s and %d identities", opened.Active().ID, len(opened.Identities()))
+	}
+
+	// passwd
+	wrap, params = fastWrap(t, "second")
+	if v, err = SealVault(opened, wrap, params); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unlockVault(path, "first"); err != ErrWrongPassphrase {
+		t.Errorf("unlock with the old passphrase: %v", err)
+	}
+	src := &VaultSource{Path: path, Passphrase: func() (string, error) { return "second", nil }}
+	opened, err = src.Keyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key added while unlocked is sealed under the same passphrase
+	next, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.ID += "-next"
+	if err := opened.Add(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveKeyring(opened); err != nil {
+		t.Fatal(err)
+	}
+
+	// export
+	exported := filepath.Join(dir, "recovery.json")
+	wrap, params = fastWrap(t, "recovery")
+	if v, err = SealVault(opened, wrap, params); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(exported); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := unlockVault(exported, "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recovered.Lookup(next.ID); err != nil || len(recovered.Keys()) != 2 {
+		t.Errorf("recovery copy holds %d keys: %v", len(recovered.Keys()), err)
+	}
+	if _, err := unlockVault(exported, "second"); err != ErrWrongPassphrase {
+		t.Errorf("recovery copy opened with the vault passphrase: %v", err)
+	}
+}
+
+func TestVaultMasterKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	kr := testKeyring(t)
+	// As vault init -master-key makes it
+	master, err := NewKey(randomPlaintext(t, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := SealVault(kr, master, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	src := &VaultSource{Path: path}
+	t.Setenv(MasterKeyEnv, base64.StdEncoding.EncodeToString(testKeyring(t).Active().Secret))
+	if _, err := src.Keyring(); err == nil {
+		t.Error("vault opened with another master key")
+	}
+	t.Setenv(MasterKeyEnv, base64.StdEncoding.EncodeToString(master.Secret))
+	opened, err := src.Keyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Active().ID != kr.Active().ID {
+		t.Errorf("vault opened with key %s", opened.Active().ID)
+	}
+}
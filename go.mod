@@ -2,6 +2,14 @@ module Syncase-silent-app-main
 
 go 1.24.5
 
-require github.com/fsnotify/fsnotify v1.9.0
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/klauspost/compress v1.18.0
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.40.0
+	golang.org/x/net v0.42.0
+	golang.org/x/sys v0.34.0
+	golang.org/x/term v0.33.0
+)
 
-require golang.org/x/sys v0.13.0 // indirect
+require github.com/kr/fs v0.1.0 // indirect
@@ -2,6 +2,19 @@
 
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 func main() {
+	if handled, err := runCommand(os.Args[1:]); handled {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	runService()
 }
@@ -0,0 +1,447 @@
+// Package manifest keeps a signed record of every object the agent put on
+// the remote, so the remote can be checked for missing, extra or tampered
+// objects.
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+)
+
+// DefaultDeviceKeyPath holds the Ed25519 key this device signs with.
+const DefaultDeviceKeyPath = "storage/keys/device_ed25519.json"
+
+// DefaultTrustPath lists the public keys of the other devices whose
+// manifests this device accepts.
+const DefaultTrustPath = "storage/keys/trusted_devices.json"
+
+// RemoteDir returns the folder beside the remote root of cfg that holds
+// the manifest of every device writing to it.
+func RemoteDir(cfg *config.Config) string {
+	return cfg.Root() + ".manifest"
+}
+
+// RemoteName returns the file name of the manifest of the device with
+// public key pub.
+func RemoteName(cfg *config.Config, pub ed25519.PublicKey) string {
+	return path.Join(RemoteDir(cfg), DeviceID(pub)+".json")
+}
+
+// DeviceID names a device by a short hash of its public key.
+func DeviceID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// localPath keeps the last manifest this device published, to notice the
+// remote one being rolled back to an older signed copy
+func localPath(cfg *config.Config) string {
+	return cfg.StatePath("manifest.json")
+}
+
+var (
+	ErrBadSignature = errors.New("manifest signature is invalid")
+	ErrOtherDevice  = errors.New("manifest is signed by another device")
+	ErrRolledBack   = errors.New("manifest is older than the last one this device published")
+)
+
+// Entry describes one remote object as it was uploaded, or its deletion.
+type Entry struct {
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Version uint64 `json:"version"`
+	// Deleted marks a tombstone, so the entries other devices keep for the
+	// object are known to be outdated
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Manifest lists every object a device wrote under the remote root by its
+// path there.
+type Manifest struct {
+	Device    string           `json:"device"` // base64 Ed25519 public key
+	Sequence  uint64           `json:"sequence"`
+	Updated   time.Time        `json:"updated"`
+	Entries   map[string]Entry `json:"entries"`
+	Signature string           `json:"signature,omitempty"`
+}
+
+// New returns an empty manifest.
+func New() *Manifest {
+	return &Manifest{Entries: make(map[string]Entry)}
+}
+
+// signedBytes is the canonical encoding the signature covers: the manifest
+// without its signature, with map keys in sorted order.
+func (m *Manifest) signedBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Sign bumps the sequence number and signs the manifest with key.
+func (m *Manifest) Sign(key ed25519.PrivateKey) error {
+	m.Device = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	m.Sequence++
+	m.Updated = time.Now().UTC()
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return nil
+}
+
+// Verify checks that the manifest was signed by pub.
+func (m *Manifest) Verify(pub ed25519.PublicKey) error {
+	if m.Device != base64.StdEncoding.EncodeToString(pub) {
+		return ErrOtherDevice
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return ErrBadSignature
+	}
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func parse(data []byte) (*Manifest, error) {
+	m := New()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.Entries == nil {
+		m.Entries = make(map[string]Entry)
+	}
+	return m, nil
+}
+
+// Fetch downloads the manifest this device keeps on the remote of cfg and
+// verifies it against key. It returns an error wrapping os.ErrNotExist when
+// the remote has none.
+func Fetch(ctx context.Context, cfg *config.Config, store backend.Backend, key ed25519.PrivateKey) (*Manifest, error) {
+	data, err := backend.ReadAll(ctx, store, RemoteName(cfg, key.Public().(ed25519.PublicKey)))
+	if err != nil {
+		return nil, err
+	}
+	m, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Verify(key.Public().(ed25519.PublicKey)); err != nil {
+		return nil, err
+	}
+	if last := LoadLocal(cfg); m.Sequence < last.Sequence {
+		return nil, ErrRolledBack
+	}
+	return m, nil
+}
+
+// FetchOthers downloads the manifests of the other devices writing to the
+// remote of cfg, by device ID. Only devices in trusted are accepted, and
+// each manifest must be signed with the key trusted for its device. The IDs
+// of devices that are not trusted are returned as untrusted; manifests that
+// fail verification are skipped.
+func FetchOthers(ctx context.Context, cfg *config.Config, store backend.Backend, key ed25519.PrivateKey, trusted Trusted) (others map[string]*Manifest, untrusted []string, err error) {
+	objects, err := store.List(ctx, RemoteDir(cfg))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	own := DeviceID(key.Public().(ed25519.PublicKey))
+	others = make(map[string]*Manifest)
+	for _, obj := range objects {
+		id, ok := strings.CutSuffix(path.Base(obj.Path), ".json")
+		if !ok || id == own {
+			continue
+		}
+		pub, ok := trusted[id]
+		if !ok {
+			untrusted = append(untrusted, id)
+			continue
+		}
+		m, err := fetchOther(ctx, store, obj.Path, pub)
+		if err != nil {
+			log.Printf("[MANIFEST WARN] Ignoring manifest of device %s: %v", id, err)
+			continue
+		}
+		others[id] = m
+	}
+	sort.Strings(untrusted)
+	return others, untrusted, nil
+}
+
+func fetchOther(ctx context.Context, store backend.Backend, name string, pub ed25519.PublicKey) (*Manifest, error) {
+	data, err := backend.ReadAll(ctx, store, name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Verify(pub); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Latest returns the latest entry of the object at p among the manifests
+// of several devices: the one with the highest version. Rewrapping keeps
+// the version, so of equal versions the one published last wins.
+func Latest(p string, ms ...*Manifest) (Entry, bool) {
+	var latest Entry
+	var updated time.Time
+	var found bool
+	for _, m := range ms {
+		e, ok := m.Entries[p]
+		if !ok {
+			continue
+		}
+		if !found || e.Version > latest.Version || e.Version == latest.Version && m.Updated.After(updated) {
+			latest, updated, found = e, m.Updated, true
+		}
+	}
+	return latest, found
+}
+
+// Merge combines the manifests of every device writing to a remote into
+// one holding the latest entry of each object, see Latest. Deleted objects
+// keep their tombstones.
+func Merge(ms ...*Manifest) *Manifest {
+	merged := New()
+	for _, m := range ms {
+		for p := range m.Entries {
+			if _, done := merged.Entries[p]; !done {
+				merged.Entries[p], _ = Latest(p, ms...)
+			}
+		}
+	}
+	return merged
+}
+
+// Publish signs the manifest and uploads it beside the remote root.
+func (m *Manifest) Publish(ctx context.Context, cfg *config.Config, store backend.Backend, key ed25519.PrivateKey) error {
+	if err := m.Sign(key); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := RemoteName(cfg, key.Public().(ed25519.PublicKey))
+	if err := store.Put(ctx, name, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath(cfg)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(localPath(cfg), data, 0644)
+}
+
+// LoadLocal returns the last manifest this device published, or an empty
+// one. It is the fallback when the remote manifest cannot be trusted.
+func LoadLocal(cfg *config.Config) *Manifest {
+	data, err := os.ReadFile(localPath(cfg))
+	if err != nil {
+		return New()
+	}
+	m, err := parse(data)
+	if err != nil {
+		return New()
+	}
+	return m
+}
+
+// Report is the result of comparing the remote with its manifest.
+type Report struct {
+	Missing  []string // in the manifest but not on the remote
+	Extra    []string // on the remote but not in the manifest
+	Tampered []string // size or hash differs from the manifest
+	// Unhashed objects could only be checked by size
+	Unhashed []string
+}
+
+// OK reports whether the remote matches the manifest.
+func (r *Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Tampered) == 0
+}
+
+// Compare checks the listed remote objects against the manifest.
+func (m *Manifest) Compare(objects []backend.Object) *Report {
+	r := &Report{}
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		seen[obj.Path] = true
+		e, ok := m.Entries[obj.Path]
+		switch {
+		case !ok, e.Deleted:
+			r.Extra = append(r.Extra, obj.Path)
+		case e.Size != obj.Size:
+			r.Tampered = append(r.Tampered, obj.Path)
+		case obj.Hashes["sha256"] == "":
+			r.Unhashed = append(r.Unhashed, obj.Path)
+		case obj.Hashes["sha256"] != e.SHA256:
+			r.Tampered = append(r.Tampered, obj.Path)
+		}
+	}
+	for path, e := range m.Entries {
+		if !seen[path] && !e.Deleted {
+			r.Missing = append(r.Missing, path)
+		}
+	}
+	sort.Strings(r.Missing)
+	sort.Strings(r.Extra)
+	sort.Strings(r.Tampered)
+	sort.Strings(r.Unhashed)
+	return r
+}
+
+// FillHashes hashes every object the backend reported no SHA-256 for,
+// downloading it unless the backend can hash it in place.
+func FillHashes(ctx context.Context, b backend.Backend, objects []backend.Object) error {
+	for i := range objects {
+		if objects[i].Hashes["sha256"] != "" {
+			continue
+		}
+		sum, err := backend.Hash(ctx, b, objects[i].Path, "sha256")
+		if err != nil {
+			return err
+		}
+		if objects[i].Hashes == nil {
+			objects[i].Hashes = make(map[string]string)
+		}
+		objects[i].Hashes["sha256"] = sum
+	}
+	return nil
+}
+
+// Trusted holds the public keys of the devices whose manifests are
+// accepted, by device ID.
+type Trusted map[string]ed25519.PublicKey
+
+type trustFile struct {
+	Devices []string `json:"devices"` // base64 Ed25519 public keys
+}
+
+// ParseDeviceKey decodes a device public key as printed by DeviceKey.
+func ParseDeviceKey(s string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%q is not a device public key", s)
+	}
+	return pub, nil
+}
+
+// DeviceKey returns the printable form of a device public key.
+func DeviceKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// Add trusts the device with public key pub.
+func (t Trusted) Add(pub ed25519.PublicKey) {
+	t[DeviceID(pub)] = pub
+}
+
+// LoadTrusted reads the list of trusted devices at path. A missing file
+// trusts no other device.
+func LoadTrusted(path string) (Trusted, error) {
+	t := make(Trusted)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f trustFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse trusted devices %s: %w", path, err)
+	}
+	for _, s := range f.Devices {
+		pub, err := ParseDeviceKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted devices %s: %w", path, err)
+		}
+		t.Add(pub)
+	}
+	return t, nil
+}
+
+// SaveTrusted writes the list of trusted devices to path.
+func SaveTrusted(path string, t Trusted) error {
+	f := trustFile{Devices: make([]string, 0, len(t))}
+	for _, pub := range t {
+		f.Devices = append(f.Devices, DeviceKey(pub))
+	}
+	sort.Strings(f.Devices)
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+type deviceKeyFile struct {
+	PrivateKey string `json:"private_key"`
+}
+
+// LoadDeviceKey reads the device signing key at path, creating one on first use.
+func LoadDeviceKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var f deviceKeyFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("failed to parse device key %s: %w", path, err)
+		}
+		seed, err := base64.StdEncoding.DecodeString(f.PrivateKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("device key %s is invalid", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.MarshalIndent(deviceKeyFile{PrivateKey: base64.StdEncoding.EncodeToString(key.Seed())}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
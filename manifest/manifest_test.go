@@ -0,0 +1,186 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyTampered(t *testing.T) {
+	key := newKey(t)
+	m := New()
+	m.Entries["a.enc"] = Entry{Size: 10, SHA256: "aa", Version: 1}
+	if err := m.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	if err := m.Verify(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Entries["a.enc"] = Entry{Size: 10, SHA256: "bb", Version: 1}
+	if err := m.Verify(pub); err != ErrBadSignature {
+		t.Errorf("verify of a changed entry: %v", err)
+	}
+	if err := m.Verify(newKey(t).Public().(ed25519.PublicKey)); err != ErrOtherDevice {
+		t.Errorf("verify against another device: %v", err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	m := New()
+	m.Entries["same"] = Entry{Size: 3, SHA256: "11"}
+	m.Entries["missing"] = Entry{Size: 3, SHA256: "22"}
+	m.Entries["resized"] = Entry{Size: 3, SHA256: "33"}
+	m.Entries["rehashed"] = Entry{Size: 3, SHA256: "44"}
+	m.Entries["unhashed"] = Entry{Size: 3, SHA256: "55"}
+	m.Entries["deleted"] = Entry{Deleted: true}
+
+	r := m.Compare([]backend.Object{
+		{Path: "same", Size: 3, Hashes: map[string]string{"sha256": "11"}},
+		{Path: "resized", Size: 4, Hashes: map[string]string{"sha256": "33"}},
+		{Path: "rehashed", Size: 3, Hashes: map[string]string{"sha256": "ff"}},
+		{Path: "unhashed", Size: 3},
+		{Path: "deleted", Size: 3},
+		{Path: "new", Size: 3},
+	})
+	if r.OK() {
+		t.Error("report is OK")
+	}
+	for name, got := range map[string][]string{"missing": r.Missing, "extra": r.Extra, "tampered": r.Tampered, "unhashed": r.Unhashed} {
+		want := map[string][]string{
+			"missing":  {"missing"},
+			"extra":    {"deleted", "new"},
+			"tampered": {"rehashed", "resized"},
+			"unhashed": {"unhashed"},
+		}[name]
+		if !slices.Equal(got, want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFetchRolledBack(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Config{StateDir: t.TempDir()}
+	store := backend.NewLocal(t.TempDir())
+	key := newKey(t)
+
+	m := New()
+	if err := m.Publish(ctx, cfg, store, key); err != nil {
+		t.Fatal(err)
+	}
+	name := RemoteName(cfg, key.Public().(ed25519.PublicKey))
+	old, err := backend.ReadAll(ctx, store, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(ctx, cfg, store, key); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Fetch(ctx, cfg, store, key); err != nil || got.Sequence != 2 {
+		t.Fatalf("fetch = %v, %v", got, err)
+	}
+
+	// The remote is put back to the first, validly signed manifest
+	if err := store.Put(ctx, name, bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Fetch(ctx, cfg, store, key); err != ErrRolledBack {
+		t.Errorf("fetch of a rolled back manifest: %v", err)
+	}
+}
+
+func TestFetchOthersTrust(t *testing.T) {
+	ctx := context.Background()
+	store := backend.NewLocal(t.TempDir())
+	own, friend, rogue := newKey(t), newKey(t), newKey(t)
+	trusted := make(Trusted)
+	trusted.Add(friend.Public().(ed25519.PublicKey))
+
+	for _, key := range []ed25519.PrivateKey{friend, rogue} {
+		m := New()
+		m.Entries["a.enc"] = Entry{Size: 1, Version: 1}
+		if key.Equal(rogue) {
+			// A higher version would win every lookup if it were accepted
+			m.Entries["a.enc"] = Entry{Size: 2, Version: 99}
+		}
+		cfg := &config.Config{StateDir: t.TempDir()}
+		if err := m.Publish(ctx, cfg, store, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The rogue device also replaces the friend's manifest with one it
+	// signed itself
+	forged := New()
+	forged.Entries["b.enc"] = Entry{Size: 1}
+	if err := forged.Sign(rogue); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{StateDir: t.TempDir()}
+	others, untrusted, err := FetchOthers(ctx, cfg, store, own, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friendID, rogueID := DeviceID(friend.Public().(ed25519.PublicKey)), DeviceID(rogue.Public().(ed25519.PublicKey))
+	if len(others) != 1 || others[friendID] == nil {
+		t.Errorf("accepted manifests of %v", others)
+	}
+	if !slices.Equal(untrusted, []string{rogueID}) {
+		t.Errorf("untrusted = %v, want %s", untrusted, rogueID)
+	}
+	if e, _ := Latest("a.enc", others[friendID]); e.Version != 1 {
+		t.Errorf("latest version = %d", e.Version)
+	}
+
+	if err := store.Put(ctx, RemoteName(cfg, friend.Public().(ed25519.PublicKey)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if others, _, err = FetchOthers(ctx, cfg, store, own, trusted); err != nil || len(others) != 0 {
+		t.Errorf("manifest signed by another key accepted: %v, %v", others, err)
+	}
+}
+
+func TestTrustedFile(t *testing.T) {
+	path := t.TempDir() + "/trusted.json"
+	if trusted, err := LoadTrusted(path); err != nil || len(trusted) != 0 {
+		t.Fatalf("trusted before any were added = %v, %v", trusted, err)
+	}
+	pub := newKey(t).Public().(ed25519.PublicKey)
+	trusted := make(Trusted)
+	trusted.Add(pub)
+	if err := SaveTrusted(path, trusted); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTrusted(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded[DeviceID(pub)].Equal(pub) {
+		t.Errorf("loaded %v", loaded)
+	}
+	if _, err := ParseDeviceKey("not a key"); err == nil {
+		t.Errorf("parse of a bad key: %v", err)
+	}
+}
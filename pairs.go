@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+	syncpkg "Syncase-silent-app-main/sync"
+	"Syncase-silent-app-main/uploader"
+	"Syncase-silent-app-main/watcher"
+)
+
+// pullInterval is how often pull-only pairs bring the remote down again
+const pullInterval = 5 * time.Minute
+
+// syncPair is one sync pair ready to run.
+type syncPair struct {
+	cfg     *config.Config
+	keyring *crypto.Keyring
+}
+
+// label names the pair in messages
+func (p *syncPair) label() string {
+	if p.cfg.Name == "" {
+		return p.cfg.WatchedFolder
+	}
+	return p.cfg.Name
+}
+
+// preparePairs checks the folder of every sync pair of cfg and unlocks its
+// keys. Pairs without a key of their own share the configured keys, which
+// are unlocked once.
+func preparePairs(cfg *config.Config) ([]*syncPair, error) {
+	pairCfgs, err := cfg.SyncPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	var shared *crypto.Keyring
+	var sharedLoaded bool
+	pairs := make([]*syncPair, 0, len(pairCfgs))
+	for _, pc := range pairCfgs {
+		// Resolve absolute path for watched folder
+		pc.WatchedFolder, err = filepath.Abs(pc.WatchedFolder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve watched folder path: %w", err)
+		}
+
+		// Ensure watched folder exists
+		fmt.Println("🗂 Checking watched folder:", pc.WatchedFolder)
+		info, err := os.Stat(pc.WatchedFolder)
+		if err != nil {
+			return nil, fmt.Errorf("watched folder error: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("watched path is not a directory: %s", pc.WatchedFolder)
+		}
+		fmt.Println("✅ Watched folder ready")
+
+		p := &syncPair{cfg: pc}
+		if pc.KeyringPath != "" {
+			if p.keyring, err = crypto.LoadKeys(pc); err != nil {
+				return nil, fmt.Errorf("failed to load encryption key of sync pair %s: %w", p.label(), err)
+			}
+		} else {
+			// Unlock encryption keys (prompts for a passphrase if configured)
+			if !sharedLoaded {
+				if shared, err = loadKeys(cfg); err != nil {
+					return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+				}
+				if shared == nil {
+					fmt.Printf("✍️  Write-only device: encrypting to %d recipients\n", len(cfg.Recipients))
+				}
+				sharedLoaded = true
+			}
+			p.keyring = shared
+		}
+		if p.keyring == nil && pc.SyncDirection() == config.DirectionPull {
+			return nil, fmt.Errorf("sync pair %s pulls, which a write-only device cannot decrypt", p.label())
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs, nil
+}
+
+// runPairs runs every pair until ctx is done or all of them have stopped.
+// A pair that fails does not stop the others.
+func runPairs(ctx context.Context, pairs []*syncPair) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(pairs))
+	for i, p := range pairs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.run(ctx); err != nil {
+				log.Printf("[PAIR ERROR] %s: %v", p.label(), err)
+				errs[i] = fmt.Errorf("%s: %w", p.label(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// run syncs the pair in its direction: pairs that push watch their folder
+// until ctx is done, pull-only pairs pull again every pullInterval.
+func (p *syncPair) run(ctx context.Context) error {
+	cfg := p.cfg
+	log.Printf("[PAIR] %s: %s <-> %s (%s)", p.label(), cfg.WatchedFolder, cfg.Root(), cfg.SyncDirection())
+
+	store, err := uploader.NewBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage backend: %w", err)
+	}
+	defer backend.Close(store)
+
+	// Signed manifest of what this device put on the remote
+	mf, err := syncpkg.OpenManifest(ctx, cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer func() {
+		// Publish what is still waiting for the next batch
+		if err := mf.Flush(context.WithoutCancel(ctx)); err != nil {
+			log.Printf("[MANIFEST WARN] %s: %v", p.label(), err)
+		}
+	}()
+
+	// Write-only devices cannot decrypt, so there is nothing to pull or
+	// rotate; pull-only pairs never write to the remote
+	if p.keyring != nil && cfg.SyncDirection() != config.DirectionPush {
+		// Initial remote → local sync to match folders
+		fmt.Println("🔁 Performing initial remote pull to match folders...")
+		if err := syncpkg.InitialSync(ctx, cfg, store, p.keyring, mf); err != nil {
+			log.Println("[WARN] Initial remote pull failed:", err)
+		} else {
+			log.Println("[INFO] Remote → Local baseline sync completed")
+		}
+	}
+	if p.keyring != nil && cfg.SyncDirection() != config.DirectionPull {
+		// Finish an interrupted key rotation in the background
+		go resumeRotation(ctx, cfg, store, p.keyring, mf)
+	}
+
+	if cfg.SyncDirection() == config.DirectionPull {
+		ticker := time.NewTicker(pullInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			if err := syncpkg.InitialSync(ctx, cfg, store, p.keyring, mf); err != nil {
+				log.Println("[WARN] Remote pull failed:", err)
+			}
+		}
+	}
+
+	// Start watcher (blocking)
+	fmt.Println("👀 Starting watcher...")
+	log.Println("[INFO] Starting folder watcher")
+	if err := watcher.StartWatcher(ctx, cfg, store, p.keyring, mf); err != nil {
+		return fmt.Errorf("watcher exited with error: %w", err)
+	}
+	return nil
+}
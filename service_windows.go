@@ -5,7 +5,6 @@ package main
 import (
 	"Syncase-silent-app-main/config"
 	"Syncase-silent-app-main/uploader"
-	"Syncase-silent-app-main/watcher"
 	"context"
 	"fmt"
 	"log"
@@ -227,21 +226,19 @@ func runApp(ctx context.Context) error {
 		return err
 	}
 
-	cfg.WatchedFolder, err = filepath.Abs(cfg.WatchedFolder)
+	// Passphrase keys are unlocked through SYNCASE_PASSPHRASE when running as a service
+	pairs, err := preparePairs(cfg)
 	if err != nil {
 		return err
 	}
 
-	info, err := os.Stat(cfg.WatchedFolder)
-	if err != nil || !info.IsDir() {
-		return fmt.Errorf("invalid watched folder: %s", cfg.WatchedFolder)
+	// Transfer stats are logged and saved to storage/ while running
+	if err := uploader.LoadStats(); err != nil {
+		log.Println("[WARN] Previous transfer stats not loaded:", err)
 	}
+	defer uploader.SaveStats()
+	go uploader.ReportStats(ctx, statsInterval)
 
-	// Initial sync
-	if err := uploader.SyncRemoteToLocal(ctx, cfg); err != nil {
-		log.Println("[WARN] initial remote pull failed:", err)
-	}
-
-	// BLOCKS here (this is correct)
-	return watcher.StartWatcher(ctx, cfg)
+	// BLOCKS here until the service stops
+	return runPairs(ctx, pairs)
 }
@@ -0,0 +1,162 @@
+// sync/manifest.go
+package sync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	syncstd "sync"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/manifest"
+)
+
+// RemoteTree returns the part of store holding the encrypted tree of cfg;
+// the manifests sit beside it.
+func RemoteTree(cfg *config.Config, store backend.Backend) backend.Backend {
+	return backend.Sub(store, cfg.Root())
+}
+
+// publishDelay batches the updates of uploads that finish close together
+// into one publish of the manifest
+const publishDelay = 30 * time.Second
+
+// Manifest is the signed manifest of this device, shared by everything that
+// writes to the remote so their updates do not overwrite each other, and
+// the manifests of the other devices writing to the same remote.
+type Manifest struct {
+	cfg   *config.Config
+	store backend.Backend
+	key   ed25519.PrivateKey
+	// trusted are the other devices whose manifests are accepted
+	trusted manifest.Trusted
+
+	mu     syncstd.Mutex
+	m      *manifest.Manifest
+	others map[string]*manifest.Manifest
+	// dirty is set while changes wait for the next publish
+	dirty bool
+	timer *time.Timer
+}
+
+// OpenManifest loads the device key and the manifests on the remote. When
+// this device's remote copy is missing or fails verification, the last
+// manifest it published is used instead, so a tampered remote cannot
+// rewrite history.
+func OpenManifest(ctx context.Context, cfg *config.Config, store backend.Backend) (*Manifest, error) {
+	key, err := manifest.LoadDeviceKey(manifest.DefaultDeviceKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := manifest.LoadTrusted(manifest.DefaultTrustPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.Fetch(ctx, cfg, store, key)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[MANIFEST WARN] %v, continuing from the local copy", err)
+		}
+		m = manifest.LoadLocal(cfg)
+	}
+	s := &Manifest{cfg: cfg, store: store, key: key, trusted: trusted, m: m}
+	if err := s.Refresh(ctx); err != nil {
+		log.Printf("[MANIFEST WARN] Manifests of other devices not loaded: %v", err)
+	}
+	return s, nil
+}
+
+// Refresh loads the manifests the trusted devices have published since.
+// Manifests of other devices are ignored.
+func (s *Manifest) Refresh(ctx context.Context) error {
+	others, untrusted, err := manifest.FetchOthers(ctx, s.cfg, s.store, s.key, s.trusted)
+	if err != nil {
+		return err
+	}
+	for _, id := range untrusted {
+		log.Printf("[MANIFEST WARN] Ignoring manifest of untrusted device %s", id)
+	}
+	s.mu.Lock()
+	s.others = others
+	s.mu.Unlock()
+	return nil
+}
+
+// Version returns the version of the latest upload or deletion of the
+// object at remote by any device, 0 if it is unknown.
+func (s *Manifest) Version(remote string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest(remote).Version
+}
+
+func (s *Manifest) latest(remote string) manifest.Entry {
+	ms := make([]*manifest.Manifest, 0, len(s.others)+1)
+	ms = append(ms, s.m)
+	for _, m := range s.others {
+		ms = append(ms, m)
+	}
+	e, _ := manifest.Latest(remote, ms...)
+	return e
+}
+
+// Record stores the entry of an uploaded object. It is published with the
+// next batch.
+func (s *Manifest) Record(remote string, e manifest.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.Entries[remote] = e
+	s.schedule()
+}
+
+// Remove records the deletion of objects. It is published with the next
+// batch.
+func (s *Manifest) Remove(remotes ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, remote := range remotes {
+		s.m.Entries[remote] = manifest.Entry{Version: s.latest(remote).Version + 1, Deleted: true}
+	}
+	s.schedule()
+}
+
+// schedule publishes the pending changes after publishDelay unless Flush
+// does it first. The caller holds s.mu.
+func (s *Manifest) schedule() {
+	s.dirty = true
+	if s.timer != nil {
+		return
+	}
+	s.timer = time.AfterFunc(publishDelay, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if err := s.Flush(ctx); err != nil {
+			log.Printf("[MANIFEST WARN] %v, retrying later", err)
+		}
+	})
+}
+
+// Flush publishes the changes recorded since the last publish, if any. When
+// that fails they are tried again after publishDelay.
+func (s *Manifest) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !s.dirty {
+		return nil
+	}
+	if err := s.m.Publish(ctx, s.cfg, s.store, s.key); err != nil {
+		s.schedule()
+		return fmt.Errorf("failed to publish manifest: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,60 @@
+// sync/names.go
+package sync
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+)
+
+// RemoteNamer maps relative paths in the watched folder to object names on
+// the remote and back. Names are only encrypted when the remote opted in.
+type RemoteNamer struct {
+	names *crypto.NameCipher
+}
+
+// NewRemoteNamer returns the namer for the remote configured in cfg.
+func NewRemoteNamer(cfg *config.Config, keyring *crypto.Keyring) (*RemoteNamer, error) {
+	if !cfg.EncryptNames {
+		return &RemoteNamer{}, nil
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("encrypt_names needs a key, it is not available on write-only devices")
+	}
+	names, err := crypto.NewNameCipher(keyring)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteNamer{names: names}, nil
+}
+
+// RemotePath returns the object name for a slash-separated local relative
+// path. It fails for names too long for the remote once encrypted.
+func (n *RemoteNamer) RemotePath(rel string) (string, error) {
+	if n.names != nil {
+		var err error
+		if rel, err = n.names.EncryptPath(rel); err != nil {
+			return "", err
+		}
+	}
+	remote := rel + ".enc"
+	if base := path.Base(remote); len(base) > crypto.MaxEncryptedName {
+		return "", fmt.Errorf("%s is too long for the remote: its object name has %d characters, the limit is %d", rel, len(base), crypto.MaxEncryptedName)
+	}
+	return remote, nil
+}
+
+// LocalPath returns the local relative path for an object name.
+func (n *RemoteNamer) LocalPath(remote string) (string, error) {
+	rel, ok := strings.CutSuffix(remote, ".enc")
+	if !ok {
+		return "", fmt.Errorf("%s is not an encrypted object", remote)
+	}
+	if n.names != nil {
+		return n.names.DecryptPath(rel)
+	}
+	return rel, nil
+}
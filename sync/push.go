@@ -0,0 +1,276 @@
+// sync/push.go
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	syncstd "sync"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+	"Syncase-silent-app-main/manifest"
+)
+
+// pushStateFile records what was pushed, in the state directory
+const pushStateFile = "push_state.json"
+
+// pushedFile records the version of a local file that is on the remote.
+type pushedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func (p pushedFile) matches(info os.FileInfo) bool {
+	return p.Size == info.Size() && p.ModTime.Equal(info.ModTime())
+}
+
+// Pusher uploads the watched folder to the remote. Every file goes through
+// the same encryption as a single upload; nothing is ever copied as is.
+type Pusher struct {
+	cfg      *config.Config
+	tree     backend.Backend
+	key      crypto.KeyWrapper
+	codec    crypto.Codec
+	namer    *RemoteNamer
+	lock     *FileLock
+	manifest *Manifest
+
+	mu    syncstd.Mutex
+	state map[string]pushedFile
+}
+
+// NewPusher returns a Pusher that uploads to store and encrypts to
+// cfg.Recipients if set and with the active key of keyring otherwise; keyring
+// is nil on write-only devices. lock is the lock shared with the watcher;
+// every upload is recorded in mf.
+func NewPusher(cfg *config.Config, store backend.Backend, keyring *crypto.Keyring, lock *FileLock, mf *Manifest) (*Pusher, error) {
+	namer, err := NewRemoteNamer(cfg, keyring)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.KeyWrapper
+	switch {
+	case len(cfg.Recipients) > 0:
+		if key, err = crypto.ParseRecipients(cfg.Recipients); err != nil {
+			return nil, err
+		}
+	case keyring != nil:
+		key = keyring.Active()
+	default:
+		return nil, fmt.Errorf("no encryption key and no recipients configured")
+	}
+	codec, err := crypto.ParseCodec(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	return &Pusher{
+		cfg:      cfg,
+		tree:     RemoteTree(cfg, store),
+		key:      key,
+		codec:    codec,
+		namer:    namer,
+		lock:     lock,
+		manifest: mf,
+		state:    loadPushState(cfg),
+	}, nil
+}
+
+// Ignored reports whether the file at path is never uploaded: stray
+// encrypted files, and the temporary files of decryptions in progress or
+// left by a crash.
+func Ignored(path string) bool {
+	return strings.HasSuffix(path, ".enc") || strings.HasPrefix(filepath.Base(path), crypto.TempPrefix)
+}
+
+// Upload encrypts one file of the watched folder straight into the remote.
+// The caller holds the file's lock.
+func (p *Pusher) Upload(ctx context.Context, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(p.cfg.WatchedFolder, path)
+	if err != nil {
+		return fmt.Errorf("failed to get relative path: %w", err)
+	}
+	rel = filepath.ToSlash(rel)
+	remote, err := p.namer.RemotePath(rel)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt straight into the upload, bound to its relative path and next
+	// version, so no temporary file ever appears in the watched tree
+	binding := crypto.Binding{Path: rel, Version: p.manifest.Version(remote) + 1}
+	obj, err := backend.Upload(ctx, p.tree, remote, func(w io.Writer) error {
+		return crypto.EncryptFileTo(p.key, w, path, binding, p.codec)
+	}, "sha256")
+	if err != nil {
+		return err
+	}
+	p.manifest.Record(remote, manifest.Entry{Size: obj.Size, SHA256: obj.Hashes["sha256"], Version: binding.Version})
+
+	p.mu.Lock()
+	p.state[rel] = pushedFile{Size: info.Size(), ModTime: info.ModTime()}
+	err = savePushState(p.cfg, p.state)
+	p.mu.Unlock()
+	return err
+}
+
+// PushAll brings the remote in line with the watched folder: files that
+// changed since their last upload are uploaded again, and objects whose
+// local file is gone are deleted. Files locked by the watcher are left to it.
+func (p *Pusher) PushAll(ctx context.Context) error {
+	log.Printf("[SYNC] Local -> Remote: %s", p.cfg.WatchedFolder)
+
+	// New versions must follow what other devices uploaded meanwhile
+	if err := p.manifest.Refresh(ctx); err != nil {
+		log.Printf("[MANIFEST WARN] Manifests of other devices not refreshed: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	var uploaded, failed int
+	// stopped is a failure that every further upload would run into too
+	var stopped error
+
+	err := filepath.Walk(p.cfg.WatchedFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || Ignored(path) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(p.cfg.WatchedFolder, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		p.mu.Lock()
+		prev, ok := p.state[rel]
+		p.mu.Unlock()
+		if ok && prev.matches(info) {
+			return nil
+		}
+
+		acquired, err := p.lock.Acquire(path)
+		if err != nil || !acquired {
+			return nil
+		}
+		defer p.lock.Release(path)
+
+		if err := p.Upload(ctx, path); err != nil {
+			log.Printf("[SYNC ERROR] %s: %v", rel, err)
+			failed++
+			switch backend.Classify(err) {
+			case backend.ClassAuthExpired, backend.ClassQuotaExceeded:
+				stopped = err
+				return filepath.SkipAll
+			}
+			return nil
+		}
+		uploaded++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var deleted []string
+	for _, rel := range p.pushedPaths() {
+		if stopped != nil {
+			// Not every file was seen, so none can be told to be gone
+			break
+		}
+		if seen[rel] {
+			continue
+		}
+		remote, err := p.namer.RemotePath(rel)
+		if err == nil {
+			err = p.tree.Delete(ctx, remote)
+		}
+		if err != nil {
+			log.Printf("[SYNC ERROR] %s: %v", rel, err)
+			failed++
+			continue
+		}
+		p.mu.Lock()
+		delete(p.state, rel)
+		p.mu.Unlock()
+		deleted = append(deleted, remote)
+	}
+	if len(deleted) > 0 {
+		p.manifest.Remove(deleted...)
+	}
+	// Everything this run uploaded and deleted is published at once
+	if err := p.manifest.Flush(ctx); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	err = savePushState(p.cfg, p.state)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[SYNC STATS] %d uploaded, %d deleted, %d failed", uploaded, len(deleted), failed)
+	if stopped != nil {
+		return fmt.Errorf("sync stopped: %w", stopped)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be synced", failed)
+	}
+	return nil
+}
+
+func (p *Pusher) pushedPaths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	paths := make([]string, 0, len(p.state))
+	for rel := range p.state {
+		paths = append(paths, rel)
+	}
+	return paths
+}
+
+func loadPushState(cfg *config.Config) map[string]pushedFile {
+	state := make(map[string]pushedFile)
+	data, err := os.ReadFile(cfg.StatePath(pushStateFile))
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		// Start over; the worst case is uploading everything once more
+		return make(map[string]pushedFile)
+	}
+	return state
+}
+
+func savePushState(cfg *config.Config, state map[string]pushedFile) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := cfg.StatePath(pushStateFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -3,40 +3,211 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"Syncase-silent-app-main/backend"
 	"Syncase-silent-app-main/config"
 	"Syncase-silent-app-main/crypto"
-	"Syncase-silent-app-main/uploader"
 )
 
-func InitialSync(ctx context.Context, cfg *config.Config) error {
+// mirrorStateFile records the ETag of every mirrored object, in the state
+// directory
+const mirrorStateFile = "mirror_etags.json"
+
+// InitialSync mirrors the encrypted remote into cfg.EncryptedFolder and
+// decrypts every object that is newer than its local copy into the watched
+// folder, reversing name encryption on the way. Objects listed in mf must
+// carry the latest version any device recorded there, so an older copy
+// cannot be replayed.
+func InitialSync(ctx context.Context, cfg *config.Config, store backend.Backend, keyring *crypto.Keyring, mf *Manifest) error {
 	fmt.Println("[INITIAL SYNC] Pulling from remote...")
 
-	if err := uploader.SyncRemoteToLocal(ctx, cfg); err != nil {
+	// Objects are bound to the version of whichever device wrote them last
+	if err := mf.Refresh(ctx); err != nil {
+		log.Printf("[MANIFEST WARN] Manifests of other devices not refreshed: %v", err)
+	}
+
+	if err := mirrorRemote(ctx, RemoteTree(cfg, store), cfg.EncryptedFolder, cfg.StatePath(mirrorStateFile)); err != nil {
 		return fmt.Errorf("initial sync failed: %w", err)
 	}
 
+	namer, err := NewRemoteNamer(cfg, keyring)
+	if err != nil {
+		return err
+	}
+
+	// Pulled files are recorded as pushed so they are not uploaded straight back
+	pushed := loadPushState(cfg)
+	defer savePushState(cfg, pushed)
+
 	// Decrypt all .enc files
-	return filepath.Walk(cfg.WatchedFolder, func(path string, info os.FileInfo, err error) error {
+	return filepath.Walk(cfg.EncryptedFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".enc") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(cfg.EncryptedFolder, path)
+		if err != nil {
+			return nil
+		}
+		localRel, err := namer.LocalPath(filepath.ToSlash(rel))
+		if err != nil {
+			fmt.Printf("⚠️  Skipping %s: %v\n", rel, err)
+			return nil
+		}
+
+		// Names come from the remote, so they must not leave the folder
+		out, err := restoreTarget(cfg.WatchedFolder, localRel)
 		if err != nil {
+			fmt.Printf("⚠️  Skipping %s: %v\n", rel, err)
+			return nil
+		}
+		if local, err := os.Stat(out); err == nil && !local.ModTime().Before(info.ModTime()) {
+			// Local copy is as new as the remote one
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		if err := crypto.DecryptFile(keyring, path, out, crypto.Binding{Path: localRel, Version: mf.Version(filepath.ToSlash(rel))}); err != nil {
+			fmt.Printf("⚠️  Failed to decrypt %s: %v\n", localRel, err)
 			return nil
 		}
-		if !info.IsDir() && strings.HasSuffix(path, ".enc") {
-			out := strings.TrimSuffix(path, ".enc")
-			key, keyErr := crypto.LoadKeyFromConfig(cfg.EncryptionKey)
-			if keyErr != nil {
-				return keyErr
+		if info, err := os.Stat(out); err == nil {
+			pushed[localRel] = pushedFile{Size: info.Size(), ModTime: info.ModTime()}
+		}
+		log.Printf("[PULL] %s", localRel)
+		return nil
+	})
+}
+
+// mirrorRemote makes dir an exact copy of tree, downloading only objects
+// that changed since the last run. Decryption into the watched folder
+// happens afterwards.
+func mirrorRemote(ctx context.Context, tree backend.Backend, dir, statePath string) error {
+	log.Printf("[SYNC] Remote -> Local: %s", dir)
+
+	// Backends that sync whole trees themselves do it in one go
+	if m, ok := tree.(backend.Mirrorer); ok {
+		err := m.Mirror(ctx, "", dir)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			if err == nil {
+				log.Println("[SYNC OK] Remote files synced to local")
 			}
-			if err := crypto.DecryptFile(key, path, out); err != nil {
-				fmt.Printf("⚠️  Failed to decrypt %s: %v\n", path, err)
-			} else {
-				os.Remove(path)
+			return err
+		}
+	}
+
+	objects, err := tree.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool, len(objects))
+	known := loadMirrorETags(statePath)
+	etags := make(map[string]string, len(objects))
+	defer saveMirrorETags(statePath, etags)
+	var downloaded, failed int
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Path, ".synclock") || strings.HasPrefix(obj.Path, ".synclocks/") {
+			continue
+		}
+		local, err := restoreTarget(dir, obj.Path)
+		if err != nil {
+			log.Printf("[SYNC ERROR] %s: %v", obj.Path, err)
+			failed++
+			continue
+		}
+		listed[local] = true
+		if info, err := os.Stat(local); err == nil && info.Size() == obj.Size && unchanged(obj, info, known[obj.Path]) {
+			if obj.ETag != "" {
+				etags[obj.Path] = obj.ETag
 			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return err
+		}
+		if err := backend.Download(ctx, tree, obj.Path, local); err != nil {
+			log.Printf("[SYNC ERROR] %s: %v", obj.Path, err)
+			failed++
+			continue
+		}
+		// Keep the remote time so the next run can tell the copy is current
+		os.Chtimes(local, obj.ModTime, obj.ModTime)
+		if obj.ETag != "" {
+			etags[obj.Path] = obj.ETag
+		}
+		downloaded++
+	}
+
+	// Drop copies of objects that are gone from the remote
+	var removed int
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || listed[path] {
+			return nil
+		}
+		if os.Remove(path) == nil {
+			removed++
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[SYNC STATS] %d downloaded, %d removed, %d failed", downloaded, removed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be downloaded", failed)
+	}
+	log.Println("[SYNC OK] Remote files synced to local")
+	return nil
+}
+
+// unchanged reports whether the local copy described by info still holds
+// the content of obj: by ETag where the backend reports one and it was
+// recorded at the last download, by modification time otherwise.
+func unchanged(obj backend.Object, info os.FileInfo, etag string) bool {
+	if obj.ETag != "" && etag != "" {
+		return obj.ETag == etag
+	}
+	return info.ModTime().Equal(obj.ModTime)
+}
+
+func loadMirrorETags(path string) map[string]string {
+	etags := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return etags
+	}
+	if err := json.Unmarshal(data, &etags); err != nil {
+		// Fall back to modification times until the next download
+		return make(map[string]string)
+	}
+	return etags
+}
+
+func saveMirrorETags(path string, etags map[string]string) error {
+	data, err := json.MarshalIndent(etags, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
 }
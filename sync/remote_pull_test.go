@@ -0,0 +1,42 @@
+package sync
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"Syncase-silent-app-main/backend"
+)
+
+// escapingBackend lists objects named to climb out of the folder they are
+// mirrored into.
+type escapingBackend struct {
+	backend.Backend
+}
+
+func (escapingBackend) List(ctx context.Context, dir string) ([]backend.Object, error) {
+	return []backend.Object{{Path: "../escape.enc", Size: 4}, {Path: "a/../../../escape.enc", Size: 4}}, nil
+}
+
+func (escapingBackend) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("data")), nil
+}
+
+func TestMirrorStaysInFolder(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "mirror", "encrypted")
+	if err := mirrorRemote(context.Background(), escapingBackend{}, dir, filepath.Join(root, "etags.json")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(root, "escape.enc"), filepath.Join(root, "mirror", "escape.enc")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("object written to %s", p)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.enc")); err != nil {
+		t.Errorf("object not mirrored inside the folder: %v", err)
+	}
+}
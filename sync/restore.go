@@ -0,0 +1,177 @@
+// sync/restore.go
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	syncstd "sync"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+)
+
+// RestoreOptions describes a disaster-recovery restore.
+type RestoreOptions struct {
+	// Target is the folder the decrypted files are written to.
+	Target string
+	// Include holds path.Match patterns on the restored relative paths. A
+	// pattern also matches everything below a folder it matches. Empty
+	// restores everything.
+	Include []string
+	Workers int
+	// Manifest, if set, gives the version every object it lists must
+	// carry, so an older copy of a file cannot be restored in its place
+	Manifest *Manifest
+}
+
+// RestoreFailure is a file that could not be restored.
+type RestoreFailure struct {
+	Path string
+	Err  error
+}
+
+// RestoreReport summarises a restore.
+type RestoreReport struct {
+	Restored int
+	Skipped  int // filtered out by Include
+	Failed   []RestoreFailure
+}
+
+// Restore decrypts the encrypted tree in src into opts.Target with parallel
+// workers. src must hold the root of the tree, since every file is bound to
+// its path below it. Restore needs neither the agent nor the watched folder;
+// every file is authenticated chunk by chunk and against its path as it is
+// written.
+func Restore(ctx context.Context, cfg *config.Config, src backend.Backend, keyring *crypto.Keyring, opts RestoreOptions, progress func(rel string, err error)) (*RestoreReport, error) {
+	namer, err := NewRemoteNamer(cfg, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	listed, err := src.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]string, 0, len(listed))
+	for _, obj := range listed {
+		objects = append(objects, obj.Path)
+	}
+	sort.Strings(objects)
+
+	report := &RestoreReport{}
+	var mu syncstd.Mutex
+	fail := func(rel string, err error) {
+		mu.Lock()
+		report.Failed = append(report.Failed, RestoreFailure{Path: rel, Err: err})
+		mu.Unlock()
+		if progress != nil {
+			progress(rel, err)
+		}
+	}
+
+	type job struct{ object, rel string }
+	jobs := make(chan job)
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg syncstd.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				b := crypto.Binding{Path: j.rel}
+				if opts.Manifest != nil {
+					b.Version = opts.Manifest.Version(j.object)
+				}
+				err := restoreObject(ctx, src, keyring, opts.Target, j.object, b)
+				if err != nil {
+					fail(j.rel, err)
+					continue
+				}
+				mu.Lock()
+				report.Restored++
+				mu.Unlock()
+				if progress != nil {
+					progress(j.rel, nil)
+				}
+			}
+		}()
+	}
+
+	for _, object := range objects {
+		if ctx.Err() != nil {
+			break
+		}
+		if !strings.HasSuffix(object, ".enc") {
+			// Manifests and other metadata beside the objects
+			continue
+		}
+		rel, err := namer.LocalPath(object)
+		if err != nil {
+			fail(object, err)
+			continue
+		}
+		if !restoreIncluded(rel, opts.Include) {
+			report.Skipped++
+			continue
+		}
+		jobs <- job{object: object, rel: rel}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(report.Failed, func(i, j int) bool { return report.Failed[i].Path < report.Failed[j].Path })
+	return report, ctx.Err()
+}
+
+func restoreObject(ctx context.Context, src backend.Backend, keyring *crypto.Keyring, target, object string, b crypto.Binding) error {
+	out, err := restoreTarget(target, b.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+
+	r, err := src.Get(ctx, object)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return crypto.DecryptReaderToFile(keyring, r, out, b)
+}
+
+// restoreTarget joins rel onto the target folder, refusing paths that would
+// escape it, e.g. from a crafted object name.
+func restoreTarget(target, rel string) (string, error) {
+	out := filepath.Join(target, filepath.FromSlash(path.Clean("/"+rel)))
+	if r, err := filepath.Rel(target, out); err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+	return out, nil
+}
+
+func restoreIncluded(rel string, include []string) bool {
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		// Check rel and each of its parent folders
+		for p := rel; p != "." && p != ""; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
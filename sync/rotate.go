@@ -0,0 +1,246 @@
+// sync/rotate.go
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+	"Syncase-silent-app-main/manifest"
+)
+
+// rotationStateFile tracks a rotation in progress, in the state directory
+const rotationStateFile = "rotation.json"
+
+var errFileBusy = errors.New("file is locked by another sync")
+
+// RotationProgress reports how far a key rotation has got.
+type RotationProgress struct {
+	KeyID   string
+	Total   int
+	Done    int // rewritten in this or an earlier run
+	Skipped int // already under the active key
+	Failed  int
+	Current string
+}
+
+// rotationState is persisted after every object so an interrupted rotation
+// picks up where it stopped.
+type rotationState struct {
+	KeyID   string            `json:"key_id"`
+	Started time.Time         `json:"started"`
+	Done    map[string]bool   `json:"done"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// RotationPending reports whether an earlier rotation did not finish.
+func RotationPending(cfg *config.Config) bool {
+	_, err := os.Stat(cfg.StatePath(rotationStateFile))
+	return err == nil
+}
+
+// MarkRotation records a rotation to keyID as pending without rewriting
+// anything, for the next RotateRemote to carry out. A rotation to keyID
+// that is already under way keeps its progress.
+func MarkRotation(cfg *config.Config, keyID string) error {
+	return saveRotationState(cfg, loadRotationState(cfg, keyID))
+}
+
+// RotateRemote moves every .enc object under the remote root to the active
+// key of kr. Only the wrapped data key in each header changes; files from
+// before per-file data keys are re-encrypted in full. Objects already under
+// the active key are left alone, and progress is saved after each object, so
+// calling it again resumes.
+func RotateRemote(ctx context.Context, cfg *config.Config, store backend.Backend, kr *crypto.Keyring, mf *Manifest, progress func(RotationProgress)) error {
+	active := kr.Active().ID
+	state := loadRotationState(cfg, active)
+
+	tree := RemoteTree(cfg, store)
+	objects, err := tree.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	files := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		files = append(files, obj.Path)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "syncase-rotate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	namer, err := NewRemoteNamer(cfg, kr)
+	if err != nil {
+		return err
+	}
+
+	lock := NewFileLock()
+	p := RotationProgress{KeyID: active}
+	for _, rel := range files {
+		if strings.HasSuffix(rel, ".enc") {
+			p.Total++
+		}
+	}
+	state.Failed = make(map[string]string)
+
+	for _, rel := range files {
+		if !strings.HasSuffix(rel, ".enc") {
+			continue
+		}
+		if state.Done[rel] {
+			p.Done++
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			saveRotationState(cfg, state)
+			// Objects rotated so far are published even so
+			mf.Flush(context.WithoutCancel(ctx))
+			return err
+		}
+
+		p.Current = rel
+		if progress != nil {
+			progress(p)
+		}
+
+		rotated, err := rotateObject(ctx, cfg, tree, kr, mf, namer, lock, tmpDir, rel)
+		switch {
+		case err != nil:
+			log.Printf("[ROTATE ERROR] %s: %v", rel, err)
+			state.Failed[rel] = err.Error()
+			p.Failed++
+		case rotated:
+			state.Done[rel] = true
+			p.Done++
+		default:
+			state.Done[rel] = true
+			p.Skipped++
+		}
+		if err := saveRotationState(cfg, state); err != nil {
+			return err
+		}
+	}
+
+	p.Current = ""
+	if progress != nil {
+		progress(p)
+	}
+	if err := mf.Flush(ctx); err != nil {
+		return err
+	}
+
+	if p.Failed > 0 {
+		return fmt.Errorf("%d of %d objects could not be rotated, run rotate again to retry", p.Failed, p.Total)
+	}
+	log.Printf("[ROTATE OK] %d objects now under key %s", p.Total, active)
+	return os.Remove(cfg.StatePath(rotationStateFile))
+}
+
+// rotateObject reads the header of one object and, unless it already uses
+// the active key, downloads it and uploads it again rewrapped. It reports whether it rewrote the object.
+func rotateObject(ctx context.Context, cfg *config.Config, tree backend.Backend, kr *crypto.Keyring, mf *Manifest,
+	namer *RemoteNamer, lock *FileLock, tmpDir, rel string) (bool, error) {
+
+	localRel, err := namer.LocalPath(rel)
+	if err != nil {
+		return false, err
+	}
+
+	// Hold the watcher's lock on the local file so a concurrent upload of a
+	// newer version cannot be overwritten by the rewrapped old one
+	localPath := filepath.Join(cfg.WatchedFolder, filepath.FromSlash(localRel))
+	acquired, err := lock.Acquire(localPath)
+	if err != nil {
+		return false, err
+	}
+	if !acquired {
+		return false, errFileBusy
+	}
+	defer lock.Release(localPath)
+
+	// Only the header is needed to tell whether the object is current
+	head, err := backend.ReadHead(ctx, tree, rel, crypto.MaxHeaderSize)
+	if err != nil {
+		return false, err
+	}
+	if current, err := usesKey(head, kr.Active().ID); err != nil || current {
+		return false, err
+	}
+
+	oldPath := filepath.Join(tmpDir, "old.enc")
+	newPath := filepath.Join(tmpDir, "new.enc")
+	defer os.Remove(oldPath)
+	defer os.Remove(newPath)
+
+	if err := backend.Download(ctx, tree, rel, oldPath); err != nil {
+		return false, err
+	}
+	version := mf.Version(rel)
+	if err := crypto.RewrapFile(kr, oldPath, newPath, crypto.Binding{Path: localRel, Version: version}); err != nil {
+		return false, fmt.Errorf("rewrap failed: %w", err)
+	}
+	obj, err := backend.UploadFile(ctx, tree, rel, newPath, "sha256")
+	if err != nil {
+		return false, err
+	}
+	mf.Record(rel, manifest.Entry{Size: obj.Size, SHA256: obj.Hashes["sha256"], Version: version})
+	return true, nil
+}
+
+func usesKey(head []byte, keyID string) (bool, error) {
+	h, err := crypto.ReadHeader(bytes.NewReader(head))
+	if err == crypto.ErrNotEncrypted {
+		// Legacy files carry no key id and always need rewriting
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if h.PublicKey() {
+		// Files written for recipients do not depend on the master key
+		return true, nil
+	}
+	return h.KeyID == keyID, nil
+}
+
+func loadRotationState(cfg *config.Config, keyID string) *rotationState {
+	fresh := &rotationState{KeyID: keyID, Started: time.Now(), Done: make(map[string]bool)}
+
+	data, err := os.ReadFile(cfg.StatePath(rotationStateFile))
+	if err != nil {
+		return fresh
+	}
+	var state rotationState
+	if err := json.Unmarshal(data, &state); err != nil || state.KeyID != keyID {
+		// Unreadable, or left over from a rotation to another key
+		return fresh
+	}
+	if state.Done == nil {
+		state.Done = make(map[string]bool)
+	}
+	return &state
+}
+
+func saveRotationState(cfg *config.Config, state *rotationState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := cfg.StatePath(rotationStateFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
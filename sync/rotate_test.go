@@ -0,0 +1,41 @@
+package sync
+
+import (
+	"testing"
+
+	"Syncase-silent-app-main/config"
+)
+
+func TestMarkRotation(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	if RotationPending(cfg) {
+		t.Fatal("rotation pending in a new state directory")
+	}
+	if err := MarkRotation(cfg, "k2"); err != nil {
+		t.Fatal(err)
+	}
+	if !RotationPending(cfg) {
+		t.Fatal("marked rotation not pending")
+	}
+
+	// Marking again keeps the progress of the rotation under way
+	state := loadRotationState(cfg, "k2")
+	state.Done["a.enc"] = true
+	if err := saveRotationState(cfg, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := MarkRotation(cfg, "k2"); err != nil {
+		t.Fatal(err)
+	}
+	if !loadRotationState(cfg, "k2").Done["a.enc"] {
+		t.Error("marking again lost the progress")
+	}
+
+	// A rotation to another key starts over
+	if err := MarkRotation(cfg, "k3"); err != nil {
+		t.Fatal(err)
+	}
+	if state := loadRotationState(cfg, "k3"); len(state.Done) != 0 {
+		t.Errorf("rotation to k3 starts with %v done", state.Done)
+	}
+}
@@ -0,0 +1,238 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+	"Syncase-silent-app-main/config"
+	"Syncase-silent-app-main/crypto"
+	"Syncase-silent-app-main/manifest"
+)
+
+// testDevice is one agent syncing its own folder with the shared remote.
+type testDevice struct {
+	cfg     *config.Config
+	store   backend.Backend
+	keyring *crypto.Keyring
+	mf      *Manifest
+}
+
+func newTestDevice(t *testing.T, store backend.Backend, keyring *crypto.Keyring) *testDevice {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		WatchedFolder:   filepath.Join(dir, "watched"),
+		EncryptedFolder: filepath.Join(dir, "encrypted"),
+		StateDir:        filepath.Join(dir, "state"),
+		EncryptNames:    true,
+	}
+	if err := os.MkdirAll(cfg.WatchedFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Every device signs its manifest with a key of its own
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf := &Manifest{cfg: cfg, store: store, key: key, trusted: make(manifest.Trusted), m: manifest.New()}
+	return &testDevice{cfg: cfg, store: store, keyring: keyring, mf: mf}
+}
+
+// trust makes d accept the manifests of other
+func (d *testDevice) trust(other *testDevice) {
+	d.mf.trusted.Add(other.mf.key.Public().(ed25519.PublicKey))
+}
+
+// push runs a sync the way the watcher does, which starts after the pull
+func (d *testDevice) push(t *testing.T) *Pusher {
+	t.Helper()
+	pusher, err := NewPusher(d.cfg, d.store, d.keyring, NewFileLock(), d.mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pusher.PushAll(context.Background()); err != nil {
+		t.Fatal("push:", err)
+	}
+	return pusher
+}
+
+func (d *testDevice) pull(t *testing.T) {
+	t.Helper()
+	if err := InitialSync(context.Background(), d.cfg, d.store, d.keyring, d.mf); err != nil {
+		t.Fatal("pull:", err)
+	}
+}
+
+func (d *testDevice) write(t *testing.T, rel, content string) {
+	t.Helper()
+	path := filepath.Join(d.cfg.WatchedFolder, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A pull only replaces files older than the remote copy
+	earlier := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, earlier, earlier); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+}
+
+func TestRoundTripLocal(t *testing.T) {
+	// The file lock keeps its lock files in the working directory
+	t.Chdir(t.TempDir())
+	ctx := context.Background()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := crypto.NewKeyring([]*crypto.Key{key}, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := backend.NewLocal(t.TempDir())
+	a := newTestDevice(t, store, keyring)
+	b := newTestDevice(t, store, keyring)
+	a.trust(b)
+	b.trust(a)
+
+	// Push from a, pull into b
+	a.write(t, "a.txt", "first")
+	a.write(t, "dir/b.txt", "second")
+	pusher := a.push(t)
+	objects, err := RemoteTree(a.cfg, store).List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("remote holds %d objects, want 2", len(objects))
+	}
+	for _, obj := range objects {
+		if bytes.Contains([]byte(obj.Path), []byte("txt")) {
+			t.Errorf("object name %s is not encrypted", obj.Path)
+		}
+	}
+	first, err := pusher.namer.RemotePath("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstCopy, err := backend.ReadAll(ctx, RemoteTree(a.cfg, store), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.pull(t)
+	checkFile(t, filepath.Join(b.cfg.WatchedFolder, "a.txt"), "first")
+	checkFile(t, filepath.Join(b.cfg.WatchedFolder, "dir", "b.txt"), "second")
+
+	// A new version from b is bound to the next version and pulled by a
+	b.write(t, "a.txt", "changed")
+	remote, err := b.push(t).namer.RemotePath("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := b.mf.Version(remote); v != 2 {
+		t.Errorf("version after the second upload = %d, want 2", v)
+	}
+	a.pull(t)
+	checkFile(t, filepath.Join(a.cfg.WatchedFolder, "a.txt"), "changed")
+
+	// Deleting a file removes the object and the mirrored copy
+	if err := os.Remove(filepath.Join(a.cfg.WatchedFolder, "dir", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	gone, err := a.push(t).namer.RemotePath("dir/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RemoteTree(a.cfg, store).Stat(ctx, gone); !os.IsNotExist(err) {
+		t.Errorf("deleted object still on the remote: %v", err)
+	}
+	b.pull(t)
+	if _, err := os.Stat(filepath.Join(b.cfg.EncryptedFolder, filepath.FromSlash(gone))); !os.IsNotExist(err) {
+		t.Errorf("mirrored copy of a deleted object was kept: %v", err)
+	}
+
+	// Restore needs nothing but the remote and the keys
+	target := t.TempDir()
+	opts := RestoreOptions{Target: target, Workers: 2, Manifest: a.mf}
+	report, err := Restore(ctx, a.cfg, RemoteTree(a.cfg, store), keyring, opts, nil)
+	if err != nil {
+		t.Fatal("restore:", err)
+	}
+	if report.Restored != 1 || len(report.Failed) != 0 {
+		t.Fatalf("restore: %d restored, failures %v", report.Restored, report.Failed)
+	}
+	checkFile(t, filepath.Join(target, "a.txt"), "changed")
+
+	// An older copy put back on the remote is not restored
+	if err := store.Put(ctx, path.Join(a.cfg.Root(), first), bytes.NewReader(firstCopy)); err != nil {
+		t.Fatal(err)
+	}
+	opts.Target = t.TempDir()
+	report, err = Restore(ctx, a.cfg, RemoteTree(a.cfg, store), keyring, opts, nil)
+	if err != nil {
+		t.Fatal("restore:", err)
+	}
+	if report.Restored != 0 || len(report.Failed) != 1 {
+		t.Errorf("restore of a replayed copy: %d restored, failures %v", report.Restored, report.Failed)
+	}
+}
+
+func TestPushSkipsTempFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx := context.Background()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := crypto.NewKeyring([]*crypto.Key{key}, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := backend.NewLocal(t.TempDir())
+	a := newTestDevice(t, store, keyring)
+	b := newTestDevice(t, store, keyring)
+
+	// A plaintext temp file left by a pull that crashed
+	a.write(t, "a.txt", "content")
+	a.write(t, "dir/"+crypto.TempPrefix+"123", "half a file")
+	a.push(t)
+	objects, err := RemoteTree(a.cfg, store).List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 {
+		t.Errorf("remote holds %d objects, want 1", len(objects))
+	}
+
+	// Pulls decrypt through temp files that are gone once they finish
+	b.pull(t)
+	checkFile(t, filepath.Join(b.cfg.WatchedFolder, "a.txt"), "content")
+	filepath.Walk(b.cfg.WatchedFolder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && Ignored(path) {
+			t.Errorf("%s left in the watched folder", path)
+		}
+		return nil
+	})
+}
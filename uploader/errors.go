@@ -0,0 +1,63 @@
+package uploader
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+
+	"Syncase-silent-app-main/backend"
+)
+
+// rclone exit codes, see https://rclone.org/docs/#exit-code
+const (
+	exitDirNotFound  = 3
+	exitFileNotFound = 4
+	exitFatal        = 7
+)
+
+// rcloneMessages map what rclone and the remotes behind it say to error
+// classes. They are checked in order, as e.g. Google Drive reports rate
+// limits as "403 Forbidden".
+var rcloneMessages = []struct {
+	class   backend.ErrorClass
+	phrases []string
+}{
+	{backend.ClassRateLimited, []string{"ratelimitexceeded", "rate limit", "too many requests", "slowdown", "throttl"}},
+	{backend.ClassQuotaExceeded, []string{"quota", "insufficient storage", "insufficientstorage", "no space left", "storage full"}},
+	{backend.ClassAuthExpired, []string{"invalid_grant", "token expired", "expired token", "couldn't fetch token", "token has been expired", "unauthorized", "invalid_client", "authentication failed"}},
+	{backend.ClassNetwork, []string{"no such host", "connection refused", "network is unreachable", "i/o timeout", "connection reset", "tls handshake timeout", "dial tcp", "no route to host"}},
+	{backend.ClassPermissionDenied, []string{"permission denied", "forbidden", "access denied", "accessdenied", "insufficientfilepermissions"}},
+	{backend.ClassNotFound, []string{"not found", "doesn't exist", "does not exist", "no such file"}},
+}
+
+// classifyMessage returns the class of a failure from what was logged
+// about it.
+func classifyMessage(msg string) backend.ErrorClass {
+	msg = strings.ToLower(msg)
+	for _, m := range rcloneMessages {
+		for _, phrase := range m.phrases {
+			if strings.Contains(msg, phrase) {
+				return m.class
+			}
+		}
+	}
+	return backend.ClassUnknown
+}
+
+// classifyRclone returns the class of a failed rclone command from its exit
+// code and the messages it logged.
+func classifyRclone(err error, msg string) backend.ErrorClass {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case exitDirNotFound, exitFileNotFound:
+			return backend.ClassNotFound
+		}
+	}
+	class := classifyMessage(msg)
+	if class == backend.ClassUnknown && errors.As(err, &exitErr) && exitErr.ExitCode() == exitFatal {
+		// Retries will not help, e.g. a suspended account
+		return backend.ClassPermissionDenied
+	}
+	return class
+}
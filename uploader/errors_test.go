@@ -0,0 +1,81 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"Syncase-silent-app-main/backend"
+)
+
+func TestClassifyMessage(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want backend.ErrorClass
+	}{
+		{"", backend.ClassUnknown},
+		{"something odd happened", backend.ClassUnknown},
+		{"googleapi: Error 403: User Rate Limit Exceeded, rateLimitExceeded", backend.ClassRateLimited},
+		{"HTTP 429 Too Many Requests", backend.ClassRateLimited},
+		{"SlowDown: Please reduce your request rate", backend.ClassRateLimited},
+		{"googleapi: Error 403: The user's Drive storage quota has been exceeded., storageQuotaExceeded", backend.ClassQuotaExceeded},
+		{"write /mnt/nas/x: no space left on device", backend.ClassQuotaExceeded},
+		{"oauth2: cannot fetch token: 400 Bad Request\nResponse: {\"error\":\"invalid_grant\"}", backend.ClassAuthExpired},
+		{"401 Unauthorized", backend.ClassAuthExpired},
+		{"dial tcp: lookup www.googleapis.com: no such host", backend.ClassNetwork},
+		{"read tcp 10.0.0.2:5000: connection reset by peer", backend.ClassNetwork},
+		{"googleapi: Error 403: Forbidden", backend.ClassPermissionDenied},
+		{"AccessDenied: Access Denied", backend.ClassPermissionDenied},
+		{"object not found", backend.ClassNotFound},
+		{"directory NOT FOUND", backend.ClassNotFound},
+		// Earlier classes win: Google Drive reports rate limits as 403
+		{"403 Forbidden: rate limit exceeded", backend.ClassRateLimited},
+		{"permission denied: quota exceeded", backend.ClassQuotaExceeded},
+	} {
+		if got := classifyMessage(tc.msg); got != tc.want {
+			t.Errorf("classifyMessage(%q) = %v, want %v", tc.msg, got, tc.want)
+		}
+	}
+}
+
+// exitError runs the test binary to exit with code and returns its error
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), exitCodeEnv+"="+strconv.Itoa(code))
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != code {
+		t.Fatalf("exit %d: %v", code, err)
+	}
+	return err
+}
+
+func TestClassifyRclone(t *testing.T) {
+	for _, tc := range []struct {
+		code int // 0 for a failure to run rclone at all
+		msg  string
+		want backend.ErrorClass
+	}{
+		{exitDirNotFound, "", backend.ClassNotFound},
+		{exitFileNotFound, "", backend.ClassNotFound},
+		// The exit code decides over the messages
+		{exitFileNotFound, "rate limit exceeded", backend.ClassNotFound},
+		{1, "", backend.ClassUnknown},
+		{1, "HTTP 429 Too Many Requests", backend.ClassRateLimited},
+		{exitFatal, "", backend.ClassPermissionDenied},
+		{exitFatal, "no space left on device", backend.ClassQuotaExceeded},
+		{0, "", backend.ClassUnknown},
+		{0, "connection refused", backend.ClassNetwork},
+	} {
+		err := exec.ErrNotFound
+		if tc.code != 0 {
+			err = exitError(t, tc.code)
+		}
+		if got := classifyRclone(err, tc.msg); got != tc.want {
+			t.Errorf("classifyRclone(exit %d, %q) = %v, want %v", tc.code, tc.msg, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+)
+
+const (
+	// healthInterval is how often a running daemon is checked
+	healthInterval = 30 * time.Second
+	// startTimeout bounds how long a new daemon may take to answer
+	startTimeout = 15 * time.Second
+)
+
+// Daemon is one rclone rc server, usually an "rclone rcd" process started
+// and supervised by StartDaemon, that all transfers go through instead of
+// one rclone process each.
+type Daemon struct {
+	user, pass string
+	client     *http.Client
+	// managed is set for daemons this process started and restarts
+	managed bool
+	// bin is the rclone executable a managed daemon runs
+	bin string
+
+	mu     sync.Mutex
+	url    string
+	cmd    *exec.Cmd
+	exited chan struct{}
+	stop   chan struct{}
+	closed bool
+	// run receives the stats of the current daemon process
+	run *statsRun
+}
+
+// StartDaemon launches "rclone rcd" on a free local port with random
+// credentials and keeps it running: it is health-checked periodically and
+// restarted when it dies, until Close.
+func StartDaemon() (*Daemon, error) {
+	return startDaemon("rclone")
+}
+
+// startDaemon is StartDaemon running the rclone executable bin
+func startDaemon(bin string) (*Daemon, error) {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	d := &Daemon{
+		user:    "syncase",
+		pass:    hex.EncodeToString(secret),
+		client:  &http.Client{},
+		managed: true,
+		bin:     bin,
+		stop:    make(chan struct{}),
+	}
+	d.mu.Lock()
+	err := d.startLocked()
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go d.watch()
+	return d, nil
+}
+
+// sharedDaemon is the one managed daemon of the process: the first backend
+// that needs it starts it and the last one closed stops it, so every pair
+// goes through the same rcd.
+type sharedDaemon struct {
+	// bin is the rclone executable the daemon runs
+	bin string
+
+	mu   sync.Mutex
+	d    *Daemon
+	refs int
+}
+
+// shared is the daemon NewBackend hands to rclone_daemon backends
+var shared = &sharedDaemon{bin: "rclone"}
+
+// acquire returns the running daemon, starting it if there is none, and
+// takes a reference to it.
+func (s *sharedDaemon) acquire() (*Daemon, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.d == nil {
+		d, err := startDaemon(s.bin)
+		if err != nil {
+			return nil, err
+		}
+		s.d = d
+	}
+	s.refs++
+	return s.d, nil
+}
+
+// release drops a reference taken by acquire and stops the daemon with
+// the last one.
+func (s *sharedDaemon) release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == 0 {
+		return nil
+	}
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	d := s.d
+	s.d = nil
+	return d.Close()
+}
+
+// ConnectDaemon returns a Daemon for an rc server that is already running
+// at url, e.g. one started by hand or a fake in tests. It is never
+// restarted.
+func ConnectDaemon(url, user, pass string) *Daemon {
+	return &Daemon{
+		user:   user,
+		pass:   pass,
+		client: &http.Client{},
+		url:    strings.TrimSuffix(url, "/") + "/",
+		run:    newStatsRun(),
+	}
+}
+
+// startLocked launches a new rcd and waits until it answers.
+func (d *Daemon) startLocked() error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(d.bin, "rcd",
+		"--rc-addr", addr,
+		"--rc-user", d.user,
+		"--rc-pass", d.pass,
+		"--rc-serve",
+		"--use-json-log", "-v",
+	)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start rclone rcd: %w", err)
+	}
+	rcdLog := newJSONLog(true)
+	exited := make(chan struct{})
+	go func() {
+		io.Copy(rcdLog, stderr)
+		cmd.Wait()
+		rcdLog.Close()
+		close(exited)
+	}()
+	d.cmd, d.exited, d.url, d.run = cmd, exited, "http://"+addr+"/", rcdLog.run
+
+	deadline := time.Now().Add(startTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := d.post(ctx, d.url, "core/version", nil, nil)
+		cancel()
+		if err == nil {
+			log.Printf("[RCLONE] rcd listening on %s", addr)
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("rclone rcd exited on start: %w", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			d.killLocked()
+			return fmt.Errorf("rclone rcd did not answer within %v: %w", startTimeout, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// killLocked stops the managed process and waits for it to exit
+func (d *Daemon) killLocked() {
+	if d.cmd != nil && d.cmd.Process != nil {
+		d.cmd.Process.Kill()
+		<-d.exited
+	}
+	d.cmd = nil
+}
+
+// runningLocked reports whether the managed process is still alive.
+func (d *Daemon) runningLocked() bool {
+	if d.cmd == nil {
+		return false
+	}
+	select {
+	case <-d.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// endpoint returns the URL to send requests to, restarting a managed
+// daemon that has died.
+func (d *Daemon) endpoint() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return "", errors.New("rclone rcd is shut down")
+	}
+	if d.managed && !d.runningLocked() {
+		log.Println("[RCLONE] rcd is not running, restarting")
+		if err := d.startLocked(); err != nil {
+			return "", err
+		}
+	}
+	return d.url, nil
+}
+
+// restart replaces a managed daemon that stopped answering.
+func (d *Daemon) restart(reason error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.managed || d.closed {
+		return reason
+	}
+	log.Printf("[RCLONE] rcd unhealthy, restarting: %v", reason)
+	d.killLocked()
+	return d.startLocked()
+}
+
+// watch checks the daemon every healthInterval and restarts it when it
+// does not answer.
+func (d *Daemon) watch() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.check()
+	}
+}
+
+// check restarts the daemon unless it answers a stats request
+func (d *Daemon) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, err := d.Stats(ctx)
+	cancel()
+	if err != nil {
+		if rerr := d.restart(err); rerr != nil {
+			log.Printf("[RCLONE ERROR] restart failed: %v", rerr)
+		}
+	}
+}
+
+// Close stops a daemon started by StartDaemon.
+func (d *Daemon) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if d.managed {
+		close(d.stop)
+		d.killLocked()
+	}
+	d.run.finish()
+	return nil
+}
+
+// rcError is a failed rc call. Missing objects match fs.ErrNotExist.
+type rcError struct {
+	Method  string
+	Status  int
+	Message string
+}
+
+func (e *rcError) Error() string {
+	return fmt.Sprintf("rclone rc %s: %s (HTTP %d)", e.Method, e.Message, e.Status)
+}
+
+// ErrorClass classifies the failure by its message, as the daemon answers
+// most failures of the remote with a plain 500.
+func (e *rcError) ErrorClass() backend.ErrorClass {
+	if class := classifyMessage(e.Message); class != backend.ClassUnknown {
+		return class
+	}
+	return backend.HTTPClass(e.Status)
+}
+
+func (e *rcError) Is(target error) bool {
+	return target == fs.ErrNotExist && e.ErrorClass() == backend.ClassNotFound
+}
+
+// Call runs the rc method with in as its JSON parameters and decodes the
+// result into out, which may be nil. A managed daemon that cannot be
+// reached is restarted and the call tried once more.
+func (d *Daemon) Call(ctx context.Context, method string, in, out any) error {
+	url, err := d.endpoint()
+	if err != nil {
+		return err
+	}
+	err = d.post(ctx, url, method, in, out)
+	var rcErr *rcError
+	if err == nil || errors.As(err, &rcErr) || ctx.Err() != nil || !d.managed {
+		return err
+	}
+	if err := d.restart(err); err != nil {
+		return err
+	}
+	if url, err = d.endpoint(); err != nil {
+		return err
+	}
+	return d.post(ctx, url, method, in, out)
+}
+
+func (d *Daemon) post(ctx context.Context, url, method string, in, out any) error {
+	if in == nil {
+		in = struct{}{}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(ctx, http.MethodPost, url+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeResult(method, resp, out)
+}
+
+// do sends an authenticated request to the daemon.
+func (d *Daemon) do(ctx context.Context, method, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if d.user != "" {
+		req.SetBasicAuth(d.user, d.pass)
+	}
+	return d.client.Do(req)
+}
+
+// decodeResult turns an rc response into out or an rcError.
+func decodeResult(method string, resp *http.Response, out any) error {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &failure) != nil || failure.Error == "" {
+			failure.Error = strings.TrimSpace(string(data))
+		}
+		return &rcError{Method: method, Status: resp.StatusCode, Message: failure.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("unexpected rclone rc %s response: %w", method, err)
+	}
+	return nil
+}
+
+// Stats returns the daemon's transfer statistics and records them for the
+// package Stats; it doubles as the health check.
+func (d *Daemon) Stats(ctx context.Context) (*TransferStats, error) {
+	var stats TransferStats
+	if err := d.Call(ctx, "core/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.run.update(stats)
+	d.mu.Unlock()
+	return &stats, nil
+}
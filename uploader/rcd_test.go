@@ -0,0 +1,298 @@
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"Syncase-silent-app-main/backend"
+)
+
+// fakeRCDEnv makes the test binary run as a fake "rclone rcd"
+const fakeRCDEnv = "SYNCASE_FAKE_RCD"
+
+// exitCodeEnv makes the test binary exit with the code it is set to, like
+// a failed rclone command
+const exitCodeEnv = "SYNCASE_EXIT_CODE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeRCDEnv) == "1" {
+		fakeRCD(os.Args[1:])
+		return
+	}
+	if code := os.Getenv(exitCodeEnv); code != "" {
+		n, _ := strconv.Atoi(code)
+		os.Exit(n)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeRCD serves a fakeRC with the address and credentials rcd is
+// started with, until it is killed or told to exit.
+func fakeRCD(args []string) {
+	f := newFakeRC()
+	var addr string
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "--rc-addr":
+			addr = args[i+1]
+		case "--rc-user":
+			f.user = args[i+1]
+		case "--rc-pass":
+			f.pass = args[i+1]
+		}
+	}
+	f.exit = func() { os.Exit(1) }
+	http.ListenAndServe(addr, f)
+	os.Exit(2)
+}
+
+// fakeRC answers the rc methods the backend and the health check use, for
+// a remote held in memory.
+type fakeRC struct {
+	user, pass string
+	// exit ends the daemon, for "fake/exit"
+	exit func()
+
+	mu        sync.Mutex
+	objects   map[string][]byte
+	unhealthy bool
+}
+
+func newFakeRC() *fakeRC {
+	return &fakeRC{objects: make(map[string][]byte)}
+}
+
+func (f *fakeRC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != f.user || pass != f.pass {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]any{"error": "authentication failed"})
+		return
+	}
+	var in struct {
+		Remote string
+		Opt    struct {
+			ShowHash  bool     `json:"showHash"`
+			HashTypes []string `json:"hashTypes"`
+		}
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out any = map[string]any{}
+	switch r.URL.Path {
+	case "/core/version":
+		out = map[string]any{"version": "v1.70.0-fake"}
+	case "/core/stats":
+		if f.unhealthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			out = map[string]any{"error": "accounting is stuck"}
+			break
+		}
+		out = TransferStats{Bytes: 42, Transfers: 1}
+	case "/operations/fsinfo":
+		out = map[string]any{"Hashes": []string{"sha256", "md5"}}
+	case "/operations/stat":
+		data, ok := f.objects[in.Remote]
+		if !ok {
+			out = map[string]any{"item": nil}
+			break
+		}
+		item := map[string]any{"Path": in.Remote, "Size": len(data), "ModTime": time.Now()}
+		if in.Opt.ShowHash {
+			hashes := map[string]string{}
+			if slices.Contains(in.Opt.HashTypes, "md5") {
+				sum := md5.Sum(data)
+				hashes["md5"] = hex.EncodeToString(sum[:])
+			}
+			if len(in.Opt.HashTypes) != 1 {
+				hashes["unasked"] = "0"
+			}
+			item["Hashes"] = hashes
+		}
+		out = map[string]any{"item": item}
+	case "/operations/deletefile":
+		if _, ok := f.objects[in.Remote]; !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			out = map[string]any{"error": "object not found"}
+			break
+		}
+		delete(f.objects, in.Remote)
+	case "/fake/unhealthy":
+		f.unhealthy = true
+	case "/fake/exit":
+		defer f.exit()
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		out = map[string]any{"error": "couldn't find method " + r.URL.Path}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func TestRcloneRCFake(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRC()
+	f.user, f.pass = "user", "secret"
+	f.objects["dir/obj"] = []byte("content")
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	r := NewRcloneRC(ConnectDaemon(srv.URL, "user", "secret"), "remote:/")
+	if h := r.ReportedHash(ctx); h != "md5" {
+		t.Errorf("reported hash = %q, want md5", h)
+	}
+	obj, err := r.Stat(ctx, "dir/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum([]byte("content"))
+	if obj.Path != "dir/obj" || obj.Size != 7 || obj.Hashes["md5"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("stat = %+v", obj)
+	}
+	if obj.Hashes["unasked"] != "" {
+		t.Error("stat asked for every hash of the remote")
+	}
+	if _, err := r.Stat(ctx, "missing"); backend.Classify(err) != backend.ClassNotFound {
+		t.Errorf("stat of a missing object: %v", err)
+	}
+
+	if err := r.Delete(ctx, "dir/obj"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects) != 0 {
+		t.Error("object not deleted")
+	}
+	if err := r.Delete(ctx, "dir/obj"); err != nil {
+		t.Errorf("delete of a missing object: %v", err)
+	}
+
+	// An unmanaged daemon is only checked, never restarted
+	stats, err := r.d.Stats(ctx)
+	if err != nil || stats.Bytes != 42 {
+		t.Fatalf("stats = %+v, %v", stats, err)
+	}
+	f.mu.Lock()
+	f.unhealthy = true
+	f.mu.Unlock()
+	if _, err := r.d.Stats(ctx); err == nil {
+		t.Error("stats of an unhealthy daemon succeeded")
+	}
+
+	wrong := NewRcloneRC(ConnectDaemon(srv.URL, "user", "wrong"), "remote:/")
+	if _, err := wrong.Stat(ctx, "dir/obj"); backend.Classify(err) != backend.ClassAuthExpired {
+		t.Errorf("stat with wrong credentials: %v", err)
+	}
+}
+
+// pid returns the process id of the daemon's current rcd
+func (d *Daemon) pid() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cmd.Process.Pid
+}
+
+func TestDaemonRestart(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv(fakeRCDEnv, "1")
+	d, err := startDaemon(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	// A daemon that fails its health check is replaced
+	first := d.pid()
+	d.check()
+	if d.pid() != first {
+		t.Fatal("healthy daemon restarted")
+	}
+	if err := d.Call(ctx, "fake/unhealthy", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.check()
+	second := d.pid()
+	if second == first {
+		t.Fatal("unhealthy daemon not restarted")
+	}
+	if _, err := d.Stats(ctx); err != nil {
+		t.Fatalf("stats after restart: %v", err)
+	}
+
+	// A daemon that died is started again by the next call
+	d.Call(ctx, "fake/exit", nil, nil)
+	d.mu.Lock()
+	exited := d.exited
+	d.mu.Unlock()
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("fake rcd did not exit")
+	}
+	if err := d.Call(ctx, "core/version", nil, nil); err != nil {
+		t.Fatalf("call after the daemon died: %v", err)
+	}
+	if d.pid() == second {
+		t.Error("dead daemon not restarted")
+	}
+
+	d.Close()
+	if err := d.Call(ctx, "core/version", nil, nil); err == nil {
+		t.Error("call after Close succeeded")
+	}
+}
+
+func TestSharedDaemon(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv(fakeRCDEnv, "1")
+	s := &sharedDaemon{bin: os.Args[0]}
+
+	// Every backend gets the same rcd
+	a, err := s.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	b, err := s.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("second acquire started another daemon")
+	}
+	first, second := NewRcloneRC(a, "remote:/"), NewRcloneRC(b, "remote:/")
+	first.shared, second.shared = s, s
+
+	// It keeps running until the last backend is closed
+	first.Close()
+	first.Close()
+	if err := b.Call(ctx, "core/version", nil, nil); err != nil {
+		t.Fatalf("daemon stopped while still in use: %v", err)
+	}
+	second.Close()
+	if err := b.Call(ctx, "core/version", nil, nil); err == nil {
+		t.Error("daemon still running after the last backend closed")
+	}
+
+	// The next backend starts a new one
+	c, err := s.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.release()
+	if c == a {
+		t.Error("stopped daemon handed out again")
+	}
+	if err := c.Call(ctx, "core/version", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
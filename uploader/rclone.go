@@ -3,467 +3,380 @@ package uploader
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"Syncase-silent-app-main/backend"
 	"Syncase-silent-app-main/config"
 )
 
-const (
-	maxUploadAttempts = 3
-	maxSyncAttempts   = 3
-	rcloneTimeout     = 10 * time.Minute
-)
+const rcloneTimeout = 10 * time.Minute
 
-// UploadWithRclone uploads a single file to the remote with retries and verification
-func UploadWithRclone(ctx context.Context, cfg *config.Config, localPath string) error {
-	// Get absolute path for local file
-	absLocalPath, err := filepath.Abs(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path: %w", err)
+// NewBackend returns the storage backend configured in cfg.
+func NewBackend(cfg *config.Config) (backend.Backend, error) {
+	switch cfg.Backend {
+	case "", "rclone":
+		if cfg.RcloneRemote == "" {
+			return nil, fmt.Errorf("rclone_remote is not configured")
+		}
+		if cfg.RcloneDaemon {
+			// All pairs and commands of the process share one rcd
+			d, err := shared.acquire()
+			if err != nil {
+				return nil, err
+			}
+			rc := NewRcloneRC(d, cfg.RcloneRemote+":/")
+			rc.shared = shared
+			return rc, nil
+		}
+		return NewRclone(cfg.RcloneRemote + ":/"), nil
+	case "local":
+		if cfg.LocalPath == "" {
+			return nil, fmt.Errorf("local_path is not configured")
+		}
+		return backend.NewLocal(cfg.LocalPath), nil
+	case "s3":
+		return newS3(cfg.S3)
+	case "sftp":
+		return newSFTP(cfg.SFTP)
+	case "webdav":
+		return backend.NewWebDAV(backend.WebDAVOptions{
+			URL:      cfg.WebDAV.URL,
+			User:     cfg.WebDAV.User,
+			Password: cfg.WebDAV.Password,
+		})
 	}
+	return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+}
 
-	// Check if file exists
-	if _, err := os.Stat(absLocalPath); err != nil {
-		return fmt.Errorf("local file not found: %w", err)
+func newS3(c config.S3Config) (backend.Backend, error) {
+	opts := backend.S3Options{
+		Endpoint:        c.Endpoint,
+		Region:          c.Region,
+		Bucket:          c.Bucket,
+		Prefix:          c.Prefix,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
 	}
+	if opts.AccessKeyID == "" && opts.SecretAccessKey == "" {
+		opts.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		opts.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		opts.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return backend.NewS3(opts)
+}
 
-	// Get relative path from watched folder
-	relPath, err := filepath.Rel(cfg.WatchedFolder, absLocalPath)
+func newSFTP(c config.SFTPConfig) (backend.Backend, error) {
+	if c.KeyFile == "" {
+		return nil, fmt.Errorf("sftp: key_file is not configured")
+	}
+	key, err := os.ReadFile(c.KeyFile)
 	if err != nil {
-		return fmt.Errorf("failed to get relative path: %w", err)
+		return nil, fmt.Errorf("sftp: failed to read key: %w", err)
 	}
+	addr := c.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return backend.NewSFTP(backend.SFTPOptions{
+		Addr:       addr,
+		User:       c.User,
+		PrivateKey: key,
+		Passphrase: c.KeyPassphrase,
+		HostKey:    c.HostKey,
+		Root:       c.Root,
+	})
+}
 
-	// Construct remote path (ensure forward slashes for rclone)
-	remoteDest := cfg.RcloneRemote + ":/Watched_folder/" + filepath.ToSlash(relPath)
-	log.Printf("[UPLOAD] %s -> %s", filepath.Base(localPath), remoteDest)
-
-	var lastErr error
-
-	for attempt := 1; attempt <= maxUploadAttempts; attempt++ {
-		uploadCtx, cancel := context.WithTimeout(ctx, rcloneTimeout)
-
-		var stdout, stderr bytes.Buffer
-		cmd := exec.CommandContext(
-			uploadCtx,
-			"rclone",
-			"copyto",
-			absLocalPath,
-			remoteDest,
-			"--retries", "2",
-			"--low-level-retries", "3",
-			"--stats", "0",
-			"--progress",
-			"--transfers", "1",
-			"--checkers", "1",
-		)
-
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			lastErr = fmt.Errorf(
-				"upload failed (attempt %d): %v | stderr: %s",
-				attempt, err, strings.TrimSpace(stderr.String()),
-			)
-			log.Println(lastErr)
-			cancel()
-			backoff(attempt)
-			continue
-		}
-
-		cancel()
+// Rclone is a backend that runs the rclone binary for every operation, below
+// an rclone path such as "gdrive:/" or a local folder.
+type Rclone struct {
+	root string
+	hash remoteHash
+}
 
-		// Hard verification
-		if err := verifyRemoteFile(ctx, remoteDest); err != nil {
-			lastErr = fmt.Errorf("verification failed (attempt %d): %w", attempt, err)
-			log.Println(lastErr)
-			backoff(attempt)
-			continue
-		}
+// NewRclone returns a backend rooted at the rclone path root.
+func NewRclone(root string) *Rclone {
+	return &Rclone{root: root}
+}
 
-		log.Printf("[UPLOAD OK] %s verified on remote", filepath.Base(localPath))
-		return nil
+// path returns the rclone path of p below the root
+func (r *Rclone) path(p string) string {
+	if p == "" {
+		return r.root
 	}
-
-	return fmt.Errorf("upload failed after %d attempts: %w", maxUploadAttempts, lastErr)
+	if strings.HasSuffix(r.root, ":") || strings.HasSuffix(r.root, "/") {
+		return r.root + p
+	}
+	return r.root + "/" + p
 }
 
-// verifyRemoteFile ensures the file exists remotely
-func verifyRemoteFile(ctx context.Context, remotePath string) error {
-	verifyCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+// run runs rclone with args and returns its stdout.
+func (r *Rclone) run(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	var stdout, stderr bytes.Buffer
-	cmd := exec.CommandContext(verifyCtx, "rclone", "lsf", remotePath)
+	var stdout bytes.Buffer
+	stderr := newJSONLog(false)
+	defer stderr.Close()
+	cmd := exec.CommandContext(runCtx, "rclone", append(args, jsonLogArgs...)...)
 	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd.Stderr = stderr
 
 	if err := cmd.Run(); err != nil {
-		// Check if the error is "directory not found" (file might be at root)
-		errStr := stderr.String()
-		if strings.Contains(errStr, "directory not found") || strings.Contains(errStr, "Couldn't find") {
-			// Try checking if file exists by checking parent directory
-			if _, err := verifyRemoteHasFiles(ctx, filepath.Dir(remotePath)); err != nil {
-				return fmt.Errorf("parent directory verification failed: %w", err)
-			}
-			return nil
-		}
-		return fmt.Errorf("verify failed: %s", strings.TrimSpace(errStr))
+		return nil, rcloneError(args[0], err, stderr.String())
 	}
+	return stdout.Bytes(), nil
+}
 
-	if strings.TrimSpace(stdout.String()) == "" {
-		return errors.New("remote file missing after upload")
+// rcloneError describes a failed rclone command from the messages it
+// logged, classified by its exit code and those messages.
+func rcloneError(op string, err error, errStr string) error {
+	return &backend.Error{
+		Class: classifyRclone(err, errStr),
+		Op:    "rclone " + op,
+		Err:   fmt.Errorf("%v | stderr: %s", err, errStr),
 	}
-
-	return nil
 }
 
-// SyncLocalToRemote ensures remote mirrors local exactly (sends encrypted files)
-func SyncLocalToRemote(ctx context.Context, cfg *config.Config) error {
-	remoteRoot := cfg.RcloneRemote + ":/Watched_folder"
-	log.Printf("[SYNC] Local -> Remote: %s -> %s", cfg.WatchedFolder, remoteRoot)
-
-	var lastErr error
-
-	for attempt := 1; attempt <= maxSyncAttempts; attempt++ {
-		syncCtx, cancel := context.WithTimeout(ctx, rcloneTimeout)
-
-		var stdout, stderr bytes.Buffer
-		cmd := exec.CommandContext(
-			syncCtx,
-			"rclone",
-			"sync",
-			cfg.WatchedFolder,
-			remoteRoot,
-			"--create-empty-src-dirs",
-			"--exclude", "*.synclock", // Keep .enc files, exclude lock files
-			"--exclude", ".synclocks/**",
-			"--retries", "2",
-			"--low-level-retries", "3",
-			"--stats", "30s",
-			"--progress",
-			"--transfers", "4",
-			"--checkers", "8",
-		)
-
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			lastErr = fmt.Errorf(
-				"sync failed (attempt %d): %v | stderr: %s",
-				attempt, err, strings.TrimSpace(stderr.String()),
-			)
-			log.Println(lastErr)
-			cancel()
-			backoff(attempt)
-			continue
-		}
+func (r *Rclone) Put(ctx context.Context, p string, src io.Reader) error {
+	putCtx, cancel := context.WithTimeout(ctx, rcloneTimeout)
+	defer cancel()
 
-		cancel()
+	stderr := newJSONLog(false)
+	defer stderr.Close()
+	cmd := exec.CommandContext(
+		putCtx,
+		"rclone",
+		append([]string{
+			"rcat",
+			r.path(p),
+			"--low-level-retries", "3",
+		}, jsonLogArgs...)...,
+	)
+	cmd.Stderr = stderr
 
-		// Log sync stats
-		if stdout.Len() > 0 {
-			log.Printf("[SYNC STATS] %s", strings.TrimSpace(stdout.String()))
-		}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start rclone: %w", err)
+	}
 
-		// Verify sync was successful by checking remote has files
-		if ok, err := verifyRemoteHasFiles(ctx, remoteRoot); err != nil {
-			lastErr = fmt.Errorf("remote verification failed: %w", err)
-			backoff(attempt)
-			continue
-		} else if !ok {
-			lastErr = errors.New("remote appears to be empty after sync")
-			backoff(attempt)
-			continue
+	if _, err := io.Copy(stdin, src); err != nil {
+		// Kill rclone before it sees EOF so the partial object is never committed
+		cancel()
+		cmd.Wait()
+		if errStr := stderr.String(); errStr != "" {
+			return fmt.Errorf("%w | stderr: %s", err, errStr)
 		}
-
-		log.Println("[SYNC OK] Local files synced to remote")
-		return nil
+		return err
 	}
+	stdin.Close()
 
-	return fmt.Errorf("sync failed after %d attempts: %w", maxSyncAttempts, lastErr)
+	if err := cmd.Wait(); err != nil {
+		return rcloneError("rcat", err, stderr.String())
+	}
+	return nil
 }
 
-// SyncRemoteToLocal ensures the bidirectional sync from remote to local
-func SyncRemoteToLocal(ctx context.Context, cfg *config.Config) error {
-	remoteRoot := cfg.RcloneRemote + ":/Watched_folder"
-	log.Printf("[SYNC] Remote -> Local: %s -> %s", remoteRoot, cfg.WatchedFolder)
-
-	var lastErr error
-
-	for attempt := 1; attempt <= maxSyncAttempts; attempt++ {
-		syncCtx, cancel := context.WithTimeout(ctx, rcloneTimeout)
-
-		var stdout, stderr bytes.Buffer
-		cmd := exec.CommandContext(
-			syncCtx,
-			"rclone",
-			"sync",
-			remoteRoot,
-			cfg.WatchedFolder,
-			"--create-empty-src-dirs",
-			"--exclude", "*.synclock", // Keep .enc files, exclude lock files
-			"--exclude", ".synclocks/**",
-			"--retries", "2",
-			"--low-level-retries", "3",
-			"--stats", "30s",
-			"--progress",
-			"--transfers", "4",
-			"--checkers", "8",
-		)
-
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			lastErr = fmt.Errorf(
-				"sync failed (attempt %d): %v | stderr: %s",
-				attempt, err, strings.TrimSpace(stderr.String()),
-			)
-			log.Println(lastErr)
-			cancel()
-			backoff(attempt)
-			continue
-		}
+func (r *Rclone) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	getCtx, cancel := context.WithTimeout(ctx, rcloneTimeout)
 
+	rc := &rcloneReader{cancel: cancel, stderr: newJSONLog(false)}
+	rc.cmd = exec.CommandContext(getCtx, "rclone", append([]string{"cat", r.path(p)}, jsonLogArgs...)...)
+	rc.cmd.Stderr = rc.stderr
+	stdout, err := rc.cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		rc.stderr.Close()
+		return nil, err
+	}
+	if err := rc.cmd.Start(); err != nil {
 		cancel()
+		rc.stderr.Close()
+		return nil, fmt.Errorf("failed to start rclone: %w", err)
+	}
+	rc.stdout = stdout
+	return rc, nil
+}
 
-		// Log sync stats
-		if stdout.Len() > 0 {
-			log.Printf("[SYNC STATS] %s", strings.TrimSpace(stdout.String()))
+// rcloneReader streams the output of rclone cat and reports rclone's exit
+// status in place of EOF.
+type rcloneReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr *jsonLog
+	cancel context.CancelFunc
+
+	once sync.Once
+	err  error
+}
+
+func (rc *rcloneReader) Read(b []byte) (int, error) {
+	n, err := rc.stdout.Read(b)
+	if err == io.EOF {
+		if werr := rc.wait(); werr != nil {
+			return n, werr
 		}
+	}
+	return n, err
+}
 
-		// Verify sync was successful by checking local has files
-		if ok, err := verifyLocalHasFiles(cfg.WatchedFolder); err != nil {
-			lastErr = fmt.Errorf("local verification failed: %w", err)
-			backoff(attempt)
-			continue
-		} else if !ok {
-			lastErr = errors.New("local appears to be empty after sync")
-			backoff(attempt)
-			continue
+func (rc *rcloneReader) wait() error {
+	rc.once.Do(func() {
+		if err := rc.cmd.Wait(); err != nil {
+			rc.err = rcloneError("cat", err, rc.stderr.String())
 		}
+		rc.stderr.Close()
+		rc.cancel()
+	})
+	return rc.err
+}
 
-		log.Println("[SYNC OK] Remote files synced to local")
-		return nil
-	}
+func (rc *rcloneReader) Close() error {
+	// Stop a download that is no longer needed
+	rc.cancel()
+	rc.wait()
+	return nil
+}
 
-	return fmt.Errorf("sync failed after %d attempts: %w", maxSyncAttempts, lastErr)
+// lsjsonItem is one entry of rclone lsjson output.
+type lsjsonItem struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Hashes  map[string]string
 }
 
-// verifyRemoteHasFiles checks remote integrity post-sync
-func verifyRemoteHasFiles(ctx context.Context, remoteRoot string) (bool, error) {
-	verifyCtx, cancel := context.WithTimeout(ctx, 1*time.Minute)
-	defer cancel()
+func (item lsjsonItem) object(dir string) backend.Object {
+	return backend.Object{
+		Path:    path.Join(dir, item.Path),
+		Size:    item.Size,
+		ModTime: item.ModTime,
+		Hashes:  item.Hashes,
+	}
+}
 
-	var stdout, stderr bytes.Buffer
-	cmd := exec.CommandContext(
-		verifyCtx,
-		"rclone",
-		"lsf",
-		remoteRoot,
+func (r *Rclone) List(ctx context.Context, dir string) ([]backend.Object, error) {
+	out, err := r.run(ctx, rcloneTimeout,
+		"lsjson",
+		r.path(dir),
 		"--recursive",
 		"--files-only",
-		"--max-depth", "3", // Limit depth for performance
+		"--hash",
+		"--hash-type", "sha256",
 	)
-
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		// Check if error is "directory not found" - might be empty
-		errStr := stderr.String()
-		if strings.Contains(errStr, "directory not found") ||
-			strings.Contains(errStr, "doesn't exist") ||
-			strings.Contains(errStr, "not found") ||
-			strings.Contains(errStr, "Couldn't find") {
-			// Empty remote is okay for first sync
-			return true, nil
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing has been uploaded yet
+			return nil, nil
 		}
-		return false, fmt.Errorf("verify failed: %s", strings.TrimSpace(errStr))
+		return nil, err
 	}
 
-	// Check if we got any output
-	output := strings.TrimSpace(stdout.String())
-	if output == "" {
-		// Empty remote is okay
-		return true, nil
+	var items []lsjsonItem
+	if err := json.Unmarshal(out, &items); err != nil {
+		return nil, fmt.Errorf("unexpected lsjson output: %w", err)
 	}
-
-	// Count files
-	lines := strings.Split(output, "\n")
-	fileCount := 0
-	for _, line := range lines {
-		if strings.TrimSpace(line) != "" {
-			fileCount++
-		}
+	objects := make([]backend.Object, 0, len(items))
+	for _, item := range items {
+		objects = append(objects, item.object(dir))
 	}
+	return objects, nil
+}
 
-	if fileCount > 0 {
-		log.Printf("[VERIFY] Remote has %d files", fileCount)
-	}
-	return true, nil
+// remoteHash remembers the hash uploads to a remote are verified with,
+// once the remote could be asked which hashes it supports.
+type remoteHash struct {
+	mu    sync.Mutex
+	known bool
+	name  string
 }
 
-// verifyLocalHasFiles checks if local folder has files (including .enc files)
-func verifyLocalHasFiles(localRoot string) (bool, error) {
-	fileCount := 0
-	err := filepath.Walk(localRoot, func(path string, info os.FileInfo, err error) error {
+func (h *remoteHash) get(query func() ([]string, error)) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.known {
+		names, err := query()
 		if err != nil {
-			// Skip permission errors
-			if os.IsPermission(err) {
-				return nil
-			}
-			return err
+			log.Printf("[RCLONE] Hashes of the remote unknown, verifying by size: %v", err)
+			return ""
 		}
+		h.name, h.known = backend.PreferredHash(names), true
+	}
+	return h.name
+}
 
-		if !info.IsDir() {
-			// Count all files except lock files
-			if !strings.HasSuffix(path, ".synclock") &&
-				!strings.Contains(path, ".synclocks"+string(os.PathSeparator)) {
-				fileCount++
-			}
+// ReportedHash asks rclone which hashes the remote supports.
+func (r *Rclone) ReportedHash(ctx context.Context) string {
+	return r.hash.get(func() ([]string, error) {
+		out, err := r.run(ctx, 1*time.Minute, "backend", "features", r.root)
+		if err != nil {
+			return nil, err
 		}
-		return nil
+		var features struct{ Hashes []string }
+		if err := json.Unmarshal(out, &features); err != nil {
+			return nil, fmt.Errorf("unexpected features output: %w", err)
+		}
+		return features.Hashes, nil
 	})
-
-	if err != nil {
-		return false, fmt.Errorf("failed to scan local folder: %w", err)
-	}
-
-	if fileCount > 0 {
-		log.Printf("[VERIFY] Local has %d files", fileCount)
-	}
-	return fileCount > 0, nil
 }
 
-// UploadWithVersioning uploads file with timestamped versioning
-func UploadWithVersioning(ctx context.Context, cfg *config.Config, localPath string) error {
-	// Get absolute path for local file
-	absLocalPath, err := filepath.Abs(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path: %w", err)
-	}
-
-	// Check if file exists
-	if _, err := os.Stat(absLocalPath); err != nil {
-		return fmt.Errorf("local file not found: %w", err)
+func (r *Rclone) Stat(ctx context.Context, p string) (*backend.Object, error) {
+	args := []string{"lsjson", r.path(p), "--stat"}
+	// Only the hash uploads are verified with, which may be slow to compute
+	if h := r.ReportedHash(ctx); h != "" {
+		args = append(args, "--hash", "--hash-type", h)
 	}
-
-	// Create timestamped backup on remote
-	timestamp := time.Now().Format("20060102_150405")
-	filename := filepath.Base(localPath)
-	remoteVersionsDest := cfg.RcloneRemote + ":/Watched_folder_versions/" + timestamp + "/" + filename
-
-	log.Printf("[VERSIONING] Creating backup version: %s -> %s", filename, remoteVersionsDest)
-
-	uploadCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
-	defer cancel()
-
-	var stderr bytes.Buffer
-	cmd := exec.CommandContext(
-		uploadCtx,
-		"rclone",
-		"copyto",
-		absLocalPath,
-		remoteVersionsDest,
-		"--retries", "1",
-		"--low-level-retries", "2",
-		"--stats", "0",
-	)
-
-	cmd.Stderr = &stderr
-
-	// Run versioning upload (don't fail main upload if versioning fails)
-	if err := cmd.Run(); err != nil {
-		log.Printf("[VERSIONING WARN] Failed to create backup version: %v - %s",
-			err, strings.TrimSpace(stderr.String()))
-		// Don't return error - versioning is optional
-	} else {
-		log.Printf("[VERSIONING OK] Created backup version: %s", remoteVersionsDest)
+	out, err := r.run(ctx, 1*time.Minute, args...)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
-
-// Simple backoff with jitter
-func backoff(attempt int) {
-	// Exponential backoff with jitter
-	baseDelay := time.Duration(attempt*attempt) * time.Second
-	jitter := time.Duration(attempt*500) * time.Millisecond
-	sleepTime := baseDelay + jitter
-
-	if sleepTime > 30*time.Second {
-		sleepTime = 30 * time.Second
+	var item lsjsonItem
+	if err := json.Unmarshal(out, &item); err != nil {
+		return nil, fmt.Errorf("unexpected lsjson output: %w", err)
 	}
-
-	log.Printf("[BACKOFF] Waiting %v before retry (attempt %d)", sleepTime, attempt)
-	time.Sleep(sleepTime)
+	obj := item.object("")
+	obj.Path = p
+	return &obj, nil
 }
 
-// TestRcloneConnection tests if rclone is working and remote is accessible
-func TestRcloneConnection(ctx context.Context, cfg *config.Config) error {
-	testCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-
-	// Test rclone executable
-	var stderr bytes.Buffer
-	cmd := exec.CommandContext(testCtx, "rclone", "version")
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("rclone not found in PATH: %v - %s",
-			err, strings.TrimSpace(stderr.String()))
-	}
-
-	// Test remote connection
-	testRemote := cfg.RcloneRemote + ":"
-	cmd = exec.CommandContext(testCtx, "rclone", "lsd", testRemote)
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("cannot connect to remote '%s': %v - %s",
-			cfg.RcloneRemote, err, strings.TrimSpace(stderr.String()))
+func (r *Rclone) Delete(ctx context.Context, p string) error {
+	log.Printf("[DELETE] %s", r.path(p))
+	_, err := r.run(ctx, 2*time.Minute,
+		"deletefile",
+		r.path(p),
+		"--retries", "2",
+		"--low-level-retries", "3",
+	)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Already gone
+		return nil
 	}
-
-	return nil
+	return err
 }
 
-// GetRemoteFileList gets list of files from remote
-func GetRemoteFileList(ctx context.Context, cfg *config.Config) ([]string, error) {
-	remoteRoot := cfg.RcloneRemote + ":/Watched_folder"
-	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
-	defer cancel()
-
-	var stdout, stderr bytes.Buffer
-	cmd := exec.CommandContext(
-		ctx,
-		"rclone",
-		"lsf",
-		remoteRoot,
-		"--recursive",
-		"--files-only",
+func (r *Rclone) Move(ctx context.Context, from, to string) error {
+	_, err := r.run(ctx, rcloneTimeout,
+		"moveto",
+		r.path(from),
+		r.path(to),
+		"--retries", "2",
+		"--low-level-retries", "3",
 	)
-
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to list remote files: %s", strings.TrimSpace(stderr.String()))
-	}
-
-	output := strings.TrimSpace(stdout.String())
-	if output == "" {
-		return []string{}, nil
-	}
-
-	return strings.Split(output, "\n"), nil
+	return err
 }
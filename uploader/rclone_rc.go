@@ -0,0 +1,225 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"Syncase-silent-app-main/backend"
+)
+
+// RcloneRC is a backend that sends every operation to a long-running rclone
+// rc server instead of starting rclone each time.
+type RcloneRC struct {
+	d    *Daemon
+	root string
+	// shared is set when d was acquired from it and Close releases it
+	shared *sharedDaemon
+	closed sync.Once
+	hash   remoteHash
+}
+
+// NewRcloneRC returns a backend rooted at the rclone path root that talks
+// to d.
+func NewRcloneRC(d *Daemon, root string) *RcloneRC {
+	return &RcloneRC{d: d, root: root}
+}
+
+// path returns the rclone path of p below the root
+func (r *RcloneRC) path(p string) string {
+	return (&Rclone{root: r.root}).path(p)
+}
+
+// Put streams src to the daemon as a multipart upload.
+func (r *RcloneRC) Put(ctx context.Context, p string, src io.Reader) error {
+	base, err := r.d.endpoint()
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("fs", r.root)
+	query.Set("remote", strings.TrimPrefix(path.Dir("/"+p), "/"))
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("file0", path.Base(p))
+		if err == nil {
+			_, err = io.Copy(part, src)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := r.d.do(ctx, http.MethodPost, base+"operations/uploadfile?"+query.Encode(), form.FormDataContentType(), pr)
+	// Stop the writer if the request ended before the body was consumed
+	pr.CloseWithError(errors.New("upload aborted"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeResult("operations/uploadfile", resp, nil)
+}
+
+// PutFile has the daemon copy the local file itself.
+func (r *RcloneRC) PutFile(ctx context.Context, p, localPath string) error {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return err
+	}
+	return r.d.Call(ctx, "operations/copyfile", map[string]any{
+		"srcFs":     filepath.Dir(abs),
+		"srcRemote": filepath.Base(abs),
+		"dstFs":     r.root,
+		"dstRemote": p,
+	}, nil)
+}
+
+// Get downloads p from the objects the daemon serves with --rc-serve.
+func (r *RcloneRC) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	base, err := r.d.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	resp, err := r.d.do(ctx, http.MethodGet, base+"["+url.PathEscape(r.root)+"]/"+strings.Join(segments, "/"), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeResult("get", resp, nil)
+	}
+	return resp.Body, nil
+}
+
+func (r *RcloneRC) List(ctx context.Context, dir string) ([]backend.Object, error) {
+	var out struct {
+		List []lsjsonItem `json:"list"`
+	}
+	err := r.d.Call(ctx, "operations/list", map[string]any{
+		"fs":     r.root,
+		"remote": dir,
+		"opt": map[string]any{
+			"recurse":   true,
+			"filesOnly": true,
+			"showHash":  true,
+			"hashTypes": []string{"sha256"},
+		},
+	}, &out)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing has been uploaded yet
+			return nil, nil
+		}
+		return nil, err
+	}
+	objects := make([]backend.Object, 0, len(out.List))
+	for _, item := range out.List {
+		// Paths are relative to the root, dir included
+		objects = append(objects, item.object(""))
+	}
+	return objects, nil
+}
+
+// ReportedHash asks the daemon which hashes the remote supports.
+func (r *RcloneRC) ReportedHash(ctx context.Context) string {
+	return r.hash.get(func() ([]string, error) {
+		var out struct {
+			Hashes []string `json:"Hashes"`
+		}
+		err := r.d.Call(ctx, "operations/fsinfo", map[string]any{"fs": r.root}, &out)
+		return out.Hashes, err
+	})
+}
+
+func (r *RcloneRC) Stat(ctx context.Context, p string) (*backend.Object, error) {
+	var out struct {
+		Item *lsjsonItem `json:"item"`
+	}
+	opt := map[string]any{}
+	// Only the hash uploads are verified with, which may be slow to compute
+	if h := r.ReportedHash(ctx); h != "" {
+		opt["showHash"] = true
+		opt["hashTypes"] = []string{h}
+	}
+	err := r.d.Call(ctx, "operations/stat", map[string]any{
+		"fs":     r.root,
+		"remote": p,
+		"opt":    opt,
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, backend.NotFound(p)
+	}
+	obj := out.Item.object("")
+	obj.Path = p
+	return &obj, nil
+}
+
+func (r *RcloneRC) Delete(ctx context.Context, p string) error {
+	log.Printf("[DELETE] %s", r.path(p))
+	err := r.d.Call(ctx, "operations/deletefile", map[string]any{
+		"fs":     r.root,
+		"remote": p,
+	}, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Already gone
+		return nil
+	}
+	return err
+}
+
+func (r *RcloneRC) Move(ctx context.Context, from, to string) error {
+	return r.d.Call(ctx, "operations/movefile", map[string]any{
+		"srcFs":     r.root,
+		"srcRemote": from,
+		"dstFs":     r.root,
+		"dstRemote": to,
+	}, nil)
+}
+
+// Mirror has the daemon sync dir to localDir, leaving out lock files.
+func (r *RcloneRC) Mirror(ctx context.Context, dir, localDir string) error {
+	abs, err := filepath.Abs(localDir)
+	if err != nil {
+		return err
+	}
+	if err := r.d.Call(ctx, "sync/sync", map[string]any{
+		"srcFs": r.path(dir),
+		"dstFs": abs,
+		"_filter": map[string]any{
+			"ExcludeRule": []string{"*.synclock", ".synclocks/**"},
+		},
+	}, nil); err != nil {
+		return fmt.Errorf("rclone sync: %w", err)
+	}
+	return nil
+}
+
+// Close releases the shared daemon if the backend acquired it, which stops
+// it once no other backend uses it.
+func (r *RcloneRC) Close() error {
+	var err error
+	if r.shared != nil {
+		r.closed.Do(func() { err = r.shared.release() })
+	}
+	return err
+}
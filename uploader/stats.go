@@ -0,0 +1,354 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const statsPath = "storage/transfer_stats.json"
+
+// maxEvents is how many file events Stats keeps
+const maxEvents = 200
+
+// jsonLogArgs make rclone log one JSON object per line, including the
+// per-file events and stats parsed by jsonLog.
+var jsonLogArgs = []string{"--use-json-log", "-v", "--stats", "30s"}
+
+// TransferStats are rclone's transfer statistics, as it logs them with
+// --use-json-log and as core/stats reports them.
+type TransferStats struct {
+	Bytes          int64   `json:"bytes"`
+	TotalBytes     int64   `json:"totalBytes"`
+	Speed          float64 `json:"speed"` // bytes per second
+	ETA            float64 `json:"eta"`   // seconds, 0 when unknown
+	Checks         int64   `json:"checks"`
+	TotalChecks    int64   `json:"totalChecks"`
+	Transfers      int64   `json:"transfers"`
+	TotalTransfers int64   `json:"totalTransfers"`
+	Deletes        int64   `json:"deletes"`
+	Renames        int64   `json:"renames"`
+	Errors         int64   `json:"errors"`
+	ElapsedTime    float64 `json:"elapsedTime"` // seconds
+	LastError      string  `json:"lastError,omitempty"`
+	// Transferring lists the files in flight
+	Transferring []FileProgress `json:"transferring,omitempty"`
+}
+
+// FileProgress is the progress of one file in flight.
+type FileProgress struct {
+	Name       string  `json:"name"`
+	Size       int64   `json:"size"`
+	Bytes      int64   `json:"bytes"`
+	Percentage int     `json:"percentage"`
+	Speed      float64 `json:"speed"`
+	ETA        float64 `json:"eta"`
+}
+
+// add folds the counters of o into s. Speed and ETA describe a moment and
+// are not added up.
+func (s *TransferStats) add(o TransferStats) {
+	s.Bytes += o.Bytes
+	s.TotalBytes += o.TotalBytes
+	s.Checks += o.Checks
+	s.TotalChecks += o.TotalChecks
+	s.Transfers += o.Transfers
+	s.TotalTransfers += o.TotalTransfers
+	s.Deletes += o.Deletes
+	s.Renames += o.Renames
+	s.Errors += o.Errors
+	s.ElapsedTime += o.ElapsedTime
+	if o.LastError != "" {
+		s.LastError = o.LastError
+	}
+}
+
+// String summarises s for the log.
+func (s TransferStats) String() string {
+	str := formatBytes(s.Bytes)
+	if s.Speed > 0 {
+		str += fmt.Sprintf(" at %s/s", formatBytes(int64(s.Speed)))
+	}
+	str += fmt.Sprintf(", %d/%d files, %d checks, %d deletes, %d errors",
+		s.Transfers, s.TotalTransfers, s.Checks, s.Deletes, s.Errors)
+	if s.ETA > 0 {
+		str += fmt.Sprintf(", ETA %v", time.Duration(s.ETA)*time.Second)
+	}
+	return str
+}
+
+// formatBytes renders n in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// FileEvent is something rclone logged about one file, such as a copy,
+// a deletion or a failure.
+type FileEvent struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Object  string    `json:"object"`
+	Message string    `json:"msg"`
+}
+
+// StatsSnapshot is what Stats reports.
+type StatsSnapshot struct {
+	Updated time.Time `json:"updated"`
+	// Total adds up every finished rclone run, across restarts
+	Total TransferStats `json:"total"`
+	// Live adds up the runs in progress
+	Live TransferStats `json:"live"`
+	// Running is the number of runs in progress
+	Running int `json:"running"`
+	// Events are the latest file events, oldest first
+	Events []FileEvent `json:"events"`
+}
+
+// statsRecorder collects the stats of every rclone process and daemon.
+type statsRecorder struct {
+	mu     sync.Mutex
+	total  TransferStats
+	live   map[*statsRun]TransferStats
+	events []FileEvent
+}
+
+var recorder = &statsRecorder{live: make(map[*statsRun]TransferStats)}
+
+// statsRun is one rclone process, or one lifetime of a daemon, whose stats
+// count up from zero.
+type statsRun struct {
+	started time.Time
+}
+
+func newStatsRun() *statsRun {
+	run := &statsRun{started: time.Now()}
+	recorder.mu.Lock()
+	recorder.live[run] = TransferStats{}
+	recorder.mu.Unlock()
+	return run
+}
+
+// update replaces the stats of the run with the latest ones rclone reported
+func (run *statsRun) update(s TransferStats) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if _, ok := recorder.live[run]; ok {
+		recorder.live[run] = s
+	}
+}
+
+// finish moves the last stats of the run into the totals
+func (run *statsRun) finish() {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if s, ok := recorder.live[run]; ok {
+		recorder.total.add(s)
+		delete(recorder.live, run)
+	}
+}
+
+func (r *statsRecorder) event(e FileEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	if len(r.events) > maxEvents {
+		r.events = append(r.events[:0:0], r.events[len(r.events)-maxEvents:]...)
+	}
+}
+
+// Stats returns the transfer statistics of this process, on top of the
+// totals loaded by LoadStats.
+func Stats() StatsSnapshot {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	snap := StatsSnapshot{
+		Updated: time.Now(),
+		Total:   recorder.total,
+		Running: len(recorder.live),
+		Events:  append([]FileEvent(nil), recorder.events...),
+	}
+	for _, s := range recorder.live {
+		snap.Live.add(s)
+		snap.Live.Speed += s.Speed
+		snap.Live.ETA = max(snap.Live.ETA, s.ETA)
+		snap.Live.Transferring = append(snap.Live.Transferring, s.Transferring...)
+	}
+	return snap
+}
+
+// LoadStats restores the totals and events saved by SaveStats.
+func LoadStats() error {
+	data, err := os.ReadFile(statsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap StatsSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", statsPath, err)
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.total = snap.Total
+	recorder.events = snap.Events
+	return nil
+}
+
+// SaveStats writes the current Stats to storage/transfer_stats.json.
+func SaveStats() error {
+	data, err := json.MarshalIndent(Stats(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statsPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(statsPath, data, 0600)
+}
+
+// ReportStats logs and saves the stats every interval until ctx is done.
+func ReportStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			SaveStats()
+			return
+		case <-ticker.C:
+		}
+		snap := Stats()
+		if snap.Running > 0 {
+			log.Printf("[TRANSFER STATS] %d running: %s", snap.Running, snap.Live)
+		}
+		log.Printf("[TRANSFER STATS] total: %s", snap.Total)
+		if err := SaveStats(); err != nil {
+			log.Printf("[TRANSFER STATS] failed to save: %v", err)
+		}
+	}
+}
+
+// jsonLogEntry is one line of rclone's --use-json-log output.
+type jsonLogEntry struct {
+	Time   time.Time      `json:"time"`
+	Level  string         `json:"level"`
+	Msg    string         `json:"msg"`
+	Object string         `json:"object"`
+	Stats  *TransferStats `json:"stats"`
+}
+
+// maxMessages bounds the messages a jsonLog keeps, in bytes
+const maxMessages = 64 << 10
+
+// jsonLog is the stderr of an rclone process run with jsonLogArgs. It
+// feeds stats and file events to the recorder and keeps the other
+// messages to report failures with.
+type jsonLog struct {
+	run *statsRun
+	// echo logs the messages as they arrive, for processes nobody waits on
+	echo bool
+
+	mu      sync.Mutex
+	partial []byte
+	msgs    bytes.Buffer
+}
+
+func newJSONLog(echo bool) *jsonLog {
+	return &jsonLog{run: newStatsRun(), echo: echo}
+}
+
+func (l *jsonLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.line(l.partial[:i])
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (l *jsonLog) line(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var e jsonLogEntry
+	if line[0] != '{' || json.Unmarshal(line, &e) != nil {
+		// Output from before logging was set up, or not rclone at all
+		l.message(string(line))
+		return
+	}
+	switch {
+	case e.Stats != nil:
+		l.run.update(*e.Stats)
+	case e.Object != "":
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+		recorder.event(FileEvent{Time: e.Time, Level: e.Level, Object: e.Object, Message: e.Msg})
+		log.Printf("[TRANSFER] %s: %s", e.Object, e.Msg)
+		if e.Level != "info" && e.Level != "debug" {
+			l.message(e.Object + ": " + e.Msg)
+		}
+	case e.Level != "info" && e.Level != "debug":
+		l.message(e.Msg)
+	}
+}
+
+func (l *jsonLog) message(msg string) {
+	if l.echo {
+		// Nobody reads the messages of a long-running process back
+		log.Printf("[RCLONE] %s", msg)
+		return
+	}
+	if l.msgs.Len()+len(msg) >= maxMessages {
+		return
+	}
+	if l.msgs.Len() > 0 {
+		l.msgs.WriteByte('\n')
+	}
+	l.msgs.WriteString(msg)
+}
+
+// String returns the messages that were not stats or file events, as far
+// as they fit in maxMessages. Echoed messages are not kept.
+func (l *jsonLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.TrimSpace(l.msgs.String())
+}
+
+// Close handles a last unterminated line and ends the run.
+func (l *jsonLog) Close() error {
+	l.mu.Lock()
+	if len(l.partial) > 0 {
+		l.line(l.partial)
+		l.partial = nil
+	}
+	l.mu.Unlock()
+	l.run.finish()
+	return nil
+}
@@ -0,0 +1,52 @@
+package uploader
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONLog(t *testing.T) {
+	l := newJSONLog(false)
+	// Lines may arrive split across writes
+	fmt.Fprint(l, `{"level":"info","msg":"stats","stats":{"bytes":10,"transfers":1}}`+"\n"+`{"level":"error","object":"a.enc","msg":"Failed to `)
+	fmt.Fprint(l, `copy: quota exceeded"}`+"\nplain text\n")
+	fmt.Fprint(l, `{"level":"info","msg":"Copied (new)","object":"b.enc"}`)
+
+	recorder.mu.Lock()
+	live := recorder.live[l.run]
+	recorder.mu.Unlock()
+	if live.Bytes != 10 || live.Transfers != 1 {
+		t.Errorf("stats of the run = %+v", live)
+	}
+	l.Close()
+
+	if got, want := l.String(), "a.enc: Failed to copy: quota exceeded\nplain text"; got != want {
+		t.Errorf("messages = %q, want %q", got, want)
+	}
+	events := Stats().Events
+	if n := len(events); n < 2 || events[n-1].Object != "b.enc" || events[n-2].Level != "error" {
+		t.Errorf("latest events = %+v", events)
+	}
+}
+
+func TestJSONLogBounded(t *testing.T) {
+	line := `{"level":"error","msg":"` + strings.Repeat("x", 1000) + `"}` + "\n"
+
+	// A daemon's log is echoed and not kept
+	echo := newJSONLog(true)
+	defer echo.Close()
+	fmt.Fprint(echo, line)
+	if echo.msgs.Len() != 0 {
+		t.Errorf("echoed log keeps %d bytes", echo.msgs.Len())
+	}
+
+	l := newJSONLog(false)
+	defer l.Close()
+	for range 2 * maxMessages / len(line) {
+		fmt.Fprint(l, line)
+	}
+	if n := len(l.String()); n > maxMessages {
+		t.Errorf("log keeps %d bytes", n)
+	}
+}
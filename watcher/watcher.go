@@ -9,10 +9,10 @@ import (
 	syncstd "sync"
 	"time"
 
+	"Syncase-silent-app-main/backend"
 	"Syncase-silent-app-main/config"
 	"Syncase-silent-app-main/crypto"
 	syncpkg "Syncase-silent-app-main/sync"
-	"Syncase-silent-app-main/uploader"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -27,12 +27,16 @@ const (
 	watchWorkers       = 4     // Parallel workers for adding watches
 )
 
-// StartWatcher starts watching the local folder and syncing changes to remote
-func StartWatcher(ctx context.Context, cfg *config.Config) error {
+// StartWatcher starts watching the local folder and syncing changes to remote.
+// New uploads are encrypted with the active key of keyring, or to the
+// configured recipients, and recorded in mf. keyring is nil on write-only devices.
+func StartWatcher(ctx context.Context, cfg *config.Config, store backend.Backend, keyring *crypto.Keyring, mf *syncpkg.Manifest) error {
 	log.Println("[WATCHER] Starting optimized watcher...")
 
-	// Load encryption key
-	key, err := crypto.LoadKeyFromConfig(cfg.EncryptionKey)
+	// Create file lock instance
+	fileLock := syncpkg.NewFileLock()
+
+	pusher, err := syncpkg.NewPusher(cfg, store, keyring, fileLock, mf)
 	if err != nil {
 		return err
 	}
@@ -44,9 +48,6 @@ func StartWatcher(ctx context.Context, cfg *config.Config) error {
 	}
 	defer watcher.Close()
 
-	// Create file lock instance
-	fileLock := syncpkg.NewFileLock()
-
 	var (
 		mu          syncstd.Mutex
 		syncRunning bool
@@ -90,7 +91,7 @@ func StartWatcher(ctx context.Context, cfg *config.Config) error {
 			time.Sleep(syncDebounceTime)
 
 			log.Println("[SYNC] Debounced sync starting...")
-			if err := uploader.SyncLocalToRemote(ctx, cfg); err != nil {
+			if err := pusher.PushAll(ctx); err != nil {
 				log.Println("[SYNC ERROR]", err)
 			} else {
 				log.Println("[SYNC] Completed successfully")
@@ -99,8 +100,8 @@ func StartWatcher(ctx context.Context, cfg *config.Config) error {
 	}
 
 	processFileEvent := func(path string, isDelete bool) {
-		// Skip temporary encrypted files
-		if strings.HasSuffix(path, ".enc") {
+		// Skip stray encrypted files and the temp files of pulls
+		if syncpkg.Ignored(path) {
 			return
 		}
 
@@ -150,7 +151,7 @@ func StartWatcher(ctx context.Context, cfg *config.Config) error {
 		}
 
 		// Process file with locking
-		go processFileWithLock(ctx, path, key, cfg, fileLock, &mu, triggerSync)
+		go processFileWithLock(ctx, path, pusher, fileLock, &mu, triggerSync)
 	}
 
 	for {
@@ -381,7 +382,7 @@ func cleanupPendingOps(ctx context.Context, mu *syncstd.Mutex, pendingOps map[st
 	}
 }
 
-func processFileWithLock(ctx context.Context, filePath string, key []byte, cfg *config.Config,
+func processFileWithLock(ctx context.Context, filePath string, pusher *syncpkg.Pusher,
 	fileLock *syncpkg.FileLock, mu *syncstd.Mutex, triggerSync func()) {
 
 	// Try to acquire lock with timeout
@@ -418,20 +419,8 @@ func processFileWithLock(ctx context.Context, filePath string, key []byte, cfg *
 		return
 	}
 
-	// Create encrypted version
-	encPath := filePath + ".enc"
-	if err := crypto.EncryptFile(key, filePath, encPath); err != nil {
-		log.Println("[ENCRYPT ERROR]", err)
-		return
-	}
-	defer func() {
-		if err := os.Remove(encPath); err != nil && !os.IsNotExist(err) {
-			log.Println("[CLEANUP ERROR] failed to remove temp file:", encPath, err)
-		}
-	}()
-
-	// Upload encrypted file
-	if err := uploader.UploadWithRclone(ctx, cfg, encPath); err != nil {
+	// Encrypt straight into the upload
+	if err := pusher.Upload(ctx, filePath); err != nil {
 		log.Println("[UPLOAD ERROR]", err)
 		return
 	}